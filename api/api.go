@@ -18,6 +18,14 @@ const (
 	post = "POST"
 )
 
+// Capabilities required by handlers.
+type capability int
+
+const (
+	capRead capability = 1 << iota
+	capWrite
+)
+
 // HTTP API for managing a mail queue.
 type API struct {
 	config   *Config
@@ -25,43 +33,60 @@ type API struct {
 	server   *server.AsyncServer
 	serveMux *http.ServeMux
 	queue    *queue.Queue
+	caps     capability
 	stopped  chan bool
 }
 
-// Create a handler that logs and validates requests as they come in. The
-// return value of the handler is assumed to be either an error or a map.
-func (a *API) method(methods []string, handler func(r *http.Request) interface{}) http.HandlerFunc {
+// Create a handler that only accepts requests using one of the methods.
+func (a *API) allow(methods []string, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		foundMethod := false
 		for _, m := range methods {
 			if r.Method == m {
-				foundMethod = true
+				handler(w, r)
+				return
 			}
 		}
-		if foundMethod {
-			v := handler(r)
-			if err, ok := v.(error); ok {
-				v = map[string]string{
-					"error": err.Error(),
-				}
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Create a handler that logs and validates requests as they come in. The
+// return value of the handler is assumed to be either an error or a map.
+func (a *API) method(methods []string, handler func(r *http.Request) interface{}) http.HandlerFunc {
+	return a.allow(methods, func(w http.ResponseWriter, r *http.Request) {
+		v := handler(r)
+		if err, ok := v.(error); ok {
+			v = map[string]string{
+				"error": err.Error(),
 			}
-			if data, err := json.Marshal(v); err == nil {
-				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
-				if r.Method != head {
-					w.Write(data)
-				}
-			} else {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		if data, err := json.Marshal(v); err == nil {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if r.Method != head {
+				w.Write(data)
 			}
 		} else {
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
-	}
+	})
 }
 
-// Create a new API instance for the specified queue.
+// Register a handler that requires the specified capability. Requests for
+// handlers with capabilities that the API lacks are rejected.
+func (a *API) handle(pattern string, c capability, h http.HandlerFunc) {
+	a.serveMux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if a.caps&c == 0 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// Create a new API instance for the specified queue. Handlers that modify the
+// queue are disabled in read-only mode.
 func New(config *Config, queue *queue.Queue) *API {
 	a := &API{
 		config:   config,
@@ -69,13 +94,31 @@ func New(config *Config, queue *queue.Queue) *API {
 		server:   server.New(config.Addr),
 		serveMux: http.NewServeMux(),
 		queue:    queue,
+		caps:     capRead | capWrite,
 		stopped:  make(chan bool),
 	}
+	if config.ReadOnly {
+		a.caps = capRead
+	}
 	a.server.Handler = a
-	a.serveMux.HandleFunc("/v1/raw", a.method([]string{post}, a.raw))
-	a.serveMux.HandleFunc("/v1/send", a.method([]string{post}, a.send))
-	a.serveMux.HandleFunc("/v1/status", a.method([]string{head, get}, a.status))
-	a.serveMux.HandleFunc("/v1/version", a.method([]string{head, get}, a.version))
+	a.handle("/v1/raw", capWrite, a.method([]string{post}, a.raw))
+	a.handle("/v1/send", capWrite, a.method([]string{post}, a.send))
+	a.handle("/v1/pause", capWrite, a.method([]string{post}, a.pause))
+	a.handle("/v1/resume", capWrite, a.method([]string{post}, a.resume))
+	a.handle("/v1/verbosity", capWrite, a.method([]string{post}, a.verbosity))
+	a.handle("/v1/status", capRead, a.method([]string{head, get}, a.status))
+	a.handle("/v1/tags", capRead, a.method([]string{head, get}, a.tags))
+	a.handle("/v1/capabilities", capRead, a.method([]string{head, get}, a.capabilities))
+	a.handle("/v1/blocklists", capRead, a.method([]string{head, get}, a.blocklists))
+	a.handle("/v1/bounces", capRead, a.method([]string{head, get}, a.bounces))
+	a.handle("/v1/captured", capRead, a.method([]string{head, get}, a.captured))
+	a.handle("/v1/connections", capRead, a.method([]string{head, get}, a.connections))
+	a.handle("/v1/cooldowns", capRead, a.method([]string{head, get}, a.cooldowns))
+	a.handle("/v1/downgrades", capRead, a.method([]string{head, get}, a.downgrades))
+	a.handle("/v1/events", capRead, a.allow([]string{head, get}, a.events))
+	a.handle("/v1/history", capRead, a.method([]string{head, get}, a.history))
+	a.handle("/v1/metrics", capRead, a.allow([]string{head, get}, a.metrics))
+	a.handle("/v1/version", capRead, a.method([]string{head, get}, a.version))
 	return a
 }
 
@@ -9,11 +9,15 @@ import (
 )
 
 func createServer(username, password string) (*API, *http.Request, error) {
-	a := New(&Config{
+	return createServerWithConfig(&Config{
 		Addr:     "127.0.0.1:0",
 		Username: username,
 		Password: password,
-	}, nil)
+	})
+}
+
+func createServerWithConfig(config *Config) (*API, *http.Request, error) {
+	a := New(config, nil)
 	if err := a.Start(); err != nil {
 		return nil, nil, err
 	}
@@ -64,3 +68,39 @@ func TestShutdown(t *testing.T) {
 		t.Fatal("error expected")
 	}
 }
+
+func TestReadOnly(t *testing.T) {
+	a, req, err := createServerWithConfig(&Config{
+		Addr:     "127.0.0.1:0",
+		ReadOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	req.Method = "POST"
+	req.URL.Path = "/v1/send"
+	if err := attest.HttpStatusCode(req, http.StatusForbidden); err != nil {
+		t.Fatal(err)
+	}
+	req.Method = "GET"
+	req.URL.Path = "/v1/version"
+	if err := attest.HttpStatusCode(req, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamMethods(t *testing.T) {
+	a, req, err := createServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	req.Method = "POST"
+	for _, p := range []string{"/v1/events", "/v1/metrics"} {
+		req.URL.Path = p
+		if err := attest.HttpStatusCode(req, http.StatusMethodNotAllowed); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -8,4 +8,5 @@ type Config struct {
 	TLSKey     string `json:"tls-key"`
 	Username   string `json:"username"`
 	Password   string `json:"password"`
+	ReadOnly   bool   `json:"read-only"`
 }
@@ -2,38 +2,72 @@ package api
 
 import (
 	"github.com/hectane/hectane/email"
+	"github.com/hectane/hectane/queue"
 	"github.com/hectane/hectane/version"
 
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"time"
 )
 
+// Record the provenance of a message submitted in the request.
+func submission(r *http.Request) *queue.Submission {
+	user, _, _ := r.BasicAuth()
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return &queue.Submission{
+		User:     user,
+		ClientIP: ip,
+		Protocol: queue.SubmissionHTTP,
+		Time:     time.Now(),
+	}
+}
+
 // Send a raw MIME message.
 func (a *API) raw(r *http.Request) interface{} {
 	var raw email.Raw
 	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
 		return err
 	}
+	raw.Submission = submission(r)
 	if err := raw.DeliverToQueue(a.queue); err != nil {
 		return err
 	}
 	return struct{}{}
 }
 
-// Send an email with the specified parameters.
+// Send an email with the specified parameters. Messages that were stored but
+// not yet queued when the request is cancelled are deleted.
 func (a *API) send(r *http.Request) interface{} {
 	var e email.Email
 	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
 		return err
 	}
-	messages, err := e.Messages(a.queue.Storage)
+	e.Submission = submission(r)
+	if err := a.queue.CheckIdentity(e.SendingIdentity); err != nil {
+		return map[string]string{
+			"error": err.Error(),
+		}
+	}
+	messages, err := e.Messages(a.queue)
 	if err != nil {
 		return map[string]string{
 			"error": err.Error(),
 		}
 	}
-	for _, m := range messages {
-		a.queue.Deliver(m)
+	for i, m := range messages {
+		if err := a.queue.DeliverContext(r.Context(), m); err != nil {
+			for _, m := range messages[i:] {
+				if err := a.queue.Storage.DeleteMessage(m); err != nil {
+					a.log.Error(err.Error())
+				}
+			}
+			return err
+		}
 	}
 	return struct{}{}
 }
@@ -43,6 +77,101 @@ func (a *API) status(r *http.Request) interface{} {
 	return a.queue.Status()
 }
 
+// Serve metrics if the metrics backend supports it.
+func (a *API) metrics(w http.ResponseWriter, r *http.Request) {
+	if h, ok := a.queue.Metrics().(http.Handler); ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Pause delivery for the reason provided in the request.
+func (a *API) pause(r *http.Request) interface{} {
+	var p struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return err
+	}
+	a.queue.Pause(p.Reason)
+	return struct{}{}
+}
+
+// Resume delivery after it was paused.
+func (a *API) resume(r *http.Request) interface{} {
+	a.queue.Resume()
+	return struct{}{}
+}
+
+// Override the log level for the host in the request, removing the override
+// if the level is empty, and provide the overrides for each host.
+func (a *API) verbosity(r *http.Request) interface{} {
+	var v struct {
+		Host  string `json:"host"`
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return err
+	}
+	if err := a.queue.SetVerbosity(v.Host, v.Level); err != nil {
+		return err
+	}
+	return a.queue.Verbosity()
+}
+
+// Retrieve the number of bounced recipients for each reason.
+func (a *API) bounces(r *http.Request) interface{} {
+	return a.queue.BounceStatus()
+}
+
+// Retrieve the messages retained for hosts configured to capture them.
+func (a *API) captured(r *http.Request) interface{} {
+	return a.queue.Captured()
+}
+
+// Retrieve the extensions most recently advertised by each host.
+func (a *API) capabilities(r *http.Request) interface{} {
+	return a.queue.Capabilities()
+}
+
+// Retrieve the result of checking each source IP against each DNSBL.
+func (a *API) blocklists(r *http.Request) interface{} {
+	return a.queue.Blocklists()
+}
+
+// Retrieve information about each open connection to a mail server.
+func (a *API) connections(r *http.Request) interface{} {
+	return a.queue.Connections()
+}
+
+// Retrieve the active cooldowns for hosts and source IPs that were rate
+// limited.
+func (a *API) cooldowns(r *http.Request) interface{} {
+	return a.queue.Cooldowns()
+}
+
+// Retrieve the TLS downgrades observed for each host.
+func (a *API) downgrades(r *http.Request) interface{} {
+	return a.queue.Downgrades()
+}
+
+// Retrieve the most recent deliveries, including details of the TLS session
+// used for each.
+func (a *API) history(r *http.Request) interface{} {
+	return a.queue.History()
+}
+
+// Retrieve delivery counts for tagged messages. Query parameters are used to
+// filter the results by tag value.
+func (a *API) tags(r *http.Request) interface{} {
+	filter := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		filter[k] = v[0]
+	}
+	return a.queue.TagStatus(filter)
+}
+
 // Retrieve version information, including the current version of the
 // application.
 func (a *API) version(r *http.Request) interface{} {
@@ -50,3 +179,34 @@ func (a *API) version(r *http.Request) interface{} {
 		"version": version.Version,
 	}
 }
+
+// Stream delivery events to the client as server-sent events until the client
+// disconnects.
+func (a *API) events(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	c := a.queue.Subscribe()
+	defer a.queue.Unsubscribe(c)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	for {
+		select {
+		case e := <-c:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
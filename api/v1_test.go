@@ -0,0 +1,43 @@
+package api
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSendCancelled(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	q, err := queue.NewQueue(&queue.Config{Directory: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Stop()
+	var (
+		a           = New(&Config{}, q)
+		ctx, cancel = context.WithCancel(context.Background())
+		r           = httptest.NewRequest("POST", "/v1/send", strings.NewReader(
+			`{"from": "me@example.com", "to": ["you@example.com", "you@example.org"], "text": "test"}`,
+		))
+	)
+	cancel()
+	if _, ok := a.send(r.WithContext(ctx)).(error); !ok {
+		t.Fatal("error expected")
+	}
+	messages, err := q.Storage.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("%d message(s) left in storage", len(messages))
+	}
+}
@@ -32,10 +32,12 @@ func Parse() (*Config, error) {
 	flag.StringVar(&c.API.TLSKey, "tls-key", "", "private key `file` for TLS")
 	flag.StringVar(&c.API.Username, "username", "", "`username` for HTTP basic auth")
 	flag.StringVar(&c.API.Password, "password", "", "`password` for HTTP basic auth")
+	flag.BoolVar(&c.API.ReadOnly, "read-only", false, "disable API methods that modify the queue")
 	flag.BoolVar(&c.Log.Debug, "debug", false, "show debug log messages")
 	flag.StringVar(&c.Log.Logfile, "logfile", "", "`file` to write log output to")
 	flag.StringVar(&c.Queue.Directory, "directory", path.Join(os.TempDir(), "hectane"), "`directory` for persistent storage")
 	flag.BoolVar(&c.Queue.DisableSSLVerification, "disable-ssl-verification", false, "don't verify SSL certificates")
+	flag.BoolVar(&c.Queue.EnableMetrics, "enable-metrics", false, "serve metrics in the Prometheus format")
 	flag.StringVar(&c.SMTP.Addr, "smtp-addr", ":smtp", "`address` and port for SMTP server")
 	flag.IntVar(&c.SMTP.ReadTimeout, "read-timeout", 900, "`seconds` before client timeout")
 	flag.Parse()
@@ -17,15 +17,26 @@ import (
 
 // Abstract representation of an email.
 type Email struct {
-	From        string       `json:"from"`
-	To          []string     `json:"to"`
-	Cc          []string     `json:"cc"`
-	Bcc         []string     `json:"bcc"`
-	Subject     string       `json:"subject"`
-	Headers     Headers      `json:"headers"`
-	Text        string       `json:"text"`
-	Html        string       `json:"html"`
-	Attachments []Attachment `json:"attachments"`
+	From            string            `json:"from"`
+	To              []string          `json:"to"`
+	Cc              []string          `json:"cc"`
+	Bcc             []string          `json:"bcc"`
+	Subject         string            `json:"subject"`
+	Headers         Headers           `json:"headers"`
+	Text            string            `json:"text"`
+	Html            string            `json:"html"`
+	Attachments     []Attachment      `json:"attachments"`
+	Tags            map[string]string `json:"tags"`
+	DataErrorPolicy string            `json:"data-error-policy"`
+	MaxAttempts     int               `json:"max-attempts"`
+	MaxLifetime     int               `json:"max-lifetime"`
+	Priority        int               `json:"priority"`
+	SendingIdentity string            `json:"sending-identity"`
+	NotifySuccess   bool              `json:"notify-success"`
+	Confidential    bool              `json:"confidential"`
+
+	// Provenance recorded by the server that accepted the email
+	Submission *queue.Submission `json:"-"`
 }
 
 // Write the headers for the email to the specified writer.
@@ -89,8 +100,22 @@ func (e *Email) writeBody(w *multipart.Writer) error {
 	return nil
 }
 
+// Determine if the email was flagged as confidential, either explicitly or
+// with a Sensitivity header.
+func (e *Email) confidential() bool {
+	if e.Confidential {
+		return true
+	}
+	for k, v := range e.Headers {
+		if strings.EqualFold(k, "Sensitivity") && isConfidential(v) {
+			return true
+		}
+	}
+	return false
+}
+
 // Create an array of messages with the specified body.
-func (e *Email) newMessages(s *queue.Storage, from, body string) ([]*queue.Message, error) {
+func (e *Email) newMessages(q *queue.Queue, from, body string) ([]*queue.Message, error) {
 	addresses := append(append(e.To, e.Cc...), e.Bcc...)
 	m, err := GroupAddressesByHost(addresses)
 	if err != nil {
@@ -99,11 +124,20 @@ func (e *Email) newMessages(s *queue.Storage, from, body string) ([]*queue.Messa
 	messages := make([]*queue.Message, 0, 1)
 	for h, to := range m {
 		msg := &queue.Message{
-			Host: h,
-			From: from,
-			To:   to,
+			Host:            h,
+			From:            from,
+			To:              to,
+			Tags:            e.Tags,
+			DataErrorPolicy: e.DataErrorPolicy,
+			MaxAttempts:     e.MaxAttempts,
+			MaxLifetime:     e.MaxLifetime,
+			Priority:        e.Priority,
+			SendingIdentity: e.SendingIdentity,
+			NotifySuccess:   e.NotifySuccess,
+			Confidential:    e.confidential(),
+			Submission:      e.Submission,
 		}
-		if err := s.SaveMessage(msg, body); err != nil {
+		if err := q.Storage.SaveMessage(msg, body); err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
@@ -112,13 +146,14 @@ func (e *Email) newMessages(s *queue.Storage, from, body string) ([]*queue.Messa
 }
 
 // Convert the email into an array of messages grouped by host suitable for
-// delivery to the mail queue.
-func (e *Email) Messages(s *queue.Storage) ([]*queue.Message, error) {
+// delivery to the mail queue. The body is checked against the policies of
+// the queue for submitted messages.
+func (e *Email) Messages(q *queue.Queue) ([]*queue.Message, error) {
 	from, err := mail.ParseAddress(mime.QEncoding.Encode("utf-8", e.From))
 	if err != nil {
 		return nil, err
 	}
-	w, body, err := s.NewBody()
+	w, body, err := q.NewBody()
 	if err != nil {
 		return nil, err
 	}
@@ -140,5 +175,5 @@ func (e *Email) Messages(s *queue.Storage) ([]*queue.Message, error) {
 	if err := w.Close(); err != nil {
 		return nil, err
 	}
-	return e.newMessages(s, from.Address, body)
+	return e.newMessages(q, from.Address, body)
 }
@@ -58,15 +58,19 @@ func emailToMessages(e *Email) ([]*queue.Message, []byte, error) {
 		return nil, nil, err
 	}
 	defer os.RemoveAll(d)
-	s := queue.NewStorage(d)
-	m, err := e.Messages(s)
+	q, err := queue.NewQueue(&queue.Config{Directory: d})
+	if err != nil {
+		return nil, nil, err
+	}
+	q.Stop()
+	m, err := e.Messages(q)
 	if err != nil {
 		return nil, nil, err
 	}
 	if len(m) < 1 {
 		return nil, nil, errors.New("no messages")
 	}
-	r, err := s.GetMessageBody(m[0])
+	r, err := q.Storage.GetMessageBody(m[0])
 	if err != nil {
 		return nil, nil, err
 	}
@@ -181,3 +185,25 @@ func TestEmailContent(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestEmailConfidential(t *testing.T) {
+	for _, d := range []struct {
+		email        *Email
+		confidential bool
+	}{
+		{&Email{}, false},
+		{&Email{Confidential: true}, true},
+		{&Email{Headers: Headers{"Sensitivity": "Company-Confidential"}}, true},
+		{&Email{Headers: Headers{"sensitivity": "normal"}}, false},
+	} {
+		d.email.From = "me@example.com"
+		d.email.To = []string{"you@example.com"}
+		m, _, err := emailToMessages(d.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m[0].Confidential != d.confidential {
+			t.Fatalf("%t != %t", m[0].Confidential, d.confidential)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"strings"
 )
 
 // Map of email headers.
@@ -21,3 +22,13 @@ func (e Headers) Write(w io.Writer) error {
 	_, err := w.Write([]byte("\r\n"))
 	return err
 }
+
+// Determine if the value of a Sensitivity header (RFC 2156) indicates that the
+// message is confidential.
+func isConfidential(sensitivity string) bool {
+	switch strings.ToLower(strings.TrimSpace(sensitivity)) {
+	case "personal", "private", "company-confidential":
+		return true
+	}
+	return false
+}
@@ -2,18 +2,48 @@ package email
 
 import (
 	"github.com/hectane/hectane/queue"
+
+	"net/mail"
+	"strings"
 )
 
 // Raw represents a raw email message ready for delivery.
 type Raw struct {
-	From string   `json:"from"`
-	To   []string `json:"to"`
-	Body string   `json:"body"`
+	From            string            `json:"from"`
+	To              []string          `json:"to"`
+	Body            string            `json:"body"`
+	Tags            map[string]string `json:"tags"`
+	DataErrorPolicy string            `json:"data-error-policy"`
+	MaxAttempts     int               `json:"max-attempts"`
+	MaxLifetime     int               `json:"max-lifetime"`
+	Priority        int               `json:"priority"`
+	SendingIdentity string            `json:"sending-identity"`
+	NotifySuccess   bool              `json:"notify-success"`
+	Confidential    bool              `json:"confidential"`
+
+	// Provenance recorded by the server that accepted the message
+	Submission *queue.Submission `json:"-"`
+}
+
+// confidential determines if the message was flagged as confidential, either
+// explicitly or with a Sensitivity header.
+func (r *Raw) confidential() bool {
+	if r.Confidential {
+		return true
+	}
+	m, err := mail.ReadMessage(strings.NewReader(r.Body))
+	if err != nil {
+		return false
+	}
+	return isConfidential(m.Header.Get("Sensitivity"))
 }
 
 // DeliverToQueue delivers raw messages to the queue.
 func (r *Raw) DeliverToQueue(q *queue.Queue) error {
-	w, body, err := q.Storage.NewBody()
+	if err := q.CheckIdentity(r.SendingIdentity); err != nil {
+		return err
+	}
+	w, body, err := q.NewBody()
 	if err != nil {
 		return err
 	}
@@ -27,11 +57,22 @@ func (r *Raw) DeliverToQueue(q *queue.Queue) error {
 	if err != nil {
 		return err
 	}
+	messageID := q.NewMessageID(r.From, body)
 	for h, to := range hostMap {
 		m := &queue.Message{
-			Host: h,
-			From: r.From,
-			To:   to,
+			Host:            h,
+			From:            r.From,
+			To:              to,
+			Tags:            r.Tags,
+			DataErrorPolicy: r.DataErrorPolicy,
+			MaxAttempts:     r.MaxAttempts,
+			MaxLifetime:     r.MaxLifetime,
+			Priority:        r.Priority,
+			SendingIdentity: r.SendingIdentity,
+			NotifySuccess:   r.NotifySuccess,
+			Confidential:    r.confidential(),
+			Submission:      r.Submission,
+			MessageID:       messageID,
 		}
 		if err := q.Storage.SaveMessage(m, body); err != nil {
 			return err
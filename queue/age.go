@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"math"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Distribution of the number of seconds that messages have been queued.
+type AgeStatus struct {
+	Count int `json:"count"`
+	P50   int `json:"p50"`
+	P90   int `json:"p90"`
+	P99   int `json:"p99"`
+	Max   int `json:"max"`
+}
+
+// Compute the age distribution for messages created at the specified times.
+// Percentiles use the nearest-rank method.
+func newAgeStatus(created []time.Time, now time.Time) *AgeStatus {
+	ages := make([]int, 0, len(created))
+	for _, c := range created {
+		ages = append(ages, int(now.Sub(c)/time.Second))
+	}
+	sort.Ints(ages)
+	rank := func(p float64) int {
+		if len(ages) == 0 {
+			return 0
+		}
+		return ages[int(math.Ceil(p*float64(len(ages))))-1]
+	}
+	return &AgeStatus{
+		Count: len(ages),
+		P50:   rank(0.5),
+		P90:   rank(0.9),
+		P99:   rank(0.99),
+		Max:   rank(1),
+	}
+}
+
+// Creation times of the messages in the queue, which are added when messages
+// are delivered to a host queue and removed once they are no longer queued.
+// Messages saved before creation times were recorded are ignored. All methods
+// are safe to call from multiple goroutines.
+type ageTracker struct {
+	m       sync.Mutex
+	created map[string]time.Time
+}
+
+// Create a new, empty tracker.
+func newAgeTracker() *ageTracker {
+	return &ageTracker{
+		created: make(map[string]time.Time),
+	}
+}
+
+// Record the creation time of the message.
+func (a *ageTracker) add(m *Message) {
+	if m.Created.IsZero() {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.created[path.Join(m.body, m.id)] = m.Created
+}
+
+// Forget the creation time of the message.
+func (a *ageTracker) remove(m *Message) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	delete(a.created, path.Join(m.body, m.id))
+}
+
+// Retrieve the creation times of all messages.
+func (a *ageTracker) times() []time.Time {
+	a.m.Lock()
+	defer a.m.Unlock()
+	created := make([]time.Time, 0, len(a.created))
+	for _, c := range a.created {
+		created = append(created, c)
+	}
+	return created
+}
+
+// Compute the age distribution of messages in the queue.
+func (q *Queue) ageStatus() *AgeStatus {
+	return newAgeStatus(q.ages.times(), time.Now())
+}
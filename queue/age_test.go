@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAgeStatus(t *testing.T) {
+	var (
+		now     = time.Now()
+		created []time.Time
+	)
+	for i := 1; i <= 100; i++ {
+		created = append(created, now.Add(-time.Duration(i)*time.Second))
+	}
+	for _, d := range []struct {
+		created []time.Time
+		status  *AgeStatus
+	}{
+		{nil, &AgeStatus{}},
+		{created[:1], &AgeStatus{1, 1, 1, 1, 1}},
+		{created, &AgeStatus{100, 50, 90, 99, 100}},
+	} {
+		if s := newAgeStatus(d.created, now); !reflect.DeepEqual(s, d.status) {
+			t.Fatalf("%v != %v", s, d.status)
+		}
+	}
+}
+
+func TestAgeTracker(t *testing.T) {
+	var (
+		a       = newAgeTracker()
+		created = time.Now()
+		m1      = &Message{id: "1", Created: created}
+		m2      = &Message{id: "2"}
+	)
+	a.add(m1)
+	a.add(m2)
+	if times := a.times(); !reflect.DeepEqual(times, []time.Time{created}) {
+		t.Fatalf("%v != %v", times, []time.Time{created})
+	}
+	a.remove(m1)
+	if times := a.times(); len(times) != 0 {
+		t.Fatalf("%d != 0", len(times))
+	}
+}
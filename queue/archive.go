@@ -0,0 +1,273 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Policies for importing messages that already exist in storage.
+const (
+	ImportSkip  = "skip"
+	ImportMerge = "merge"
+)
+
+var errInvalidArchive = errors.New("invalid entry in archive")
+
+// Write a single file from the snapshot directory to the archive.
+func exportFile(t *tar.Writer, directory, name string) error {
+	r, err := os.Open(path.Join(directory, name))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	i, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	if err := t.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    i.Size(),
+		ModTime: i.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(t, r)
+	return err
+}
+
+// Link the file to the destination, copying it if a link cannot be created
+// (such as when the destination is on another filesystem).
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Link the contents of storage into the directory and provide the names of
+// the files in the order they are exported. Each body is listed before the
+// messages that refer to it and directories whose body is missing are
+// skipped. Message files are replaced rather than rewritten, so the links are
+// unaffected by later changes.
+func (s *Storage) snapshot(directory string) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	directories, err := ioutil.ReadDir(s.directory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, d := range directories {
+		if !d.IsDir() {
+			continue
+		}
+		if s.bodyMissing(&Message{body: d.Name()}) {
+			continue
+		}
+		files, err := ioutil.ReadDir(s.bodyDirectory(d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Mkdir(path.Join(directory, d.Name()), 0700); err != nil {
+			return nil, err
+		}
+		bodyNames := []string{path.Join(d.Name(), bodyFilename)}
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), messageExtension) ||
+				strings.HasSuffix(f.Name(), coldExtension) {
+				bodyNames = append(bodyNames, path.Join(d.Name(), f.Name()))
+			}
+		}
+		for _, n := range bodyNames {
+			if err := linkOrCopy(path.Join(s.directory, n), path.Join(directory, n)); err != nil {
+				return nil, err
+			}
+		}
+		names = append(names, bodyNames...)
+	}
+	return names, nil
+}
+
+// Write the contents of storage to a tar archive. Storage is only locked
+// while a snapshot is taken so that delivery continues while the archive is
+// written. The snapshot is placed beside the storage directory if possible so
+// that files can be linked rather than copied.
+func (s *Storage) Export(w io.Writer) error {
+	directory, err := ioutil.TempDir(path.Dir(path.Clean(s.directory)), ".export")
+	if err != nil {
+		if directory, err = ioutil.TempDir("", "export"); err != nil {
+			return err
+		}
+	}
+	defer os.RemoveAll(directory)
+	names, err := s.snapshot(directory)
+	if err != nil {
+		return err
+	}
+	t := tar.NewWriter(w)
+	for _, n := range names {
+		if err := exportFile(t, directory, n); err != nil {
+			return err
+		}
+	}
+	return t.Close()
+}
+
+// Write a body from the archive to storage unless it already exists. The
+// body is written to a temporary file that replaces the body once complete so
+// that an interrupted import never leaves a partial body. True is returned if
+// the body directory was created.
+func (s *Storage) importBody(r io.Reader, body string) (bool, error) {
+	if _, err := os.Stat(s.bodyFilename(body)); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(s.bodyDirectory(body), 0700); err != nil {
+		return false, err
+	}
+	// The directory is reported as created even if writing fails so that it
+	// is removed along with the other bodies
+	temp := path.Join(s.bodyDirectory(body), bodyFilename+tempExtension)
+	w, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return true, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(temp)
+		return true, err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		os.Remove(temp)
+		return true, err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(temp)
+		return true, err
+	}
+	return true, os.Rename(temp, s.bodyFilename(body))
+}
+
+// Write a message from the archive to storage. The message is read before
+// the mutex is acquired. Nil is returned if the message was skipped.
+func (s *Storage) importMessage(r io.Reader, body, id, policy string) (*Message, error) {
+	m := &Message{
+		id:   id,
+		body: body,
+	}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, err := os.Stat(s.bodyFilename(body)); err != nil {
+		return nil, errInvalidArchive
+	}
+	if s.messageExists(m) {
+		if policy != ImportMerge {
+			return nil, nil
+		}
+		m.id = uuid.New()
+	}
+	if err := writeFile(s.messageFilename(m), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Remove the messages and any bodies created by an import that failed.
+// Bodies are only removed if no other messages use them.
+func (s *Storage) discardImport(messages []*Message, bodies []string) {
+	for _, m := range messages {
+		if err := s.DeleteMessage(m); err != nil {
+			s.log.Error(err.Error())
+		}
+	}
+	s.removeUnusedBodies(bodies)
+}
+
+// Remove the specified bodies if no messages use them.
+func (s *Storage) removeUnusedBodies(bodies []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, b := range bodies {
+		if err := s.removeBody(&Message{body: b}); err != nil && !os.IsNotExist(err) {
+			s.log.Error(err.Error())
+		}
+	}
+}
+
+// Read messages from a tar archive created with Export and add them to
+// storage. Existing messages with the same ID are either left untouched
+// ("skip") or kept alongside the imported message ("merge"). The messages
+// that were imported are returned. The archive is read without holding the
+// mutex so that delivery continues during the import. If the import fails,
+// the messages and bodies that were written are removed.
+func (s *Storage) Import(r io.Reader, policy string) ([]*Message, error) {
+	var (
+		t        = tar.NewReader(r)
+		messages []*Message
+		bodies   []string
+	)
+	fail := func(err error) ([]*Message, error) {
+		s.discardImport(messages, bodies)
+		return nil, err
+	}
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		parts := strings.Split(path.Clean(h.Name), "/")
+		if len(parts) != 2 || parts[0] == ".." || parts[0] == "." {
+			return fail(errInvalidArchive)
+		}
+		switch {
+		case parts[1] == bodyFilename:
+			created, err := s.importBody(t, parts[0])
+			if created {
+				bodies = append(bodies, parts[0])
+			}
+			if err != nil {
+				return fail(err)
+			}
+		case strings.HasSuffix(parts[1], messageExtension),
+			strings.HasSuffix(parts[1], coldExtension):
+			id := strings.TrimSuffix(parts[1], path.Ext(parts[1]))
+			m, err := s.importMessage(t, parts[0], id, policy)
+			if err != nil {
+				return fail(err)
+			}
+			if m != nil {
+				messages = append(messages, m)
+			}
+		default:
+			return fail(errInvalidArchive)
+		}
+	}
+	s.removeUnusedBodies(bodies)
+	return messages, nil
+}
@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration for periodically checking whether source IPs are listed on
+// DNS-based blocklists (DNSBLs).
+type BlocklistConfig struct {
+	// DNSBL zones to query, such as zen.spamhaus.org
+	Zones []string `json:"zones"`
+
+	// Number of seconds between checks (defaults to 3600)
+	Interval int `json:"interval"`
+
+	// Avoid listed source IPs, using other addresses in the pool if possible
+	// and deferring delivery otherwise
+	Avoid bool `json:"avoid"`
+}
+
+// Determine the interval between checks.
+func (c *BlocklistConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return time.Hour
+}
+
+// Result of the most recent check of a source IP against a DNSBL. If the
+// lookup failed, the error is recorded and the previous listing is kept.
+type BlocklistStatus struct {
+	IP      string    `json:"ip"`
+	Zone    string    `json:"zone"`
+	Listed  bool      `json:"listed"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Error indicating that every source IP is listed on a DNSBL.
+var errBlocklisted = errors.New("no source IP that is not listed on a blocklist")
+
+// Build the name queried to check the IP address against the zone. The
+// address is reversed by octet for IPv4 and by nibble for IPv6.
+func dnsblName(ip, zone string) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("invalid IP address %s", ip)
+	}
+	var parts []string
+	if v4 := addr.To4(); v4 != nil {
+		for i := len(v4) - 1; i >= 0; i-- {
+			parts = append(parts, fmt.Sprintf("%d", v4[i]))
+		}
+	} else {
+		for i := len(addr) - 1; i >= 0; i-- {
+			parts = append(parts, fmt.Sprintf("%x", addr[i]&0xf), fmt.Sprintf("%x", addr[i]>>4))
+		}
+	}
+	return strings.Join(append(parts, zone), "."), nil
+}
+
+// Determine if the IP address is listed in the zone. A name that does not
+// exist means the address is not listed. Answers outside 127.0.0.0/8 and those
+// in 127.255.255.0/24 are used by some DNSBLs to indicate that the query was
+// refused and are treated as errors.
+func checkDNSBL(ip, zone string) (bool, error) {
+	name, err := dnsblName(ip, zone)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := lookupHost(name)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, a := range addrs {
+		v4 := net.ParseIP(a).To4()
+		if v4 == nil || v4[0] != 127 || (v4[1] == 255 && v4[2] == 255) {
+			return false, fmt.Errorf("%s refused the query (%s)", zone, a)
+		}
+	}
+	return len(addrs) > 0, nil
+}
+
+// Collect the source IPs in the configuration.
+func sourceIPs(c *Config) []string {
+	seen := make(map[string]bool)
+	if c.LargeMessageSourceIP != "" {
+		seen[c.LargeMessageSourceIP] = true
+	}
+	for _, p := range c.Tiers {
+		for _, ip := range p {
+			seen[ip] = true
+		}
+	}
+	for _, h := range c.Hosts {
+		if h.SourceIP != "" {
+			seen[h.SourceIP] = true
+		}
+	}
+	for _, i := range c.SendingIdentities {
+		if i.SourceIP != "" {
+			seen[i.SourceIP] = true
+		}
+	}
+	ips := make([]string, 0, len(seen))
+	for ip := range seen {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Results of blocklist checks for each source IP and zone. All methods are
+// safe to call from multiple goroutines.
+type blocklistMonitor struct {
+	m         sync.Mutex
+	results   map[string]map[string]*BlocklistStatus
+	running   bool
+	lastCheck time.Time
+}
+
+// Create a new monitor without any results.
+func newBlocklistMonitor() *blocklistMonitor {
+	return &blocklistMonitor{
+		results: make(map[string]map[string]*BlocklistStatus),
+	}
+}
+
+// Determine if the IP address was listed in any zone when last checked.
+func (b *blocklistMonitor) listed(ip string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, s := range b.results[ip] {
+		if s.Listed {
+			return true
+		}
+	}
+	return false
+}
+
+// Begin a check if one is due and none is running.
+func (b *blocklistMonitor) start(interval time.Duration) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.running || time.Since(b.lastCheck) < interval {
+		return false
+	}
+	b.running = true
+	b.lastCheck = time.Now()
+	return true
+}
+
+// Record the result of checking the IP address against the zone.
+func (b *blocklistMonitor) update(ip, zone string, listed bool, err error) *BlocklistStatus {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.results[ip] == nil {
+		b.results[ip] = make(map[string]*BlocklistStatus)
+	}
+	s := &BlocklistStatus{
+		IP:      ip,
+		Zone:    zone,
+		Listed:  listed,
+		Checked: time.Now(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+		if p, ok := b.results[ip][zone]; ok {
+			s.Listed = p.Listed
+		}
+	}
+	b.results[ip][zone] = s
+	return s
+}
+
+// Mark the current check as finished.
+func (b *blocklistMonitor) finish() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.running = false
+}
+
+// Retrieve the results, ordered by IP address and zone.
+func (b *blocklistMonitor) all() []*BlocklistStatus {
+	b.m.Lock()
+	defer b.m.Unlock()
+	statuses := []*BlocklistStatus{}
+	for _, r := range b.results {
+		for _, s := range r {
+			statuses = append(statuses, s)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].IP != statuses[j].IP {
+			return statuses[i].IP < statuses[j].IP
+		}
+		return statuses[i].Zone < statuses[j].Zone
+	})
+	return statuses
+}
+
+// Check each source IP against the configured zones if a check is due. DNS
+// lookups are performed in a separate goroutine so that the queue is not
+// blocked. This must be called from the queue's goroutine.
+func (q *Queue) checkBlocklists() {
+	c := q.config.Blocklist
+	if c == nil || len(c.Zones) == 0 || !q.blocklists.start(c.interval()) {
+		return
+	}
+	ips := sourceIPs(q.config)
+	go func() {
+		defer q.blocklists.finish()
+		for _, ip := range ips {
+			for _, zone := range c.Zones {
+				listed, err := checkDNSBL(ip, zone)
+				s := q.blocklists.update(ip, zone, listed, err)
+				if err != nil {
+					q.log.Warnf("unable to check %s against %s: %s", ip, zone, err)
+				} else if listed {
+					q.log.Errorf("%s is listed on %s", ip, zone)
+				}
+				var v float64
+				if s.Listed {
+					v = 1
+				}
+				q.metrics.SetGauge(metricSourceIPListed, v, map[string]string{
+					labelIP:    ip,
+					labelDNSBL: zone,
+				})
+			}
+		}
+	}()
+}
+
+// Determine if the source IP should not be used because it is listed on a
+// blocklist.
+func (h *Host) blocklisted(ip string) bool {
+	c := h.config.Blocklist
+	return c != nil && c.Avoid && ip != "" && h.blocklists.listed(ip)
+}
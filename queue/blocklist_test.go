@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDNSBLName(t *testing.T) {
+	for _, v := range []struct {
+		ip   string
+		name string
+	}{
+		{"192.0.2.1", "1.2.0.192.bl.example.com"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example.com"},
+	} {
+		name, err := dnsblName(v.ip, "bl.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != v.name {
+			t.Fatalf("%s != %s", name, v.name)
+		}
+	}
+}
+
+func TestCheckDNSBL(t *testing.T) {
+	defer func(h func(string) ([]string, error)) {
+		lookupHost = h
+	}(lookupHost)
+	lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "1.2.0.192.bl.example.com":
+			return []string{"127.0.0.2"}, nil
+		case "2.2.0.192.bl.example.com":
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		case "3.2.0.192.bl.example.com":
+			return []string{"127.255.255.254"}, nil
+		}
+		return nil, errors.New("timeout")
+	}
+	b := newBlocklistMonitor()
+	b.update("192.0.2.4", "bl.example.com", true, nil)
+	for _, v := range []struct {
+		ip     string
+		listed bool
+		err    bool
+	}{
+		{"192.0.2.1", true, false},
+		{"192.0.2.2", false, false},
+		{"192.0.2.3", false, true},
+		{"192.0.2.4", false, true},
+	} {
+		listed, err := checkDNSBL(v.ip, "bl.example.com")
+		if listed != v.listed || (err != nil) != v.err {
+			t.Fatalf("%s: %t, %v", v.ip, listed, err)
+		}
+		b.update(v.ip, "bl.example.com", listed, err)
+	}
+	if !b.listed("192.0.2.4") {
+		t.Fatal("listing not kept after failed lookup")
+	}
+	if len(b.all()) != 4 {
+		t.Fatalf("%d != 4", len(b.all()))
+	}
+}
+
+func TestSourceIPs(t *testing.T) {
+	c := &Config{
+		Tiers: map[string][]string{"bulk": {"192.0.2.1"}},
+		Hosts: map[string]*HostConfig{
+			"example.com": {SourceIP: "192.0.2.2"},
+		},
+		SendingIdentities: map[string]*SendingIdentity{
+			"marketing": {SourceIP: "192.0.2.3"},
+			"default":   {Hostname: "mail.example.org"},
+		},
+	}
+	if ips := sourceIPs(c); !reflect.DeepEqual(ips, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}) {
+		t.Fatalf("unexpected source IPs: %v", ips)
+	}
+}
@@ -0,0 +1,164 @@
+package queue
+
+import (
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Reasons that a message bounced.
+const (
+	BounceInvalidRecipient = "invalid-recipient"
+	BounceMailboxFull      = "mailbox-full"
+	BouncePolicy           = "policy-rejection"
+	BounceSpam             = "spam-blocked"
+	BounceRelayDenied      = "relay-denied"
+	BounceContent          = "content-rejected"
+	BounceOther            = "other"
+)
+
+// Pattern used to classify a bounce. Each field that is set must match: the
+// reply code, the start of the enhanced status code (such as "5.1") and a
+// case-insensitive regular expression applied to the reply text.
+type BouncePattern struct {
+	Reason   string `json:"reason"`
+	Code     int    `json:"code"`
+	Enhanced string `json:"enhanced"`
+	Pattern  string `json:"pattern"`
+}
+
+// Patterns checked after any in the configuration. Text patterns come first
+// since servers often use generic status codes for rejections by filters.
+var defaultBouncePatterns = []*BouncePattern{
+	{Reason: BounceSpam, Pattern: `spam|blocklist|blacklist|block list|black list|reputation|spamhaus`},
+	{Reason: BounceRelayDenied, Pattern: `relay(ing)? (access )?(denied|not permitted|prohibited)`},
+	{Reason: BounceMailboxFull, Pattern: `mailbox (is )?full|over ?quota|quota exceeded|insufficient storage`},
+	{Reason: BounceInvalidRecipient, Pattern: `(user|mailbox|recipient|address)( \S+)? (unknown|not found|does not exist|invalid)|no such (user|mailbox)`},
+	{Reason: BounceContent, Pattern: `content|virus|malware|attachment|message (was )?rejected`},
+	{Reason: BounceMailboxFull, Enhanced: "5.2.2"},
+	{Reason: BounceRelayDenied, Enhanced: "5.7.1", Pattern: `relay`},
+	{Reason: BounceInvalidRecipient, Enhanced: "5.1."},
+	{Reason: BounceContent, Enhanced: "5.6."},
+	{Reason: BouncePolicy, Enhanced: "5.7."},
+	{Reason: BounceMailboxFull, Code: 552},
+	{Reason: BounceInvalidRecipient, Code: 550},
+	{Reason: BounceInvalidRecipient, Code: 553},
+	{Reason: BouncePolicy, Code: 554},
+}
+
+// Compiled text patterns, cached since patterns from the configuration are
+// only compiled when first used.
+var (
+	bounceRegexpMutex sync.Mutex
+	bounceRegexps     = make(map[string]*regexp.Regexp)
+)
+
+// Compile the text pattern, returning nil if it is invalid.
+func bounceRegexp(pattern string) *regexp.Regexp {
+	bounceRegexpMutex.Lock()
+	defer bounceRegexpMutex.Unlock()
+	r, ok := bounceRegexps[pattern]
+	if !ok {
+		r, _ = regexp.Compile("(?i)" + pattern)
+		bounceRegexps[pattern] = r
+	}
+	return r
+}
+
+// Determine if the pattern matches the reply.
+func (b *BouncePattern) match(code int, enhanced, text string) bool {
+	if b.Code != 0 && b.Code != code {
+		return false
+	}
+	if b.Enhanced != "" && !strings.HasPrefix(enhanced, b.Enhanced) {
+		return false
+	}
+	if b.Pattern != "" {
+		r := bounceRegexp(b.Pattern)
+		if r == nil || !r.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Classify the error that caused a message to bounce using the patterns in
+// the configuration followed by the default patterns. Patterns that require
+// an enhanced status code never match replies without a valid one, leaving
+// those to patterns using the reply code.
+func (c *Config) classifyBounce(err error) string {
+	var (
+		code int
+		text string
+	)
+	switch e := err.(type) {
+	case *textproto.Error:
+		code, text = e.Code, e.Msg
+	case *recipientError:
+		code = e.code
+	default:
+		if err != nil {
+			text = err.Error()
+		}
+	}
+	enhanced, _ := parseEnhancedStatus(code, text)
+	for _, p := range append(append([]*BouncePattern{}, c.BouncePatterns...), defaultBouncePatterns...) {
+		if p.match(code, enhanced, text) {
+			return p.Reason
+		}
+	}
+	return BounceOther
+}
+
+// Number of bounced recipients for each reason. All methods are safe to call
+// from multiple goroutines.
+type bounceStats struct {
+	m      sync.Mutex
+	counts map[string]int
+}
+
+// Create a new, empty set of counts.
+func newBounceStats() *bounceStats {
+	return &bounceStats{
+		counts: make(map[string]int),
+	}
+}
+
+// Add the number of recipients that bounced for the reason.
+func (b *bounceStats) add(reason string, n int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.counts[reason] += n
+}
+
+// Retrieve the counts for each reason.
+func (b *bounceStats) all() map[string]int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	counts := make(map[string]int)
+	for r, n := range b.counts {
+		counts[r] = n
+	}
+	return counts
+}
+
+// Classify the bounce of the recipients and record the reason with the
+// message, in the metrics and in the counts for each reason.
+func (h *Host) recordBounce(m *Message, recipients []string, err error) {
+	if len(recipients) == 0 {
+		return
+	}
+	reason := h.config.classifyBounce(err)
+	if m.BounceReasons == nil {
+		m.BounceReasons = make(map[string]string)
+	}
+	for _, t := range recipients {
+		m.BounceReasons[t] = reason
+		h.metrics.IncCounter(metricBounces, map[string]string{
+			labelHost:   h.hostLabel(),
+			labelReason: reason,
+		})
+	}
+	h.bounceStats.add(reason, len(recipients))
+}
@@ -0,0 +1,35 @@
+package queue
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestClassifyBounce(t *testing.T) {
+	c := &Config{
+		BouncePatterns: []*BouncePattern{
+			{Reason: BounceContent, Pattern: `custom filter`},
+		},
+	}
+	for _, v := range []struct {
+		err    error
+		reason string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 <a@example.com>: Recipient address rejected: User unknown"}, BounceInvalidRecipient},
+		{&textproto.Error{Code: 552, Msg: "5.2.2 Mailbox full"}, BounceMailboxFull},
+		{&textproto.Error{Code: 554, Msg: "5.7.1 Service unavailable; client host blocked using zen.spamhaus.org"}, BounceSpam},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Relaying denied"}, BounceRelayDenied},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Message rejected by custom filter"}, BounceContent},
+		{&textproto.Error{Code: 550, Msg: "5.7.26 Unauthenticated email is not accepted"}, BouncePolicy},
+		{&textproto.Error{Code: 521, Msg: "closed"}, BounceOther},
+		{&textproto.Error{Code: 552, Msg: "Over the limit"}, BounceMailboxFull},
+		{&textproto.Error{Code: 550, Msg: "5.2.2x Over the limit"}, BounceInvalidRecipient},
+		{&textproto.Error{Code: 554, Msg: "4.1.1 Over the limit"}, BouncePolicy},
+		{&textproto.Error{Code: 550, Msg: "5.1.1234 Over the limit"}, BounceInvalidRecipient},
+		{&textproto.Error{Code: 521, Msg: "5.6 Over the limit"}, BounceOther},
+	} {
+		if r := c.classifyBounce(v.err); r != v.reason {
+			t.Fatalf("%v: %s != %s", v.err, r, v.reason)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// Extensions that are checked for when a connection is established.
+var knownExtensions = []string{
+	"8BITMIME",
+	"AUTH",
+	"CHUNKING",
+	"DSN",
+	"ENHANCEDSTATUSCODES",
+	"PIPELINING",
+	"SIZE",
+	"SMTPUTF8",
+	"STARTTLS",
+}
+
+// Extensions advertised by a mail server in response to EHLO. Advertised
+// includes every extension in the reply sent before STARTTLS, including those
+// that are not acted on.
+type Capabilities struct {
+	Server     string            `json:"server"`
+	Extensions map[string]string `json:"extensions"`
+	Advertised map[string]string `json:"advertised"`
+	Observed   time.Time         `json:"observed"`
+}
+
+// Determine which extensions are advertised by the server the client is
+// connected to.
+func newCapabilities(c *smtp.Client, server string, advertised map[string]string) *Capabilities {
+	capabilities := &Capabilities{
+		Server:     server,
+		Extensions: make(map[string]string),
+		Advertised: advertised,
+		Observed:   time.Now(),
+	}
+	for _, e := range knownExtensions {
+		if ok, param := c.Extension(e); ok {
+			capabilities.Extensions[e] = param
+		}
+	}
+	return capabilities
+}
+
+// Most recently observed capabilities for each host. All methods are safe to
+// call from multiple goroutines.
+type capabilityCache struct {
+	m            sync.Mutex
+	capabilities map[string]*Capabilities
+}
+
+// Create a new, empty cache.
+func newCapabilityCache() *capabilityCache {
+	return &capabilityCache{
+		capabilities: make(map[string]*Capabilities),
+	}
+}
+
+// Record the capabilities observed for the specified host.
+func (c *capabilityCache) set(host string, capabilities *Capabilities) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.capabilities[host] = capabilities
+}
+
+// Retrieve the capabilities for the specified host or nil if none have been
+// observed.
+func (c *capabilityCache) get(host string) *Capabilities {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.capabilities[host]
+}
+
+// Retrieve the capabilities for all hosts.
+func (c *capabilityCache) all() map[string]*Capabilities {
+	c.m.Lock()
+	defer c.m.Unlock()
+	capabilities := make(map[string]*Capabilities)
+	for h, v := range c.capabilities {
+		capabilities[h] = v
+	}
+	return capabilities
+}
@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"sync"
+	"time"
+)
+
+// Message retained by the capture transport instead of being delivered.
+type CapturedMessage struct {
+	ID       string      `json:"id"`
+	Host     string      `json:"host"`
+	From     string      `json:"from"`
+	To       []string    `json:"to"`
+	Headers  mail.Header `json:"headers"`
+	Body     []byte      `json:"body"`
+	Captured time.Time   `json:"captured"`
+}
+
+// Transport that keeps messages in memory so that tests can inspect them.
+// Delivering the same message again replaces the earlier copy rather than
+// adding another. All methods are safe to call from multiple goroutines.
+type CaptureStorage struct {
+	m        sync.Mutex
+	messages []CapturedMessage
+}
+
+// Create a new, empty capture buffer.
+func NewCaptureStorage() *CaptureStorage {
+	return &CaptureStorage{}
+}
+
+// Capture the message. Messages with headers that cannot be parsed are
+// captured with the entire content as the body.
+func (c *CaptureStorage) Deliver(ctx context.Context, m *Message, body io.Reader) (Result, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return Deferred, err
+	}
+	captured := CapturedMessage{
+		ID:       m.id,
+		Host:     m.Host,
+		From:     m.From,
+		To:       append([]string{}, m.To...),
+		Body:     b,
+		Captured: time.Now(),
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+		if captured.Body, err = ioutil.ReadAll(msg.Body); err != nil {
+			return Deferred, err
+		}
+		captured.Headers = msg.Header
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	for i, v := range c.messages {
+		if v.ID == captured.ID {
+			c.messages[i] = captured
+			return Delivered, nil
+		}
+	}
+	c.messages = append(c.messages, captured)
+	return Delivered, nil
+}
+
+// Retrieve the captured messages in the order they were first captured.
+func (c *CaptureStorage) Messages() []CapturedMessage {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]CapturedMessage{}, c.messages...)
+}
+
+// Discard all captured messages.
+func (c *CaptureStorage) Clear() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.messages = nil
+}
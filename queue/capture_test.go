@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestCaptureStorage(t *testing.T) {
+	var (
+		c = NewCaptureStorage()
+		m = &Message{
+			id:   "1",
+			Host: "example.com",
+			From: "me@example.org",
+			To:   []string{"you@example.com"},
+		}
+		body = "Subject: test\r\n\r\nbody"
+	)
+	for i := 0; i < 2; i++ {
+		r, err := c.Deliver(context.Background(), m, bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != Delivered {
+			t.Fatalf("%d != %d", r, Delivered)
+		}
+	}
+	messages := c.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("%d != 1", len(messages))
+	}
+	if s := messages[0].Headers.Get("Subject"); s != "test" {
+		t.Fatalf("%s != test", s)
+	}
+	if b := string(messages[0].Body); b != "body" {
+		t.Fatalf("%s != body", b)
+	}
+	c.Clear()
+	if len(c.Messages()) != 0 {
+		t.Fatal("messages not cleared")
+	}
+}
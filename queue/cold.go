@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// Messages in cold storage are promoted this long before their next attempt
+// so that they are back in their host queue in time.
+const coldPromotionLead = 2 * time.Minute
+
+// Determine the filename of the specified message in cold storage.
+func (s *Storage) coldFilename(m *Message) string {
+	return path.Join(s.directory, m.body, m.id) + coldExtension
+}
+
+// Determine if the message exists in either active or cold storage.
+func (s *Storage) messageExists(m *Message) bool {
+	for _, f := range []string{s.messageFilename(m), s.coldFilename(m)} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the messages in cold storage.
+func (s *Storage) coldMessages() ([]*Message, error) {
+	bodies, err := s.bodies()
+	if err != nil {
+		return nil, err
+	}
+	messages := []*Message{}
+	for _, b := range bodies {
+		messages = append(messages, s.loadFiles(b, coldExtension)...)
+	}
+	return messages, nil
+}
+
+// Add the messages already in cold storage to the index used for promoting
+// them. This is done once at startup since messages spilled afterwards are
+// indexed as they are moved.
+func (s *Storage) indexColdMessages() error {
+	messages, err := s.coldMessages()
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, m := range messages {
+		s.cold[s.coldFilename(m)] = m.NextAttempt
+	}
+	return nil
+}
+
+// Move the specified message to cold storage. It is not loaded with the other
+// messages until it is promoted.
+func (s *Storage) SpillMessage(m *Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := os.Rename(s.messageFilename(m), s.coldFilename(m)); err != nil {
+		return err
+	}
+	s.cold[s.coldFilename(m)] = m.NextAttempt
+	return nil
+}
+
+// Move messages in cold storage whose next attempt is before the specified
+// time back to active storage and provide them. Only the index is consulted
+// to find them, so only the files of promoted messages are read.
+func (s *Storage) PromoteMessages(before time.Time) ([]*Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var (
+		promoted = []*Message{}
+		lastErr  error
+	)
+	for f, nextAttempt := range s.cold {
+		if nextAttempt.After(before) {
+			continue
+		}
+		m, err := loadFile(f)
+		if err != nil {
+			delete(s.cold, f)
+			lastErr = err
+			continue
+		}
+		if err := os.Rename(f, s.messageFilename(m)); err != nil {
+			if os.IsNotExist(err) {
+				delete(s.cold, f)
+			}
+			lastErr = err
+			continue
+		}
+		delete(s.cold, f)
+		promoted = append(promoted, m)
+	}
+	return promoted, lastErr
+}
+
+// Determine if the message should be moved to cold storage instead of waiting
+// in the host queue for the specified duration. Messages with a caller
+// waiting for their result are kept in the queue.
+func (h *Host) shouldSpill(m *Message, d time.Duration) bool {
+	threshold := time.Duration(h.config.SpillThreshold) * time.Second
+	return threshold > 0 && d >= threshold && m.result == nil
+}
+
+// Return messages in cold storage to their host queues shortly before their
+// next attempt.
+func (q *Queue) promoteColdMessages() {
+	messages, err := q.Storage.PromoteMessages(time.Now().Add(coldPromotionLead))
+	if err != nil {
+		q.log.Error(err.Error())
+	}
+	for _, m := range messages {
+		q.deliverMessage(m)
+	}
+	if len(messages) > 0 {
+		q.log.Infof("promoted %d message(s) from cold storage", len(messages))
+	}
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"net/textproto"
+)
+
+// Log an error that occurred while delivering the message at the level
+// configured for the outcome. Errors may include recipient addresses, so for
+// confidential messages only the message ID, the generated Message-ID and the
+// reply code (if any) are logged.
+func (h *Host) logError(m *Message, outcome string, err error) {
+	level := h.config.logLevel(outcome)
+	if !m.Confidential {
+		h.log.Log(level, err.Error())
+		return
+	}
+	l := h.log.WithField("message", m.id)
+	if m.MessageID != "" {
+		l = l.WithField("message-id", m.MessageID)
+	}
+	if e, ok := err.(*textproto.Error); ok {
+		l.Logf(level, "server replied with code %d", e.Code)
+	} else {
+		l.Log(level, "delivery failed (details redacted)")
+	}
+}
+
+// Remove the recipients and submission details (which include the user and
+// client IP) from the delivery record if the message is confidential.
+func redactRecord(m *Message, r *DeliveryRecord) *DeliveryRecord {
+	if m.Confidential {
+		r.Recipients = nil
+		r.Forwarded = nil
+		r.Unverified = nil
+		r.Submission = nil
+		r.Confidential = true
+	}
+	return r
+}
+
+// Remove the recipient from the confirmation if the message is confidential.
+func redactDelivery(m *Message, d *RecipientDelivery) *RecipientDelivery {
+	if m.Confidential {
+		d.Recipient = ""
+		d.Confidential = true
+	}
+	return d
+}
@@ -0,0 +1,21 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestRedactRecord(t *testing.T) {
+	for _, confidential := range []bool{false, true} {
+		r := redactRecord(&Message{Confidential: confidential}, &DeliveryRecord{
+			Recipients: []string{"a@example.com"},
+			Forwarded:  []string{"b@example.com"},
+			Unverified: []string{"c@example.com"},
+			Submission: &Submission{User: "me", ClientIP: "192.0.2.1"},
+		})
+		redacted := r.Recipients == nil && r.Forwarded == nil &&
+			r.Unverified == nil && r.Submission == nil
+		if redacted != confidential || r.Confidential != confidential {
+			t.Fatalf("%t: unexpected record: %v", confidential, r)
+		}
+	}
+}
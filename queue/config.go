@@ -1,10 +1,188 @@
 package queue
 
+import (
+	"github.com/hectane/hectane/util"
+
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
 // See https://github.com/Freeaqingme/dkim
 type DKIMConfig struct {
 	PrivateKey       string `json:"private-key"`
 	Selector         string `json:"selector"`
 	Canonicalization string `json:"canonicalization"`
+
+	// Policy for messages from the domain that cannot be signed (they are
+	// delivered unsigned if empty)
+	Require string `json:"require"`
+}
+
+// Policies for recipients that the mail server will forward (251) or cannot
+// verify (252). They may be accepted, deferred or bounced.
+const (
+	RecipientAccept = "accept"
+	RecipientDefer  = "defer"
+	RecipientBounce = "bounce"
+)
+
+// TLS policies for connecting to a host.
+const (
+	TLSOpportunistic = "opportunistic"
+	TLSRequired      = "required"
+	TLSDisabled      = "disabled"
+)
+
+// Policies for servers whose certificate fails validation when STARTTLS is
+// opportunistic. The message may be delivered over the unauthenticated
+// connection, delivered after reconnecting without TLS or deferred.
+const (
+	InvalidCertDeliver   = "deliver"
+	InvalidCertCleartext = "cleartext"
+	InvalidCertDefer     = "defer"
+)
+
+// Policies for handling errors that occur after the message body was sent
+// but before the server confirmed receipt. It is impossible to know if the
+// message was received in this case.
+const (
+	DataAssumeFailed    = "assume-failed"
+	DataAssumeDelivered = "assume-delivered"
+	DataQuarantine      = "quarantine"
+)
+
+// Configuration for delivering to a specific host.
+type HostConfig struct {
+	// Name to use when greeting the mail server (the sender's domain is used
+	// if empty)
+	Hostname string `json:"hostname"`
+
+	// Probe the mail server before retrying a deferred message and keep
+	// deferring it (and the messages behind it) until the probe succeeds
+	ProbeBeforeFlush bool `json:"probe-before-flush"`
+
+	// Discard messages to the host and consider them delivered
+	Blackhole bool `json:"blackhole"`
+
+	// Retain messages to the host in memory instead of delivering them so
+	// that they can be inspected with Queue.Captured (intended for tests)
+	Capture bool `json:"capture"`
+
+	// Maximum size of messages (in bytes) accepted by the host. Larger
+	// messages are delivered through the named transport (provided by the
+	// application) if there is one and bounced otherwise.
+	MaxMessageSize    int64  `json:"max-message-size"`
+	OversizeTransport string `json:"oversize-transport"`
+
+	// Policies for recipients the mail server will forward (251) or cannot
+	// verify (252) (both default to accept)
+	ForwardedRecipientPolicy  string `json:"forwarded-recipient-policy"`
+	UnverifiedRecipientPolicy string `json:"unverified-recipient-policy"`
+
+	// Deliver messages through the named transport (provided by the
+	// application) or through the Mailgun HTTP API instead of SMTP
+	Transport string         `json:"transport"`
+	Mailgun   *MailgunConfig `json:"mailgun"`
+
+	// Mail servers (host or host:port) to use instead of those found by
+	// looking up the host's MX records
+	Servers []string `json:"servers"`
+
+	// Relative weights used to choose between MX records with equal priority
+	MXWeights map[string]int `json:"mx-weights"`
+
+	// Priorities that override those published for MX records, with lower
+	// values preferred (servers without one follow those with one)
+	MXPriorities map[string]int `json:"mx-priorities"`
+
+	// Handling of MX records that point to an alias (CNAME), which may be
+	// followed, replaced by the canonical name or ignored (defaults to
+	// follow)
+	CNAMEPolicy string `json:"cname-policy"`
+
+	// Order in which waiting messages are delivered (defaults to FIFO)
+	Order string `json:"order"`
+
+	// Send MAIL and every RCPT without waiting for each reply if the server
+	// advertises PIPELINING
+	Pipelining bool `json:"pipelining"`
+
+	// Greeting sent to the host's mail servers: EHLO falling back to HELO,
+	// HELO only or EHLO only, failing messages if it is rejected (defaults to
+	// auto)
+	GreetingMode string `json:"greeting-mode"`
+
+	// Check performed before reusing an open connection for another message
+	// (defaults to off)
+	ReuseCheck string `json:"reuse-check"`
+
+	// Local address to use for outgoing connections
+	SourceIP string `json:"source-ip"`
+
+	// Range of local ports to use for outgoing connections (the OS chooses
+	// an ephemeral port if unset)
+	SourcePortFirst int `json:"source-port-first"`
+	SourcePortLast  int `json:"source-port-last"`
+
+	// Policy for the use of STARTTLS (defaults to opportunistic)
+	TLSPolicy string `json:"tls-policy"`
+
+	// Policy for certificates that fail validation when STARTTLS is
+	// opportunistic (defaults to deliver)
+	InvalidCertPolicy string `json:"invalid-cert-policy"`
+
+	// Policy for TLS handshakes that time out (defaults to retry)
+	TLSTimeoutPolicy string `json:"tls-timeout-policy"`
+
+	// Maximum number of messages sent to the host per second (unlimited if
+	// zero) and the increase of the rate after the host recovers
+	MessageRate float64   `json:"message-rate"`
+	RateRamp    *RateRamp `json:"rate-ramp"`
+
+	// Maximum number of new connections established to the host per second
+	// (unlimited if zero) and the number that may be established at once
+	ConnectionRate  float64 `json:"connection-rate"`
+	ConnectionBurst int     `json:"connection-burst"`
+
+	// Reputation tier used for messages to the host
+	Tier string `json:"tier"`
+
+	// Only use source IPs with valid forward-confirmed reverse DNS
+	RequireFCrDNS bool `json:"require-fcrdns"`
+
+	// Maximum number of recipients delivered to in a single session and the
+	// number of seconds to wait between sessions
+	ChunkSize  int `json:"chunk-size"`
+	ChunkDelay int `json:"chunk-delay"`
+
+	// Maximum number of messages delivered over a single connection before
+	// it is closed (unlimited if zero)
+	MaxMessagesPerConnection int `json:"max-messages-per-connection"`
+
+	// Number of seconds to wait for a connection to be established, for the
+	// response to each command and for each operation while sending the
+	// message body, overriding the global timeouts
+	DialTimeout    int `json:"dial-timeout"`
+	CommandTimeout int `json:"command-timeout"`
+	DataTimeout    int `json:"data-timeout"`
+
+	// Overrides the global maximum number of attempts and maximum lifetime
+	// (in seconds) of messages to the host
+	MaxAttempts int `json:"max-attempts"`
+	MaxLifetime int `json:"max-lifetime"`
+
+	// Overrides the global period during which retries may be attempted
+	SendingWindow *SendingWindow `json:"sending-window"`
+}
+
+// Certificate and private key files used for authenticating to mail servers.
+type ClientCertificate struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
 }
 
 // Application configuration.
@@ -14,4 +192,426 @@ type Config struct {
 
 	// Map domain names to DKIM config for that domain
 	DKIMConfigs map[string]DKIMConfig `json:"dkim-configs"`
+
+	// Patterns used to classify bounces, checked before the defaults
+	BouncePatterns []*BouncePattern `json:"bounce-patterns"`
+
+	// Retry deferred messages immediately when the configuration is reloaded
+	// if the change affects them - all messages for hosts whose connection
+	// settings changed and messages from domains whose DKIM config changed
+	RetryOnReload bool `json:"retry-on-reload"`
+
+	// Sending identities that messages may be pinned to by name
+	SendingIdentities map[string]*SendingIdentity `json:"sending-identities"`
+
+	// URL that a confirmation is posted to for each recipient that accepts a
+	// message, for messages (or sending identities) that request them
+	SuccessWebhook string `json:"success-webhook"`
+
+	// Map domain names to the rules used for detecting duplicate recipients
+	Normalization util.NormalizeRules `json:"normalization"`
+
+	// TLS renegotiation support ("never", "once", or "freely" - defaults to
+	// "never") and the list of protocols advertised via ALPN - these are
+	// useful only for working around problems with unusual servers
+	TLSRenegotiation string   `json:"tls-renegotiation"`
+	TLSNextProtos    []string `json:"tls-next-protos"`
+
+	// Client certificate presented to mail servers that request one and the
+	// certificates for specific mail servers (by name) that take precedence
+	ClientCertificate  *ClientCertificate            `json:"client-certificate"`
+	ClientCertificates map[string]*ClientCertificate `json:"client-certificates"`
+
+	// Client certificates loaded from the files above, with those for
+	// specific mail servers indexed by normalized name
+	defaultClientCert *tls.Certificate
+	clientCerts       map[string]*tls.Certificate
+
+	// Number of seconds to wait for a connection to be established, for the
+	// server's greeting, for the response to each command, and for each
+	// operation while sending the message body - the greeting timeout should
+	// be generous since some servers deliberately delay their greeting
+	DialTimeout     int `json:"dial-timeout"`
+	GreetingTimeout int `json:"greeting-timeout"`
+	CommandTimeout  int `json:"command-timeout"`
+	DataTimeout     int `json:"data-timeout"`
+
+	// Number of seconds to wait before retrying when connections to every
+	// mail server were refused or timed out, used instead of the normal retry
+	// schedule if set
+	RefusedRetryDelay int `json:"refused-retry-delay"`
+	TimeoutRetryDelay int `json:"timeout-retry-delay"`
+
+	// Number of seconds to defer delivery after a mail server replies that it
+	// is rate limiting the source IP (disabled if zero), whether all delivery
+	// to the host or all delivery using the source IP is deferred (defaults
+	// to host), and patterns matching such replies that are checked before
+	// the defaults
+	RateLimitCooldown int      `json:"rate-limit-cooldown"`
+	RateLimitScope    string   `json:"rate-limit-scope"`
+	RateLimitPatterns []string `json:"rate-limit-patterns"`
+
+	// Maximum number of simultaneous connections using each source IP across
+	// all hosts (unlimited if zero)
+	MaxConnectionsPerIP int `json:"max-connections-per-ip"`
+
+	// Maximum number of bytes read for each reply from a mail server, which
+	// is treated as a connection failure if exceeded (defaults to 64 KiB)
+	MaxReplySize int `json:"max-reply-size"`
+
+	// Host names and IP addresses that refer to this server - mail servers
+	// matching any of these are never connected to (in addition to the
+	// configured hostname and source IP for each host)
+	Identities []string `json:"identities"`
+
+	// Policy for mail servers that resolve to loopback, private or
+	// link-local addresses (defaults to refuse) and the host names, IP
+	// addresses and networks that may be connected to regardless
+	PrivatePolicy    string   `json:"private-policy"`
+	PrivateAllowlist []string `json:"private-allowlist"`
+
+	// Messages larger than this number of bytes are delivered through a
+	// separate queue for each host (optionally from a different address) so
+	// that they do not delay smaller messages (0 to disable)
+	LargeMessageSize     int64  `json:"large-message-size"`
+	LargeMessageSourceIP string `json:"large-message-source-ip"`
+
+	// Use the sender of the most recent Resent-* header block (if present)
+	// as the envelope sender instead of the original sender
+	UseResentSender bool `json:"use-resent-sender"`
+
+	// Map reputation tier names to the pool of source IPs used for each tier
+	// and map sender domains to tiers - a sender's tier takes precedence over
+	// the tier of the host
+	Tiers       map[string][]string `json:"tiers"`
+	SenderTiers map[string]string   `json:"sender-tiers"`
+
+	// Convert bare CR and LF characters in message bodies to CRLF before
+	// signing and delivery
+	NormalizeLineEndings bool `json:"normalize-line-endings"`
+
+	// Policy for lines longer than 998 characters, which are rejected as the
+	// message is submitted and wrapped as it is delivered (defaults to pass)
+	LongLines string `json:"long-lines"`
+
+	// Reply code and message used when a message is rejected for containing
+	// long lines (defaults to 550 and "message contains lines longer than
+	// 998 characters")
+	LongLinesCode    int    `json:"long-lines-code"`
+	LongLinesMessage string `json:"long-lines-message"`
+
+	// Add Date and Message-ID headers to messages without them
+	AddDateHeader      bool `json:"add-date-header"`
+	AddMessageIDHeader bool `json:"add-message-id-header"`
+
+	// Function used to generate the Message-ID header (including angle
+	// brackets), provided by the application
+	MessageIDGenerator func(*Message) string `json:"-"`
+
+	// Policy for messages without a From header, applied as the message is
+	// submitted (defaults to pass)
+	MissingFromPolicy string `json:"missing-from-policy"`
+
+	// Minimum number of seconds between connections to the same host
+	ConnectionInterval int `json:"connection-interval"`
+
+	// Maximum number of new connections established using each source IP
+	// per second across all hosts (unlimited if zero) and the number that
+	// may be established at once
+	SourceIPConnectionRate  float64 `json:"source-ip-connection-rate"`
+	SourceIPConnectionBurst int     `json:"source-ip-connection-burst"`
+
+	// Enable the built-in Prometheus metrics backend or provide a different
+	// backend (which takes precedence)
+	EnableMetrics bool    `json:"enable-metrics"`
+	Metrics       Metrics `json:"-"`
+
+	// Maximum number of hosts that have their own label in metrics, with the
+	// remaining hosts sharing one (defaults to 100)
+	MaxHostLabels int `json:"max-host-labels"`
+
+	// Message tags used for grouping delivery statistics and the maximum
+	// number of distinct values tracked for each tag (defaults to 100)
+	TagLabels    []string `json:"tag-labels"`
+	MaxTagValues int      `json:"max-tag-values"`
+
+	// Policy for errors that occur while waiting for the server to confirm
+	// receipt of a message (defaults to assume-failed)
+	DataErrorPolicy string `json:"data-error-policy"`
+
+	// Number of delivery attempts that may fail to complete (due to a crash,
+	// for example) before a message is quarantined (0 to disable)
+	MaxIncompleteAttempts int `json:"max-incomplete-attempts"`
+
+	// Maximum number of times delivery of a message is deferred (defaults to
+	// 18) and maximum number of seconds before a message is failed (0 for no
+	// limit) - both may be overridden for individual hosts and messages
+	MaxAttempts int `json:"max-attempts"`
+	MaxLifetime int `json:"max-lifetime"`
+
+	// Rate (per second) and burst size at which messages deferred because
+	// their mail servers could not be looked up are retried across all hosts
+	// (0 for no limit) and the maximum number of seconds added at random to
+	// their retry delay
+	DNSRetryRate   float64 `json:"dns-retry-rate"`
+	DNSRetryBurst  int     `json:"dns-retry-burst"`
+	DNSRetryJitter int     `json:"dns-retry-jitter"`
+
+	// Period during which deferred messages may be retried (retries that
+	// would occur outside of it are delayed until it opens)
+	SendingWindow *SendingWindow `json:"sending-window"`
+
+	// Log levels for successful, transient and permanent outcomes of
+	// delivery attempts (defaults to info, error and error)
+	LogLevels map[string]string `json:"log-levels"`
+
+	// Log every extension advertised by mail servers in response to EHLO
+	LogExtensions bool `json:"log-extensions"`
+
+	// Number of recent deliveries kept in the delivery history (defaults to
+	// 100)
+	HistorySize int `json:"history-size"`
+
+	// Periodically send a test message to monitor delivery
+	Monitor *MonitorConfig `json:"monitor"`
+
+	// Periodically check source IPs against DNS-based blocklists
+	Blocklist *BlocklistConfig `json:"blocklist"`
+
+	// Send TLS-RPT aggregate reports to domains that request them
+	TLSReporting *TLSReportingConfig `json:"tls-reporting"`
+
+	// Move messages whose next attempt is at least this many seconds away
+	// to cold storage until shortly before the attempt (disabled if zero)
+	SpillThreshold int `json:"spill-threshold"`
+
+	// Number of goroutines used to load messages from disk at startup
+	// (defaults to 1)
+	RecoveryConcurrency int `json:"recovery-concurrency"`
+
+	// Maximum number of messages loaded at startup that are released to
+	// their host queues each second once due (unlimited if zero)
+	RecoveryRate float64 `json:"recovery-rate"`
+
+	// Policy for importing messages that already exist (defaults to skip)
+	ImportPolicy string `json:"import-policy"`
+
+	// Function invoked from host queues when the state of a message changes,
+	// provided by the application
+	OnStateChange func(*Event) `json:"-"`
+
+	// Transports that hosts may use instead of SMTP, provided by the
+	// application
+	Transports map[string]Transport `json:"-"`
+
+	// Map domain names to the config used for delivering to them
+	Hosts map[string]*HostConfig `json:"hosts"`
+
+	// Route used for hosts that have no mail servers in their config or in
+	// DNS (messages to them are bounced if unset)
+	DefaultRoute *DefaultRoute `json:"default-route"`
+}
+
+// Convert the value to a duration in seconds, using the default if unset.
+func seconds(value, def int) time.Duration {
+	if value == 0 {
+		value = def
+	}
+	return time.Duration(value) * time.Second
+}
+
+// Select the first value that is set.
+func firstSet(values ...int) int {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+func (c *Config) dialTimeout(host string) time.Duration {
+	return seconds(firstSet(c.hostConfig(host).DialTimeout, c.DialTimeout), 30)
+}
+
+func (c *Config) greetingTimeout() time.Duration {
+	return seconds(c.GreetingTimeout, 30)
+}
+
+func (c *Config) commandTimeout(host string) time.Duration {
+	return seconds(firstSet(c.hostConfig(host).CommandTimeout, c.CommandTimeout), 20)
+}
+
+func (c *Config) dataTimeout(host string) time.Duration {
+	return seconds(firstSet(c.hostConfig(host).DataTimeout, c.DataTimeout), 120)
+}
+
+func (c *Config) maxReplySize() int {
+	if c.MaxReplySize == 0 {
+		return 64 * 1024
+	}
+	return c.MaxReplySize
+}
+
+func (c *Config) longLinesCode() int {
+	if c.LongLinesCode == 0 {
+		return 550
+	}
+	return c.LongLinesCode
+}
+
+func (c *Config) longLinesMessage() string {
+	if c.LongLinesMessage == "" {
+		return "message contains lines longer than 998 characters"
+	}
+	return c.LongLinesMessage
+}
+
+func (c *Config) maxHostLabels() int {
+	if c.MaxHostLabels == 0 {
+		return 100
+	}
+	return c.MaxHostLabels
+}
+
+func (c *Config) maxTagValues() int {
+	if c.MaxTagValues == 0 {
+		return 100
+	}
+	return c.MaxTagValues
+}
+
+// Retrieve the configuration for the specified host. An empty configuration
+// is returned if the host has none.
+func (c *Config) hostConfig(host string) *HostConfig {
+	if h, ok := c.Hosts[host]; ok {
+		return h
+	}
+	return &HostConfig{}
+}
+
+// Determine if connections to the specified host made with the other
+// configuration would differ from those made with this one.
+func (c *Config) connectionChanged(o *Config, host string) bool {
+	return !reflect.DeepEqual(c.hostConfig(host), o.hostConfig(host)) ||
+		c.DisableSSLVerification != o.DisableSSLVerification ||
+		c.TLSRenegotiation != o.TLSRenegotiation ||
+		!reflect.DeepEqual(c.TLSNextProtos, o.TLSNextProtos) ||
+		!reflect.DeepEqual(c.ClientCertificate, o.ClientCertificate) ||
+		!reflect.DeepEqual(c.ClientCertificates, o.ClientCertificates) ||
+		c.LargeMessageSourceIP != o.LargeMessageSourceIP ||
+		!reflect.DeepEqual(c.Tiers, o.Tiers) ||
+		!reflect.DeepEqual(c.SendingIdentities, o.SendingIdentities) ||
+		c.dialTimeout(host) != o.dialTimeout(host) ||
+		c.greetingTimeout() != o.greetingTimeout() ||
+		c.commandTimeout(host) != o.commandTimeout(host) ||
+		c.dataTimeout(host) != o.dataTimeout(host) ||
+		c.maxReplySize() != o.maxReplySize() ||
+		!reflect.DeepEqual(c.DefaultRoute, o.DefaultRoute)
+}
+
+// Create the TLS configuration used for connecting to the specified server.
+// Certificates are verified after the handshake by verifyCertificate so that
+// validation failures can be distinguished from handshake failures.
+func (c *Config) tlsConfig(server string) *tls.Config {
+	config := &tls.Config{
+		ServerName:         server,
+		InsecureSkipVerify: true,
+		NextProtos:         c.TLSNextProtos,
+	}
+	switch c.TLSRenegotiation {
+	case "once":
+		config.Renegotiation = tls.RenegotiateOnceAsClient
+	case "freely":
+		config.Renegotiation = tls.RenegotiateFreelyAsClient
+	}
+	if cert := c.clientCertificate(server); cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config
+}
+
+// Verify the certificate presented by the server during the handshake.
+func (c *Config) verifyCertificate(server string, state tls.ConnectionState) error {
+	if c.DisableSSLVerification {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       server,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// Determine the client certificate for the mail server, falling back to the
+// default certificate if the server does not have one. The certificates are
+// available once the configuration is loaded.
+func (c *Config) clientCertificate(server string) *tls.Certificate {
+	if cert, ok := c.clientCerts[util.NormalizeDomain(server)]; ok {
+		return cert
+	}
+	return c.defaultClientCert
+}
+
+// Load the certificate and private key, ensuring that they match.
+func (cc *ClientCertificate) load() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(cc.Cert, cc.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Load the files referred to by the configuration and ensure that it is
+// valid, so that problems are reported when the configuration is loaded
+// rather than during delivery.
+func (c *Config) load() error {
+	switch c.TLSRenegotiation {
+	case "", "never", "once", "freely":
+	default:
+		return fmt.Errorf("invalid TLS renegotiation setting %q", c.TLSRenegotiation)
+	}
+	c.defaultClientCert = nil
+	if c.ClientCertificate != nil {
+		cert, err := c.ClientCertificate.load()
+		if err != nil {
+			return fmt.Errorf("client certificate: %s", err)
+		}
+		c.defaultClientCert = cert
+	}
+	c.clientCerts = make(map[string]*tls.Certificate)
+	for server, cc := range c.ClientCertificates {
+		name, err := util.ToASCII(server)
+		if err != nil {
+			return fmt.Errorf("client certificate for %s: %s", server, err)
+		}
+		cert, err := cc.load()
+		if err != nil {
+			return fmt.Errorf("client certificate for %s: %s", server, err)
+		}
+		c.clientCerts[util.NormalizeDomain(name)] = cert
+	}
+	if w := c.SendingWindow; w != nil {
+		if _, _, _, err := w.parse(); err != nil {
+			return fmt.Errorf("sending window: %s", err)
+		}
+	}
+	for host, hc := range c.Hosts {
+		if hc == nil {
+			continue
+		}
+		if w := hc.SendingWindow; w != nil {
+			if _, _, _, err := w.parse(); err != nil {
+				return fmt.Errorf("sending window for %s: %s", host, err)
+			}
+		}
+	}
+	return nil
 }
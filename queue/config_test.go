@@ -0,0 +1,197 @@
+package queue
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestVerifyCertificate(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	state := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{srv.Certificate()},
+	}
+	c := &Config{}
+	if err := c.verifyCertificate("example.com", state); err == nil {
+		t.Fatal("untrusted certificate was accepted")
+	} else if r := tlsResultType(err); r != tlsCertNotTrusted {
+		t.Fatalf("%s != %s", r, tlsCertNotTrusted)
+	}
+	c.DisableSSLVerification = true
+	if err := c.verifyCertificate("example.com", state); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostTimeouts(t *testing.T) {
+	c := &Config{
+		CommandTimeout: 60,
+		Hosts: map[string]*HostConfig{
+			"example.com": {
+				DialTimeout: 90,
+			},
+		},
+	}
+	for _, v := range []struct {
+		host    string
+		dial    time.Duration
+		command time.Duration
+	}{
+		{"example.com", 90 * time.Second, 60 * time.Second},
+		{"example.org", 30 * time.Second, 60 * time.Second},
+	} {
+		if d := c.dialTimeout(v.host); d != v.dial {
+			t.Fatalf("%s: %s != %s", v.host, d, v.dial)
+		}
+		if d := c.commandTimeout(v.host); d != v.command {
+			t.Fatalf("%s: %s != %s", v.host, d, v.command)
+		}
+	}
+}
+
+func TestConnectionChanged(t *testing.T) {
+	c := &Config{
+		SendingIdentities: map[string]*SendingIdentity{
+			"a": {SourceIP: "192.0.2.1"},
+		},
+	}
+	for _, o := range []*Config{
+		{CommandTimeout: 60, SendingIdentities: c.SendingIdentities},
+		{GreetingTimeout: 60, SendingIdentities: c.SendingIdentities},
+		{SendingIdentities: map[string]*SendingIdentity{
+			"a": {SourceIP: "192.0.2.2"},
+		}},
+	} {
+		if !c.connectionChanged(o, "example.com") {
+			t.Fatalf("change not detected: %v", o)
+		}
+	}
+	o := &Config{
+		CommandTimeout:    20,
+		SendingIdentities: c.SendingIdentities,
+	}
+	if c.connectionChanged(o, "example.com") {
+		t.Fatal("default timeout detected as a change")
+	}
+}
+
+// Write a self-signed certificate for the name and its private key to the
+// directory.
+func writeClientCertificate(t *testing.T, directory, name string) *ClientCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &ClientCertificate{
+		Cert: path.Join(directory, name+".crt"),
+		Key:  path.Join(directory, name+".key"),
+	}
+	for f, b := range map[string]*pem.Block{
+		cc.Cert: {Type: "CERTIFICATE", Bytes: der},
+		cc.Key:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(f, pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cc
+}
+
+func TestClientCertificate(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		def = writeClientCertificate(t, d, "default")
+		mx  = writeClientCertificate(t, d, "mx")
+		c   = &Config{
+			ClientCertificate: def,
+			ClientCertificates: map[string]*ClientCertificate{
+				"MX.Example.com.": mx,
+			},
+		}
+	)
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		server string
+		name   string
+	}{
+		{"mx.example.com", "mx"},
+		{"other.example.com", "default"},
+	} {
+		certs := c.tlsConfig(v.server).Certificates
+		if len(certs) != 1 {
+			t.Fatalf("%s: %d certificate(s)", v.server, len(certs))
+		}
+		cert, err := x509.ParseCertificate(certs[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Subject.CommonName != v.name {
+			t.Fatalf("%s: %s != %s", v.server, cert.Subject.CommonName, v.name)
+		}
+	}
+	c.ClientCertificate = nil
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if certs := c.tlsConfig("other.example.com").Certificates; len(certs) != 0 {
+		t.Fatalf("%d certificate(s) without a default", len(certs))
+	}
+	c.ClientCertificates["mx.example.com"] = &ClientCertificate{
+		Cert: mx.Cert,
+		Key:  def.Key,
+	}
+	if err := c.load(); err == nil {
+		t.Fatal("mismatched key was loaded")
+	}
+}
+
+func TestTLSRenegotiation(t *testing.T) {
+	for _, v := range []struct {
+		value string
+		valid bool
+	}{
+		{"", true},
+		{"never", true},
+		{"once", true},
+		{"freely", true},
+		{"freelly", false},
+		{"Once", false},
+	} {
+		c := &Config{TLSRenegotiation: v.value}
+		if err := c.load(); (err == nil) != v.valid {
+			t.Fatalf("%q: %v", v.value, err)
+		}
+	}
+}
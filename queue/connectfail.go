@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Reasons that a connection to a mail server could not be established. A
+// refused connection usually means that the host is up but the service is
+// briefly unavailable, while a timeout suggests that the host is down or that
+// connections are being filtered.
+const (
+	ConnectRefused = "refused"
+	ConnectTimeout = "timeout"
+)
+
+// Error indicating that no connection to a mail server could be established
+// for the specified reason.
+type connectError struct {
+	reason string
+	err    error
+}
+
+func (c *connectError) Error() string {
+	return fmt.Sprintf("unable to connect to a mail server (connection %s): %s", c.reason, c.err)
+}
+
+// Determine why the connection attempt failed, if it was refused or timed
+// out.
+func connectFailureReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectRefused
+	case isTimeout(err):
+		return ConnectTimeout
+	}
+	return ""
+}
+
+// Classify the error from a connection attempt, recording the failure if it
+// was refused or timed out. Nil is returned for other errors.
+func (h *Host) connectFailure(err error) *connectError {
+	reason := connectFailureReason(err)
+	if reason == "" {
+		return nil
+	}
+	h.metrics.IncCounter(metricConnFailures, map[string]string{
+		labelHost:   h.hostLabel(),
+		labelReason: reason,
+	})
+	return &connectError{reason, err}
+}
+
+// Determine the delay before retrying after connection attempts failed,
+// overriding the normal retry schedule if configured for the reason.
+func (c *Config) connectRetryDelay(reason string) time.Duration {
+	var d int
+	switch reason {
+	case ConnectRefused:
+		d = c.RefusedRetryDelay
+	case ConnectTimeout:
+		d = c.TimeoutRetryDelay
+	}
+	return time.Duration(d) * time.Second
+}
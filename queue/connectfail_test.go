@@ -0,0 +1,25 @@
+package queue
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnectFailureReason(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, err = net.Dial("tcp", addr)
+	if r := connectFailureReason(err); r != ConnectRefused {
+		t.Fatalf("%s != %s", r, ConnectRefused)
+	}
+	if r := connectFailureReason(&net.DNSError{IsTimeout: true}); r != ConnectTimeout {
+		t.Fatalf("%s != %s", r, ConnectTimeout)
+	}
+	if r := connectFailureReason(errNoMailServers); r != "" {
+		t.Fatalf("%s != \"\"", r)
+	}
+}
@@ -0,0 +1,195 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Network connection that applies a timeout to each read and write. The
+// timeout can be changed as the session moves between phases. The size of
+// each reply is limited so that a server cannot send replies of unbounded
+// size. Replies are counted separately so that the replies to pipelined
+// commands are not limited as a whole. Data read is copied to the capture
+// buffer if one is set and EHLO is replaced with HELO if heloOnly is set,
+// since the SMTP client offers no other way to skip EHLO.
+type timeoutConn struct {
+	net.Conn
+	timeout      time.Duration
+	maxReplySize int
+	replySize    int
+	linePos      int
+	continued    bool
+	capture      *bytes.Buffer
+	heloOnly     bool
+}
+
+// Error indicating that a reply from the server exceeded the maximum size.
+type replyLimitError struct {
+	size int
+}
+
+func (r *replyLimitError) Error() string {
+	return fmt.Sprintf("reply exceeded %d bytes", r.size)
+}
+
+// Set the deadline for the next operation.
+func (t *timeoutConn) extendDeadline() {
+	if t.timeout > 0 {
+		t.SetDeadline(time.Now().Add(t.timeout))
+	}
+}
+
+func (t *timeoutConn) Read(b []byte) (int, error) {
+	t.extendDeadline()
+	n, err := t.Conn.Read(b)
+	if t.capture != nil {
+		t.capture.Write(b[:n])
+	}
+	exceeded := false
+	for _, c := range b[:n] {
+		if t.replySize++; t.maxReplySize > 0 && t.replySize > t.maxReplySize {
+			exceeded = true
+		}
+		if c == '\n' {
+			// The last line of a reply has no hyphen after the code
+			if !t.continued {
+				t.replySize = 0
+			}
+			t.linePos = 0
+			t.continued = false
+			continue
+		}
+		if t.linePos == 3 {
+			t.continued = c == '-'
+		}
+		t.linePos++
+	}
+	if exceeded {
+		return n, &replyLimitError{t.maxReplySize}
+	}
+	return n, err
+}
+
+func (t *timeoutConn) Write(b []byte) (int, error) {
+	t.extendDeadline()
+	if t.heloOnly && bytes.HasPrefix(b, []byte("EHLO ")) {
+		b = append([]byte("HELO "), b[5:]...)
+	}
+	return t.Conn.Write(b)
+}
+
+// Connection to a mail server. The generation of the host configuration used
+// to establish the connection is recorded so that connections made with stale
+// settings can be discarded. The reputation tier is recorded so that messages
+// in other tiers are not delivered from the wrong address. The number of
+// messages delivered is recorded so that the connection can be closed once
+// the host's limit is reached.
+type connection struct {
+	*smtp.Client
+	conn        *timeoutConn
+	generation  int
+	tier        string
+	identity    string
+	sourceIP    string
+	release     func()
+	registry    *connRegistry
+	id          int
+	server      string
+	tls         *TLSInfo
+	tlsTimedOut bool
+	extensions  map[string]string
+	delivered   int
+}
+
+// Create a client for the network connection, waiting no longer than the
+// specified timeout for the server's greeting and reading no more than the
+// maximum size for each reply. The network connection is closed if an error
+// occurs.
+func newConnection(conn net.Conn, server string, timeout time.Duration, maxReplySize int) (*connection, error) {
+	t := &timeoutConn{
+		Conn:         conn,
+		timeout:      timeout,
+		maxReplySize: maxReplySize,
+	}
+	c, err := smtp.NewClient(t, server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &connection{
+		Client: c,
+		conn:   t,
+	}, nil
+}
+
+// Determine if the connection has delivered as many messages as the host
+// allows over a single connection.
+func (h *Host) connectionExhausted(c *connection) bool {
+	max := h.config.hostConfig(h.host).MaxMessagesPerConnection
+	return max > 0 && c.delivered >= max
+}
+
+// Record the connection in the registry so that it appears in the list of
+// open connections until it is closed.
+func (c *connection) register(r *connRegistry, host, server string) {
+	c.registry = r
+	c.server = server
+	c.id = r.add(&ConnInfo{
+		Host:   host,
+		Server: server,
+		Opened: time.Now(),
+	})
+}
+
+// Update the connection's entry in the registry.
+func (c *connection) update(fn func(*ConnInfo)) {
+	if c.registry != nil {
+		c.registry.update(c.id, fn)
+	}
+}
+
+// Remove the connection from the registry and release its slot for the
+// source IP.
+func (c *connection) unregister() {
+	if c.registry != nil {
+		c.registry.remove(c.id)
+		c.registry = nil
+	}
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+// Close the connection without ending the session.
+func (c *connection) Close() error {
+	c.unregister()
+	return c.Client.Close()
+}
+
+// End the session and close the connection.
+func (c *connection) Quit() error {
+	c.unregister()
+	return c.Client.Quit()
+}
+
+// Specify a recipient for the message and provide the code of the server's
+// reply, allowing 251 and 252 to be distinguished from 250.
+func (c *connection) rcpt(to string) (int, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return 0, errors.New("smtp: A line must not contain CR or LF")
+	}
+	id, err := c.Text.Cmd("RCPT TO:<%s>", to)
+	if err != nil {
+		return 0, err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	code, _, err := c.Text.ReadResponse(25)
+	return code, err
+}
@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnectionExhausted(t *testing.T) {
+	h := &Host{
+		config: &Config{
+			Hosts: map[string]*HostConfig{
+				"example.com": {MaxMessagesPerConnection: 2},
+			},
+		},
+		host: "example.com",
+	}
+	c := &connection{}
+	for _, exhausted := range []bool{false, false, true} {
+		if e := h.connectionExhausted(c); e != exhausted {
+			t.Fatalf("%d: %t != %t", c.delivered, e, exhausted)
+		}
+		c.delivered++
+	}
+	h.config.Hosts["example.com"].MaxMessagesPerConnection = 0
+	if h.connectionExhausted(c) {
+		t.Fatal("connection exhausted without a limit")
+	}
+}
+
+func TestReplyLimit(t *testing.T) {
+	var (
+		line  = "250 " + strings.Repeat("a", 60) + "\r\n"
+		batch = strings.Repeat(line, 10)
+		long  = "250-" + strings.Repeat("a", 60) + "\r\n250 " + strings.Repeat("a", 60) + "\r\n"
+	)
+	for _, v := range []struct {
+		data     string
+		exceeded bool
+	}{
+		{batch, false},
+		{long, true},
+		{batch + long, true},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte(v.data))
+			server.Close()
+		}()
+		var (
+			c   = &timeoutConn{Conn: client, maxReplySize: 100}
+			err error
+		)
+		for err == nil {
+			_, err = c.Read(make([]byte, 7))
+		}
+		client.Close()
+		if _, ok := err.(*replyLimitError); ok != v.exceeded {
+			t.Fatalf("%q: %t != %t (%v)", v.data, ok, v.exceeded, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the rate at which connections are established.
+type connBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets for each host and each source IP, limiting the rate at which
+// new connections are established regardless of how many are open. All
+// methods are safe to call from multiple goroutines.
+type connBuckets struct {
+	m       sync.Mutex
+	buckets map[string]*connBucket
+}
+
+// Create a new, empty set of buckets.
+func newConnBuckets() *connBuckets {
+	return &connBuckets{
+		buckets: make(map[string]*connBucket),
+	}
+}
+
+// Reserve a token from the bucket with the specified rate (per second) and
+// burst size and determine how long to wait before it may be used.
+func (c *connBuckets) reserve(key string, rate float64, burst int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := time.Now()
+	b, ok := c.buckets[key]
+	if !ok {
+		b = &connBucket{tokens: float64(burst)}
+		c.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// Wait until a new connection to the host using the source IP is permitted
+// by the connection rates for both, recording the attempt and any wait in
+// the metrics. False is returned if the host queue was shut down while
+// waiting.
+func (h *Host) waitForConnRate(sourceIP string) bool {
+	var (
+		hostConfig = h.config.hostConfig(h.host)
+		hostWait   = h.connBuckets.reserve("host:"+h.host, hostConfig.ConnectionRate, hostConfig.ConnectionBurst)
+		ipWait     = h.connBuckets.reserve("ip:"+sourceIP, h.config.SourceIPConnectionRate, h.config.SourceIPConnectionBurst)
+		d          = hostWait
+		scope      = RateLimitHost
+	)
+	if ipWait > d {
+		d = ipWait
+		scope = RateLimitSourceIP
+	}
+	h.metrics.IncCounter(metricConnsOpened, map[string]string{
+		labelHost: h.hostLabel(),
+		labelIP:   sourceIP,
+	})
+	if d <= 0 {
+		return true
+	}
+	h.log.Debugf("waiting %s to limit the connection rate", d)
+	h.metrics.IncCounter(metricConnThrottled, map[string]string{
+		labelHost:  h.hostLabel(),
+		labelScope: scope,
+	})
+	return h.sleep(d)
+}
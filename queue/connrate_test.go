@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"testing"
+	"time"
+)
+
+func TestConnBuckets(t *testing.T) {
+	c := newConnBuckets()
+	for i := 0; i < 2; i++ {
+		if d := c.reserve("host:example.com", 1, 2); d != 0 {
+			t.Fatalf("%d: %s != 0", i, d)
+		}
+	}
+	if d := c.reserve("host:example.com", 1, 2); d < 900*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected wait: %s", d)
+	}
+	if d := c.reserve("host:example.org", 1, 2); d != 0 {
+		t.Fatalf("%s != 0", d)
+	}
+	for i := 0; i < 5; i++ {
+		if d := c.reserve("ip:192.0.2.1", 0, 0); d != 0 {
+			t.Fatalf("%d: %s != 0", i, d)
+		}
+	}
+}
+
+func TestCleartextReconnectRate(t *testing.T) {
+	l, err := newStallingServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var (
+		c = &Config{
+			PrivateAllowlist: []string{"127.0.0.0/8"},
+			Hosts: map[string]*HostConfig{
+				"example.com": {
+					CommandTimeout:   1,
+					TLSTimeoutPolicy: TLSTimeoutCleartext,
+					ConnectionRate:   0.001,
+					ConnectionBurst:  1,
+				},
+			},
+		}
+		h = &Host{
+			shared: newShared(c),
+			config: c,
+			host:   "example.com",
+			log:    logrus.WithField("context", "example.com"),
+			stop:   make(chan bool),
+		}
+	)
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		close(h.stop)
+	}()
+	if conn, _ := h.tryMailServer(l.Addr().String(), "localhost", "", false); conn != nil {
+		conn.Close()
+		t.Fatal("reconnected without waiting for the connection rate")
+	}
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"bufio"
+	"io"
+)
+
+// Reader that converts bare CR and LF characters to CRLF as required by RFC
+// 5321. The conversion is performed while streaming so that the message is
+// never buffered in its entirety. Dot-stuffing is performed later by the SMTP
+// client when the body is written.
+type crlfReader struct {
+	io.Closer
+	r         *bufio.Reader
+	prevCR    bool
+	pendingLF bool
+}
+
+// Create a reader that normalizes the line endings in the specified reader.
+func newCRLFReader(r io.ReadCloser) io.ReadCloser {
+	return &crlfReader{
+		Closer: r,
+		r:      bufio.NewReader(r),
+	}
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if c.pendingLF {
+			p[n] = '\n'
+			n++
+			c.pendingLF = false
+			continue
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if c.prevCR {
+				c.prevCR = false
+				c.pendingLF = true
+				continue
+			}
+			return n, err
+		}
+		if c.prevCR {
+			c.prevCR = false
+			if b != '\n' {
+				c.r.UnreadByte()
+				c.pendingLF = true
+				continue
+			}
+		} else if b == '\n' {
+			b = '\r'
+			c.pendingLF = true
+		}
+		if b == '\r' && !c.pendingLF {
+			c.prevCR = true
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
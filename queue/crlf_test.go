@@ -0,0 +1,30 @@
+package queue
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCRLFReader(t *testing.T) {
+	data := []struct {
+		i, o string
+	}{
+		{"a\r\nb\r\n", "a\r\nb\r\n"},
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"a\rb\r", "a\r\nb\r\n"},
+		{"a\n\r\n\n", "a\r\n\r\n\r\n"},
+		{"\r\r\n", "\r\n\r\n"},
+	}
+	for _, d := range data {
+		r := newCRLFReader(ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(d.i))))
+		b, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != d.o {
+			t.Fatalf("%q != %q", b, d.o)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/mail"
 	"strings"
@@ -9,18 +10,44 @@ import (
 	"fmt"
 
 	"io/ioutil"
+	"sync"
 
 	"github.com/Freeaqingme/dkim"
 )
 
-var dkimInstances = make(map[string]*dkim.DKIM)
+var (
+	dkimMutex     sync.Mutex
+	dkimInstances = make(map[string]*dkim.DKIM)
+)
 
-func dkimFor(from string, config *Config) (*dkim.DKIM, error) {
+// Discard all cached DKIM instances so that they are recreated from the
+// current configuration.
+func resetDKIM() {
+	dkimMutex.Lock()
+	defer dkimMutex.Unlock()
+	dkimInstances = make(map[string]*dkim.DKIM)
+}
+
+// Extract the domain from the sender's address.
+func senderDomain(from string) (string, error) {
 	emailAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", err
+	}
+	return strings.Split(emailAddress.Address, "@")[1], nil
+}
+
+func dkimFor(from string, config *Config) (*dkim.DKIM, error) {
+	domain, err := senderDomain(from)
 	if err != nil {
 		return nil, err
 	}
-	domain := strings.Split(emailAddress.Address, "@")[1]
+	return dkimForDomain(domain, config)
+}
+
+func dkimForDomain(domain string, config *Config) (*dkim.DKIM, error) {
+	dkimMutex.Lock()
+	defer dkimMutex.Unlock()
 	dkimInstance, found := dkimInstances[domain]
 	if found {
 		return dkimInstance, nil
@@ -49,12 +76,55 @@ func dkimFor(from string, config *Config) (*dkim.DKIM, error) {
 	return dkimInstance, nil
 }
 
+// Policies for senders whose messages must be signed. Messages that cannot be
+// signed are either bounced or deferred.
+const (
+	DKIMRequireBounce = "bounce"
+	DKIMRequireDefer  = "defer"
+)
+
+// Error indicating that a message that must be signed could not be.
+type dkimRequiredError struct {
+	policy string
+	err    error
+}
+
+func (d *dkimRequiredError) Error() string {
+	return fmt.Sprintf("message must be signed: %s", d.err)
+}
+
+// Determine the signing policy for the domain.
+func dkimRequirement(domain string, config *Config) (string, bool) {
+	dkimConfig, found := config.DKIMConfigs[domain]
+	return dkimConfig.Require, found && dkimConfig.PrivateKey != ""
+}
+
 func dkimSigned(from string, input io.ReadCloser, config *Config) (io.ReadCloser, error) {
-	dkim, err := dkimFor(from, config)
+	domain, err := senderDomain(from)
 	if err != nil {
 		return nil, fmt.Errorf("error while getting dkimInstances for %q: %s", from, err)
 	}
+	return dkimSignedBy(domain, input, config)
+}
+
+// Sign the message with the key for the domain, which is usually the
+// sender's domain.
+func dkimSignedBy(domain string, input io.ReadCloser, config *Config) (io.ReadCloser, error) {
+	require, hasKey := dkimRequirement(domain, config)
+	if require != "" && !hasKey {
+		return nil, &dkimRequiredError{require, errors.New("no DKIM key is configured")}
+	}
+	dkim, err := dkimForDomain(domain, config)
+	if err != nil {
+		if require != "" {
+			return nil, &dkimRequiredError{require, err}
+		}
+		return nil, fmt.Errorf("error while getting dkimInstances for %q: %s", domain, err)
+	}
 	if dkim == nil {
+		if require != "" {
+			return nil, &dkimRequiredError{require, errors.New("DKIM key could not be loaded")}
+		}
 		return input, nil
 	}
 	// TODO: Do not load the content
@@ -65,6 +135,9 @@ func dkimSigned(from string, input io.ReadCloser, config *Config) (io.ReadCloser
 	}
 	signedEmail, err := dkim.Sign(email)
 	if err != nil {
+		if require != "" {
+			return nil, &dkimRequiredError{require, err}
+		}
 		return nil, fmt.Errorf("error while signing the email: %s", err)
 	}
 	return ioutil.NopCloser(bytes.NewReader(signedEmail)), nil
@@ -162,3 +162,17 @@ func TestDKIMNotSigning(t *testing.T) {
 		t.Fatal("Expecting the message to be untouched")
 	}
 }
+
+func TestDKIMRequired(t *testing.T) {
+	dkimInstances = make(map[string]*dkim.DKIM)
+	config := Config{
+		DKIMConfigs: map[string]DKIMConfig{
+			"example.org": {Require: DKIMRequireDefer},
+		},
+	}
+	r := ioutil.NopCloser(bytes.NewBufferString(sampleMessage))
+	_, err := dkimSigned(sampleFrom, r, &config)
+	if e, ok := err.(*dkimRequiredError); !ok || e.policy != DKIMRequireDefer {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
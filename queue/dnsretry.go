@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Error that occurred while looking up the mail servers for a host.
+type dnsError struct {
+	error
+}
+
+// Token bucket limiting the rate at which messages deferred due to DNS
+// failures are retried across all hosts. All methods are safe to call from
+// multiple goroutines.
+type dnsRetryLimiter struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	jitter time.Duration
+	tokens float64
+	last   time.Time
+}
+
+// Create a limiter using the specified configuration.
+func newDNSRetryLimiter(c *Config) *dnsRetryLimiter {
+	l := &dnsRetryLimiter{}
+	l.setConfig(c)
+	l.tokens = l.burst
+	return l
+}
+
+// Switch to the specified configuration.
+func (l *dnsRetryLimiter) setConfig(c *Config) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.rate = c.DNSRetryRate
+	l.burst = float64(c.DNSRetryBurst)
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.jitter = time.Duration(c.DNSRetryJitter) * time.Second
+}
+
+// Choose a random delay to add to the retry delay so that retries do not all
+// occur at once.
+func (l *dnsRetryLimiter) randomJitter() time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(l.jitter)))
+}
+
+// Reserve a token and determine how long to wait before it may be used.
+func (l *dnsRetryLimiter) reserve() time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
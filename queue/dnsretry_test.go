@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDNSRetryLimiter(t *testing.T) {
+	l := newDNSRetryLimiter(&Config{
+		DNSRetryRate:  1,
+		DNSRetryBurst: 2,
+	})
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(); d != 0 {
+			t.Fatalf("%s != 0", d)
+		}
+	}
+	if d := l.reserve(); d < 900*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected delay %s", d)
+	}
+	if d := l.reserve(); d < 1900*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("unexpected delay %s", d)
+	}
+	l.setConfig(&Config{})
+	if d := l.reserve(); d != 0 {
+		t.Fatalf("%s != 0", d)
+	}
+}
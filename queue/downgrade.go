@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons that a connection which could have used TLS did not use it (or did
+// not authenticate the server): STARTTLS was not advertised, the handshake
+// failed and the connection was reestablished without TLS, the certificate
+// was invalid and delivery continued without authentication, or the policy
+// for invalid certificates reestablished the connection without TLS.
+const (
+	DowngradeNotAdvertised  = "not-advertised"
+	DowngradeHandshakeFail  = "handshake-fail"
+	DowngradeCertInvalid    = "cert-invalid"
+	DowngradePolicyFallback = "policy-fallback"
+)
+
+// TLS downgrades observed for a host. Counts are kept for each reason along
+// with the details of the most recent downgrade.
+type DowngradeStatus struct {
+	Counts     map[string]int `json:"counts"`
+	LastServer string         `json:"last-server"`
+	LastReason string         `json:"last-reason"`
+	LastTime   time.Time      `json:"last-time"`
+}
+
+// TLS downgrades observed for each host. All methods are safe to call from
+// multiple goroutines.
+type downgradeLog struct {
+	m     sync.Mutex
+	hosts map[string]*DowngradeStatus
+}
+
+// Create a new, empty log.
+func newDowngradeLog() *downgradeLog {
+	return &downgradeLog{
+		hosts: make(map[string]*DowngradeStatus),
+	}
+}
+
+// Record a downgrade for the specified host.
+func (d *downgradeLog) add(host, server, reason string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	s, ok := d.hosts[host]
+	if !ok {
+		s = &DowngradeStatus{
+			Counts: make(map[string]int),
+		}
+		d.hosts[host] = s
+	}
+	s.Counts[reason]++
+	s.LastServer = server
+	s.LastReason = reason
+	s.LastTime = time.Now()
+}
+
+// Retrieve the downgrades for all hosts.
+func (d *downgradeLog) all() map[string]*DowngradeStatus {
+	d.m.Lock()
+	defer d.m.Unlock()
+	hosts := make(map[string]*DowngradeStatus)
+	for h, v := range d.hosts {
+		s := *v
+		s.Counts = make(map[string]int)
+		for r, n := range v.Counts {
+			s.Counts[r] = n
+		}
+		hosts[h] = &s
+	}
+	return hosts
+}
+
+// Record a TLS downgrade for a connection to the server in the log and in
+// the metrics.
+func (h *Host) recordDowngrade(server, reason string) {
+	h.metrics.IncCounter(metricTLSDowngrades, map[string]string{
+		labelHost:   h.hostLabel(),
+		labelReason: reason,
+	})
+	h.downgrades.add(h.host, server, reason)
+}
@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestDowngradeLog(t *testing.T) {
+	d := newDowngradeLog()
+	d.add("example.com", "mx1.example.com", DowngradeNotAdvertised)
+	d.add("example.com", "mx2.example.com", DowngradeNotAdvertised)
+	d.add("example.com", "mx2.example.com", DowngradeCertInvalid)
+	d.add("example.org", "mx.example.org", DowngradeHandshakeFail)
+	all := d.all()
+	if len(all) != 2 {
+		t.Fatalf("%d != 2", len(all))
+	}
+	s := all["example.com"]
+	if s.Counts[DowngradeNotAdvertised] != 2 || s.Counts[DowngradeCertInvalid] != 1 {
+		t.Fatalf("unexpected counts: %v", s.Counts)
+	}
+	if s.LastServer != "mx2.example.com" || s.LastReason != DowngradeCertInvalid {
+		t.Fatalf("unexpected last downgrade: %s, %s", s.LastServer, s.LastReason)
+	}
+	s.Counts[DowngradeNotAdvertised] = 0
+	if d.all()["example.com"].Counts[DowngradeNotAdvertised] != 2 {
+		t.Fatal("counts shared with copy")
+	}
+}
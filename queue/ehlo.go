@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Greetings used for the host's mail servers. The auto mode sends EHLO and
+// falls back to HELO if it is rejected.
+const (
+	GreetingAuto = "auto"
+	GreetingHELO = "helo"
+	GreetingEHLO = "ehlo"
+)
+
+// Error indicating that the server rejected EHLO when the host requires it.
+var errEHLORequired = errors.New("server does not support EHLO, which is required for the host")
+
+// Extensions that are not expected to have parameters.
+var flagExtensions = map[string]bool{
+	"8BITMIME":            true,
+	"CHUNKING":            true,
+	"DSN":                 true,
+	"ENHANCEDSTATUSCODES": true,
+	"PIPELINING":          true,
+	"SMTPUTF8":            true,
+	"STARTTLS":            true,
+}
+
+// Extract every extension advertised in the reply to EHLO. Parsing is
+// deliberately lenient since the reply is only used for diagnostics - lines
+// that cannot be parsed are skipped and parameters are kept as they were
+// sent. Nil is returned if the reply does not indicate success.
+func parseEHLO(reply []byte) map[string]string {
+	var (
+		extensions map[string]string
+		first      = true
+	)
+	for _, l := range bytes.Split(reply, []byte("\n")) {
+		line := strings.TrimRight(string(l), "\r")
+		if len(line) < 4 || !strings.HasPrefix(line, "250") {
+			break
+		}
+		if first {
+			extensions = make(map[string]string)
+			first = false
+		} else if f := strings.SplitN(line[4:], " ", 2); f[0] != "" {
+			var param string
+			if len(f) == 2 {
+				param = f[1]
+			}
+			extensions[strings.ToUpper(f[0])] = param
+		}
+		if line[3] == ' ' {
+			break
+		}
+	}
+	return extensions
+}
+
+// Determine if the parameters for a known extension are those expected. The
+// connection is not affected either way but unexpected parameters are worth
+// noting when diagnosing delivery problems.
+func validExtensionParam(name, param string) bool {
+	switch {
+	case flagExtensions[name]:
+		return param == ""
+	case name == "SIZE":
+		return strings.Trim(param, "0123456789") == ""
+	}
+	return true
+}
+
+// Greet the server according to the mode and capture the extensions
+// advertised in the reply. When EHLO is required, errEHLORequired is returned
+// if the server only accepted HELO.
+func (c *connection) hello(hostname, mode string) error {
+	c.conn.capture = &bytes.Buffer{}
+	c.conn.heloOnly = mode == GreetingHELO
+	defer func() {
+		c.conn.capture = nil
+		c.conn.heloOnly = false
+	}()
+	if err := c.Hello(hostname); err != nil {
+		return err
+	}
+	if mode == GreetingHELO {
+		return nil
+	}
+	c.extensions = parseEHLO(c.conn.capture.Bytes())
+	if c.extensions == nil && mode == GreetingEHLO {
+		return errEHLORequired
+	}
+	return nil
+}
+
+// Record the extensions advertised by the server, logging them if configured
+// to do so along with any known extension that has unexpected parameters.
+func (h *Host) recordExtensions(c *connection) {
+	for name, param := range c.extensions {
+		if h.config.LogExtensions {
+			h.log.Infof("%s advertised %s %s", c.server, name, param)
+		}
+		if !validExtensionParam(name, param) {
+			h.log.Warnf("%s advertised %s with unexpected parameters %q", c.server, name, param)
+		}
+	}
+	h.capabilities.set(h.host, newCapabilities(c.Client, c.server, c.extensions))
+}
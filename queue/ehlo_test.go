@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"reflect"
+	"testing"
+)
+
+func TestParseEHLO(t *testing.T) {
+	for _, v := range []struct {
+		reply      string
+		extensions map[string]string
+	}{
+		{
+			"250-mx.example.com greets you\r\n250-SIZE 1000\r\n250-x-custom a b\r\n250-\r\n250 STARTTLS\r\n",
+			map[string]string{"SIZE": "1000", "X-CUSTOM": "a b", "STARTTLS": ""},
+		},
+		{"250 mx.example.com\r\n", map[string]string{}},
+		{"502 not implemented\r\n", nil},
+	} {
+		if e := parseEHLO([]byte(v.reply)); !reflect.DeepEqual(e, v.extensions) {
+			t.Fatalf("%v != %v", e, v.extensions)
+		}
+	}
+}
+
+func TestValidExtensionParam(t *testing.T) {
+	for _, v := range []struct {
+		name  string
+		param string
+		valid bool
+	}{
+		{"SIZE", "1000", true},
+		{"SIZE", "", true},
+		{"SIZE", "unlimited", false},
+		{"PIPELINING", "", true},
+		{"STARTTLS", "now", false},
+		{"X-CUSTOM", "anything", true},
+	} {
+		if valid := validExtensionParam(v.name, v.param); valid != v.valid {
+			t.Fatalf("%s %s: %t != %t", v.name, v.param, valid, v.valid)
+		}
+	}
+}
+
+func TestEHLORequiredNextServer(t *testing.T) {
+	helo, err := newMockServer(map[string][]string{
+		"EHLO": {"502 not implemented"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer helo.Close()
+	srv, err := newMockServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	defer func(f func(string, map[string]int, string) ([]string, error)) {
+		findMailServers = f
+	}(findMailServers)
+	servers := []string{helo.l.Addr().String(), srv.l.Addr().String()}
+	findMailServers = func(string, map[string]int, string) ([]string, error) {
+		return servers, nil
+	}
+	c := &Config{
+		PrivateAllowlist: []string{"127.0.0.0/8"},
+		Hosts: map[string]*HostConfig{
+			"example.com": {GreetingMode: GreetingEHLO},
+		},
+	}
+	h := &Host{
+		shared: newShared(c),
+		config: c,
+		host:   "example.com",
+		log:    logrus.WithField("context", "example.com"),
+		stop:   make(chan bool),
+	}
+	conn, err := h.connectToMailServer("localhost", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	servers = servers[:1]
+	if _, err := h.connectToMailServer("localhost", "", ""); err != errEHLORequired {
+		t.Fatalf("%v != %v", err, errEHLORequired)
+	}
+}
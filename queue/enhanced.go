@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Parse the enhanced status code (RFC 3463) at the start of the reply text,
+// such as "5.1.1". The class must be 2, 4 or 5 and agree with the reply code
+// (if one is provided) and the subject and detail must each have one to three
+// digits. The code must be followed by whitespace or the end of the text. If
+// the code is absent or malformed, false is returned and callers should fall
+// back to the reply code alone.
+func parseEnhancedStatus(code int, text string) (string, bool) {
+	text = strings.TrimLeftFunc(text, unicode.IsSpace)
+	field := text
+	if i := strings.IndexFunc(text, unicode.IsSpace); i != -1 {
+		field = text[:i]
+	}
+	parts := strings.Split(field, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	switch parts[0] {
+	case "2", "4", "5":
+	default:
+		return "", false
+	}
+	if code != 0 && strconv.Itoa(code/100) != parts[0] {
+		return "", false
+	}
+	for _, p := range parts[1:] {
+		if len(p) < 1 || len(p) > 3 {
+			return "", false
+		}
+		for _, r := range p {
+			if r < '0' || r > '9' {
+				return "", false
+			}
+		}
+	}
+	return field, true
+}
@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestParseEnhancedStatus(t *testing.T) {
+	for _, v := range []struct {
+		code     int
+		text     string
+		enhanced string
+		ok       bool
+	}{
+		{550, "5.1.1 User unknown", "5.1.1", true},
+		{451, "4.7.650 rate limited", "4.7.650", true},
+		{250, "2.0.0", "2.0.0", true},
+		{0, "5.7.26 Unauthenticated", "5.7.26", true},
+		{550, "  5.1.1\tUser unknown", "5.1.1", true},
+		{550, "User unknown", "", false},
+		{550, "", "", false},
+		{550, "5.1 User unknown", "", false},
+		{550, "5.1.1.1 User unknown", "", false},
+		{550, "5.1.1234 User unknown", "", false},
+		{550, "5.1.1x User unknown", "", false},
+		{550, "5..1 User unknown", "", false},
+		{550, "3.1.1 User unknown", "", false},
+		{550, "4.1.1 User unknown", "", false},
+		{550, "x.y.z User unknown", "", false},
+		{550, "5.1.1: User unknown", "", false},
+	} {
+		enhanced, ok := parseEnhancedStatus(v.code, v.text)
+		if enhanced != v.enhanced || ok != v.ok {
+			t.Fatalf("%d %q: %q, %t", v.code, v.text, enhanced, ok)
+		}
+	}
+}
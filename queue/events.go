@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// States reported in events. The remaining states (delivered, deferred, failed
+// and quarantined) match the results used for metrics.
+const (
+	stateReceived   = "received"
+	stateAttempting = "attempting"
+)
+
+// Change in the delivery state of a message.
+type Event struct {
+	ID    string    `json:"id"`
+	Host  string    `json:"host"`
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// Number of events buffered for each subscriber before events are dropped.
+const eventBufferSize = 100
+
+// Distributes events to subscribers. Events are dropped for subscribers that
+// fall behind rather than delaying delivery. All methods are safe to call
+// from multiple goroutines.
+type eventStream struct {
+	m           sync.Mutex
+	subscribers map[chan *Event]bool
+}
+
+// Create a new event stream.
+func newEventStream() *eventStream {
+	return &eventStream{
+		subscribers: make(map[chan *Event]bool),
+	}
+}
+
+// Provide the event to each subscriber with room in its buffer.
+func (e *eventStream) send(event *Event) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for s := range e.subscribers {
+		select {
+		case s <- event:
+		default:
+		}
+	}
+}
+
+// Create a new subscription.
+func (e *eventStream) subscribe() chan *Event {
+	e.m.Lock()
+	defer e.m.Unlock()
+	s := make(chan *Event, eventBufferSize)
+	e.subscribers[s] = true
+	return s
+}
+
+// Remove the subscription and close its channel.
+func (e *eventStream) unsubscribe(c <-chan *Event) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for s := range e.subscribers {
+		if s == c {
+			delete(e.subscribers, s)
+			close(s)
+		}
+	}
+}
+
+// Report a change in the state of the message to subscribers and to the
+// application's hook if one was provided.
+func (h *Host) emit(m *Message, state string) {
+	event := &Event{
+		ID:    m.id,
+		Host:  h.host,
+		State: state,
+		Time:  time.Now(),
+	}
+	h.events.send(event)
+	if h.config.OnStateChange != nil {
+		h.config.OnStateChange(event)
+	}
+}
@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestEventStream(t *testing.T) {
+	var (
+		e    = newEventStream()
+		fast = e.subscribe()
+		slow = e.subscribe()
+	)
+	for i := 0; i < eventBufferSize; i++ {
+		e.send(&Event{})
+	}
+	for i := 0; i < eventBufferSize; i++ {
+		<-fast
+	}
+	e.send(&Event{State: stateReceived})
+	if v := (<-fast).State; v != stateReceived {
+		t.Fatalf("%s != %s", v, stateReceived)
+	}
+	if n := len(slow); n != eventBufferSize {
+		t.Fatalf("%d != %d", n, eventBufferSize)
+	}
+	e.unsubscribe(slow)
+	e.unsubscribe(fast)
+	e.send(&Event{})
+}
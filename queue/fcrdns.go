@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Functions used for DNS lookups, replaced during tests.
+var (
+	lookupAddr = net.LookupAddr
+	lookupHost = net.LookupHost
+)
+
+// Length of time that the result of a check is cached.
+const fcrdnsTTL = time.Hour
+
+// Error indicating that no source IP passed the check.
+var errFCrDNS = errors.New("no source IP with valid forward-confirmed reverse DNS")
+
+// Determine if the IP address has forward-confirmed reverse DNS. At least one
+// of the names the address resolves to must resolve back to the address.
+func verifyFCrDNS(ip string) bool {
+	addr := net.ParseIP(ip)
+	names, err := lookupAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, n := range names {
+		addrs, err := lookupHost(n)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if addr.Equal(net.ParseIP(a)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type fcrdnsResult struct {
+	valid   bool
+	expires time.Time
+}
+
+// Cache of check results for each IP address. All methods are safe to call
+// from multiple goroutines.
+type fcrdnsCache struct {
+	m       sync.Mutex
+	results map[string]*fcrdnsResult
+}
+
+// Create a new cache.
+func newFCrDNSCache() *fcrdnsCache {
+	return &fcrdnsCache{
+		results: make(map[string]*fcrdnsResult),
+	}
+}
+
+// Determine if the IP address has forward-confirmed reverse DNS, using the
+// cached result if it has not expired.
+func (f *fcrdnsCache) check(ip string) bool {
+	f.m.Lock()
+	r, ok := f.results[ip]
+	f.m.Unlock()
+	if ok && time.Now().Before(r.expires) {
+		return r.valid
+	}
+	r = &fcrdnsResult{
+		valid:   verifyFCrDNS(ip),
+		expires: time.Now().Add(fcrdnsTTL),
+	}
+	f.m.Lock()
+	f.results[ip] = r
+	f.m.Unlock()
+	return r.valid
+}
@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFCrDNS(t *testing.T) {
+	defer func(a, h func(string) ([]string, error)) {
+		lookupAddr, lookupHost = a, h
+	}(lookupAddr, lookupHost)
+	lookups := 0
+	lookupAddr = func(addr string) ([]string, error) {
+		lookups++
+		switch addr {
+		case "192.0.2.1":
+			return []string{"mail.example.com."}, nil
+		case "192.0.2.2":
+			return []string{"other.example.com."}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	lookupHost = func(host string) ([]string, error) {
+		return []string{"192.0.2.1"}, nil
+	}
+	c := newFCrDNSCache()
+	for _, d := range []struct {
+		ip    string
+		valid bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"192.0.2.3", false},
+		{"192.0.2.1", true},
+	} {
+		if v := c.check(d.ip); v != d.valid {
+			t.Fatalf("%s: %t != %t", d.ip, v, d.valid)
+		}
+	}
+	if lookups != 3 {
+		t.Fatalf("%d != 3", lookups)
+	}
+}
@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"time"
+)
+
+// Policies for messages without a From header.
+const (
+	MissingFromPass   = "pass"
+	MissingFromLog    = "log"
+	MissingFromReject = "reject"
+)
+
+// Read the header section of a message, returning the raw headers (including
+// the empty line that ends them) and the canonical names of those present.
+func readHeaders(r *bufio.Reader) ([]byte, map[string]bool, error) {
+	var (
+		buff  = &bytes.Buffer{}
+		names = make(map[string]bool)
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		buff.Write(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		l := bytes.TrimRight(line, "\r\n")
+		if len(l) == 0 {
+			break
+		}
+		if l[0] == ' ' || l[0] == '\t' {
+			continue
+		}
+		if i := bytes.IndexByte(l, ':'); i > 0 {
+			names[textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(l[:i])))] = true
+		}
+	}
+	return buff.Bytes(), names, nil
+}
+
+// Reader for a message with headers added.
+type headerReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Add Date and Message-ID headers to the message if they are missing and
+// enabled. The date is zero if the header should not be added and the
+// Message-ID is obtained from the function, which is nil if the header should
+// not be added. Only the header section is buffered.
+func addMissingHeaders(r io.ReadCloser, date time.Time, messageID func() string) (io.ReadCloser, error) {
+	b := bufio.NewReader(r)
+	raw, names, err := readHeaders(b)
+	if err != nil {
+		return nil, err
+	}
+	added := &bytes.Buffer{}
+	if !date.IsZero() && !names["Date"] {
+		fmt.Fprintf(added, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	}
+	if messageID != nil && !names["Message-Id"] {
+		fmt.Fprintf(added, "Message-ID: %s\r\n", messageID())
+	}
+	return &headerReader{
+		Reader: io.MultiReader(added, bytes.NewReader(raw), b),
+		Closer: r,
+	}, nil
+}
+
+// Generate a Message-ID for the message using the configured generator. By
+// default, a UUID is used with the name used to greet the mail server.
+func (h *Host) generateMessageID(m *Message, hostname string) string {
+	if h.config.MessageIDGenerator != nil {
+		return h.config.MessageIDGenerator(m)
+	}
+	if n := h.config.hostConfig(h.host).Hostname; n != "" {
+		hostname = n
+	}
+	domain, err := toASCII(hostname)
+	if err != nil {
+		h.log.Error(err.Error())
+		domain = "hectane"
+	}
+	return fmt.Sprintf("<%s@%s>", uuid.New(), domain)
+}
+
+// Generate a Message-ID for a body submitted without one, if the queue is
+// configured to add them, so that it can be saved with every message created
+// for the body and recipients at each host see the same one. An empty string
+// is returned if no Message-ID should be added. The default generator uses
+// the sender's domain.
+func (q *Queue) NewMessageID(from, body string) string {
+	if !q.config.AddMessageIDHeader {
+		return ""
+	}
+	m := &Message{
+		body: body,
+		From: from,
+	}
+	r, err := q.Storage.GetMessageBody(m)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	_, names, err := readHeaders(bufio.NewReader(r))
+	if err != nil || names["Message-Id"] {
+		return ""
+	}
+	if q.config.MessageIDGenerator != nil {
+		return q.config.MessageIDGenerator(m)
+	}
+	domain, err := senderDomain(from)
+	if err != nil {
+		return ""
+	}
+	if domain, err = toASCII(domain); err != nil {
+		q.log.Error(err.Error())
+		return ""
+	}
+	return fmt.Sprintf("<%s@%s>", uuid.New(), domain)
+}
+
+// Add missing headers to the message body as configured. The Message-ID is
+// normally generated when the message is submitted. Otherwise, a generated
+// Message-ID is saved with the message so that it remains the same when
+// delivery is retried. The Date is the time the message was created so that
+// it is the same for every attempt and recipient.
+func (h *Host) completeHeaders(m *Message, r io.ReadCloser) (io.ReadCloser, error) {
+	if !h.config.AddDateHeader && !h.config.AddMessageIDHeader {
+		return r, nil
+	}
+	hostname, err := h.parseHostname(m.From)
+	if err != nil {
+		return nil, err
+	}
+	var messageID func() string
+	if h.config.AddMessageIDHeader {
+		messageID = func() string {
+			if m.MessageID == "" {
+				m.MessageID = h.generateMessageID(m, hostname)
+				if err := h.storage.UpdateMessage(m); err != nil {
+					h.log.Error(err.Error())
+				}
+				h.log.Infof("generated Message-ID %s", m.MessageID)
+			}
+			return m.MessageID
+		}
+	}
+	var date time.Time
+	if h.config.AddDateHeader {
+		if date = m.Created; date.IsZero() {
+			date = time.Now()
+		}
+	}
+	return addMissingHeaders(r, date, messageID)
+}
@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddMissingHeaders(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := []struct {
+		message string
+		added   []string
+	}{
+		{"Date: x\r\nMessage-ID: <y>\r\n\r\nDate: body\r\n", []string{}},
+		{"Subject: x\r\n\r\nbody\r\n", []string{"Date: Thu, 02 Jan 2020 03:04:05 +0000", "Message-ID: <"}},
+		{"Subject: x\r\n date: folded\r\nmessage-id: <y>\r\n\r\n", []string{"Date: "}},
+	}
+	for _, d := range data {
+		r, err := addMissingHeaders(ioutil.NopCloser(strings.NewReader(d.message)), created, func() string {
+			return "<x@example.com>"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			s       = string(b)
+			headers = strings.TrimSuffix(s, d.message)
+		)
+		if !strings.HasSuffix(s, d.message) {
+			t.Fatalf("%q does not end with %q", s, d.message)
+		}
+		if n := strings.Count(headers, "\r\n"); n != len(d.added) {
+			t.Fatalf("%d != %d", n, len(d.added))
+		}
+		for _, a := range d.added {
+			if !strings.Contains(headers, a) {
+				t.Fatalf("%q not found in %q", a, headers)
+			}
+		}
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	q, err := NewQueue(&Config{
+		Directory:          d,
+		AddMessageIDHeader: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	for _, v := range []struct {
+		body    string
+		present bool
+	}{
+		{"Subject: x\r\n\r\nbody\r\n", false},
+		{"Message-ID: <y@example.com>\r\n\r\nbody\r\n", true},
+	} {
+		w, body, err := q.Storage.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(v.body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		id := q.NewMessageID("me@example.com", body)
+		if v.present && id != "" {
+			t.Fatalf("%s generated for body with a Message-ID", id)
+		}
+		if !v.present && !strings.HasSuffix(id, "@example.com>") {
+			t.Fatalf("unexpected Message-ID %s", id)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// Details of the TLS session used to deliver a message. Certificates are
+// validated using PKIX unless verification is disabled.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher-suite"`
+	Verified    bool   `json:"verified"`
+	Validation  string `json:"validation"`
+}
+
+// Describe the TLS session.
+func newTLSInfo(state tls.ConnectionState, verified bool) *TLSInfo {
+	t := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Verified:    verified,
+	}
+	if verified {
+		t.Validation = "pkix"
+	}
+	return t
+}
+
+// Record of a message delivered to a mail server. TLS is nil if the message
+// was delivered without TLS. Forwarded and Unverified list the recipients the
+// server accepted with a 251 or 252 reply. TLSTimedOut indicates that the
+// message was delivered without TLS because the TLS handshake timed out.
+// Submission is nil if the message's provenance was not recorded.
+// Confidential indicates that the recipients and submission were omitted.
+type DeliveryRecord struct {
+	ID           string            `json:"id"`
+	Host         string            `json:"host"`
+	Server       string            `json:"server"`
+	Recipients   []string          `json:"recipients"`
+	Forwarded    []string          `json:"forwarded"`
+	Unverified   []string          `json:"unverified"`
+	Time         time.Time         `json:"time"`
+	TLS          *TLSInfo          `json:"tls"`
+	TLSTimedOut  bool              `json:"tls-timed-out"`
+	Extensions   map[string]string `json:"extensions"`
+	Submission   *Submission       `json:"submission"`
+	Confidential bool              `json:"confidential"`
+}
+
+// Most recent deliveries, limited to the configured number of records. All
+// methods are safe to call from multiple goroutines.
+type deliveryHistory struct {
+	m       sync.Mutex
+	size    int
+	records []*DeliveryRecord
+}
+
+// Create a history using the specified configuration.
+func newDeliveryHistory(c *Config) *deliveryHistory {
+	h := &deliveryHistory{}
+	h.setConfig(c)
+	return h
+}
+
+// Switch to the specified configuration.
+func (d *deliveryHistory) setConfig(c *Config) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.size = c.HistorySize
+	if d.size == 0 {
+		d.size = 100
+	}
+	d.trim()
+}
+
+// Discard the oldest records if there are too many.
+func (d *deliveryHistory) trim() {
+	if n := len(d.records) - d.size; n > 0 {
+		d.records = append([]*DeliveryRecord{}, d.records[n:]...)
+	}
+}
+
+// Add a record to the history.
+func (d *deliveryHistory) add(r *DeliveryRecord) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.records = append(d.records, r)
+	d.trim()
+}
+
+// Provide the records in the history, oldest first.
+func (d *deliveryHistory) all() []*DeliveryRecord {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]*DeliveryRecord{}, d.records...)
+}
@@ -0,0 +1,20 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestDeliveryHistory(t *testing.T) {
+	h := newDeliveryHistory(&Config{HistorySize: 2})
+	for _, id := range []string{"a", "b", "c"} {
+		h.add(&DeliveryRecord{ID: id})
+	}
+	r := h.all()
+	if len(r) != 2 || r[0].ID != "b" || r[1].ID != "c" {
+		t.Fatalf("unexpected records: %v", r)
+	}
+	h.setConfig(&Config{HistorySize: 1})
+	if r := h.all(); len(r) != 1 || r[0].ID != "c" {
+		t.Fatalf("unexpected records: %v", r)
+	}
+}
@@ -2,15 +2,13 @@ package queue
 
 import (
 	"github.com/sirupsen/logrus"
-	"github.com/hectane/go-nonblockingchan"
+	"github.com/hectane/hectane/util"
 
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/mail"
-	"net/smtp"
 	"net/textproto"
 	"strings"
 	"sync"
@@ -20,26 +18,59 @@ import (
 
 // Host status information.
 type HostStatus struct {
-	Active bool `json:"active"`
-	Length int  `json:"length"`
+	Active   bool          `json:"active"`
+	Length   int           `json:"length"`
+	Timeouts *HostTimeouts `json:"timeouts"`
+}
+
+// Timeouts (in seconds) in effect for connections to the host.
+type HostTimeouts struct {
+	Dial     int `json:"dial"`
+	Greeting int `json:"greeting"`
+	Command  int `json:"command"`
+	Data     int `json:"data"`
+}
+
+// Lanes for delivering messages to a host.
+const (
+	laneDefault = ""
+	laneLarge   = "large"
+)
+
+// Determine the name of the queue for the specified host and lane.
+func queueName(host, lane string) string {
+	if lane == laneDefault {
+		return host
+	}
+	return host + "/" + lane
 }
 
 // Persistent connection to an SMTP host.
 type Host struct {
+	*shared
 	m            sync.Mutex
 	config       *Config
+	newConfig    *Config
+	generation   int
 	storage      *Storage
 	log          *logrus.Entry
 	host         string
-	newMessage   *nbc.NonBlockingChan
+	lane         string
+	newMessage   *messageQueue
 	lastActivity time.Time
+	lastConnect  time.Time
+	pending      map[chan *DeliveryResult]bool
+	ramp         rampState
+	retry        chan bool
+	retries      []*retryRequest
+	scheduled    map[*Message]*time.Timer
 	stop         chan bool
 }
 
-// Receive the next message in the queue. The host queue is considered
-// "inactive" while waiting for new messages to arrive. The current time is
-// recorded before entering the select{} block so that the Idle() method can
-// calculate the idle time.
+// Receive the next message in the queue, chosen according to the host's
+// ordering. The host queue is considered "inactive" while waiting for new
+// messages to arrive. The current time is recorded before entering the
+// select{} block so that the Idle() method can calculate the idle time.
 func (h *Host) receiveMessage() *Message {
 	h.m.Lock()
 	h.lastActivity = time.Now()
@@ -50,15 +81,32 @@ func (h *Host) receiveMessage() *Message {
 		h.m.Unlock()
 	}()
 	for {
+		if m := h.newMessage.pop(h.config.hostConfig(h.host).Order); m != nil {
+			return m
+		}
 		select {
-		case i := <-h.newMessage.Recv:
-			return i.(*Message)
+		case <-h.newMessage.ready:
 		case <-h.stop:
 			return nil
 		}
 	}
 }
 
+// Switch to the new configuration if one was provided. The generation is
+// incremented if the change affects connections to the host.
+func (h *Host) applyConfig() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.newConfig == nil {
+		return
+	}
+	if h.config.connectionChanged(h.newConfig, h.host) {
+		h.generation++
+	}
+	h.config = h.newConfig
+	h.newConfig = nil
+}
+
 // Parse an email address and extract the hostname.
 func (h *Host) parseHostname(addr string) (string, error) {
 	a, err := mail.ParseAddress(addr)
@@ -68,101 +116,649 @@ func (h *Host) parseHostname(addr string) (string, error) {
 	return strings.Split(a.Address, "@")[1], nil
 }
 
+// Error indicating that a name has no valid A-label form and therefore cannot
+// be resolved.
+type idnaError struct {
+	name string
+	err  error
+}
+
+func (i *idnaError) Error() string {
+	return fmt.Sprintf("%s cannot be converted to A-labels: %s", i.name, i.err)
+}
+
+// Convert the name to A-labels, returning an idnaError if it is invalid.
+func toASCII(name string) (string, error) {
+	a, err := util.ToASCII(name)
+	if err != nil {
+		return "", &idnaError{name, err}
+	}
+	return a, nil
+}
+
+// Split the server into its name and the address used to connect to it. Port
+// 25 is used unless the server includes a port. Internationalized names are
+// converted to A-labels, which are used for both DNS and TLS.
+func serverAddr(server string) (string, string, error) {
+	port := "25"
+	if h, p, err := net.SplitHostPort(server); err == nil {
+		server, port = h, p
+	}
+	name, err := toASCII(server)
+	if err != nil {
+		return "", "", err
+	}
+	return name, net.JoinHostPort(name, port), nil
+}
+
 // Attempt to connect to the specified server. The connection attempt is
 // performed in a separate goroutine, allowing it to be aborted if the host
-// queue is shut down.
-func (h *Host) tryMailServer(server, hostname string) (*smtp.Client, error) {
+// queue is shut down. The greeting timeout applies while waiting for the
+// server's banner, which some servers deliberately delay. A slot for the
+// source IP is held for as long as the connection is open and the connection
+// rates are applied once it is acquired, immediately before dialing. STARTTLS
+// is not used if cleartext is true.
+func (h *Host) tryMailServer(server, hostname, sourceIP string, cleartext bool) (*connection, error) {
+	name, addr, err := serverAddr(server)
+	if err != nil {
+		return nil, err
+	}
 	var (
-		c    *smtp.Client
-		err  error
-		done = make(chan bool)
+		hostConfig = h.config.hostConfig(h.host)
+		c          *connection
+		done       = make(chan bool)
+		release    = h.acquireIPSlot(sourceIP)
 	)
+	if release == nil {
+		return nil, nil
+	}
+	if !h.waitForConnRate(sourceIP) {
+		release()
+		return nil, nil
+	}
 	go func() {
-		c, err = smtp.Dial(fmt.Sprintf("%s:25", server))
+		var (
+			d = &net.Dialer{
+				Timeout: h.config.dialTimeout(h.host),
+				Control: h.privateControl(name),
+			}
+			conn net.Conn
+		)
+		if sourceIP != "" {
+			d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+		}
+		conn, err = dialFromPorts(d, addr, hostConfig.SourcePortFirst, hostConfig.SourcePortLast)
+		if err == nil {
+			c, err = newConnection(conn, name, h.config.greetingTimeout(), h.config.maxReplySize())
+		}
 		close(done)
 	}()
 	select {
 	case <-done:
 	case <-h.stop:
+		release()
 		return nil, nil
 	}
 	if err != nil {
+		release()
 		return nil, err
 	}
-	if err := c.Hello(hostname); err != nil {
+	c.release = release
+	c.sourceIP = sourceIP
+	c.generation = h.generation
+	c.register(h.connections, h.host, name)
+	c.update(func(info *ConnInfo) {
+		info.MaxMessages = hostConfig.MaxMessagesPerConnection
+	})
+	c.conn.timeout = h.config.commandTimeout(h.host)
+	helloName, err := toASCII(hostname)
+	if err != nil {
+		c.Close()
 		return nil, err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: server}
-		if h.config.DisableSSLVerification {
-			config.InsecureSkipVerify = true
-		}
-		if err := c.StartTLS(config); err != nil {
-			return nil, err
+	if err := c.hello(helloName, hostConfig.GreetingMode); err != nil {
+		c.Close()
+		return nil, err
+	}
+	h.recordExtensions(c)
+	if hostConfig.TLSPolicy != TLSDisabled && !cleartext {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(h.config.tlsConfig(name)); err != nil {
+				h.tlsFailure(name, tlsResultType(err))
+				c.Close()
+				if isTimeout(err) {
+					return h.tlsTimeout(server, hostname, sourceIP, err)
+				}
+				return nil, err
+			}
+			state, _ := c.TLSConnectionState()
+			if err := h.config.verifyCertificate(name, state); err != nil {
+				h.tlsFailure(name, tlsResultType(err))
+				if hostConfig.TLSPolicy == TLSRequired {
+					c.Close()
+					return nil, err
+				}
+				switch hostConfig.InvalidCertPolicy {
+				case InvalidCertCleartext:
+					h.log.Warnf("%s: %s, reconnecting without TLS", name, err)
+					h.recordDowngrade(name, DowngradePolicyFallback)
+					c.Close()
+					return h.tryMailServer(server, hostname, sourceIP, true)
+				case InvalidCertDefer:
+					c.Close()
+					return nil, &invalidCertError{err}
+				}
+				h.log.Warnf("%s: %s, continuing without authentication", name, err)
+				h.recordDowngrade(name, DowngradeCertInvalid)
+				c.tls = newTLSInfo(state, false)
+			} else {
+				h.tlsSuccess()
+				c.tls = newTLSInfo(state, !h.config.DisableSSLVerification)
+			}
+			c.update(func(info *ConnInfo) {
+				info.TLS = c.tls
+			})
+		} else {
+			h.tlsFailure(name, tlsStartTLSNotSupported)
+			if hostConfig.TLSPolicy == TLSRequired {
+				c.Close()
+				return nil, errors.New("STARTTLS is required but not supported")
+			}
+			h.recordDowngrade(name, DowngradeNotAdvertised)
 		}
 	}
 	return c, nil
 }
 
-// Attempt to find the mail servers for the specified host. MX records are
-// checked first. If one or more were found, the records are converted into an
-// array of strings (sorted by priority). If none were found, the original host
-// is returned.
-func (h *Host) findMailServers(host string) []string {
-	r, err := net.LookupMX(host)
+// Wait for the specified duration. False is returned if the host queue was
+// shut down while waiting.
+func (h *Host) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-h.stop:
+		return false
+	}
+}
+
+// Wait until the minimum interval between connections has elapsed. False is
+// returned if the host queue was shut down while waiting.
+func (h *Host) waitToConnect() bool {
+	interval := time.Duration(h.config.ConnectionInterval) * time.Second
+	if d := interval - time.Since(h.lastConnect); d > 0 {
+		h.log.Debugf("waiting %s before connecting", d)
+		if !h.sleep(d) {
+			return false
+		}
+	}
+	h.lastConnect = time.Now()
+	return true
+}
+
+// Log the form used to look up an internationalized host, since a mismatch
+// between the submitted and resolvable forms may explain a failure.
+func (h *Host) logIDN() {
+	if a, err := util.ToASCII(h.host); err == nil && a != h.host {
+		h.log.Warnf("%s was looked up as %s", h.host, a)
+	}
+}
+
+// Errors indicating that delivery to the host is impossible.
+var (
+	errNoMailServers = errors.New("domain does not accept mail")
+	errSelfDelivery  = errors.New("all mail servers refer to this server")
+)
+
+// Function used to find the mail servers for a host, replaced during tests.
+var findMailServers = util.FindWeightedMailServers
+
+// Determine the mail servers for the host. Servers in the host's config take
+// precedence over those found in DNS, which is queried using the A-label form
+// of the host. If DNS definitively finds none, the default route applies.
+func (h *Host) mailServers() ([]string, error) {
+	hostConfig := h.config.hostConfig(h.host)
+	if len(hostConfig.Servers) > 0 {
+		return hostConfig.Servers, nil
+	}
+	host, err := toASCII(h.host)
 	if err != nil {
-		return []string{host}
+		return nil, err
 	}
-	servers := make([]string, len(r))
-	for i, r := range r {
-		servers[i] = strings.TrimSuffix(r.Host, ".")
+	servers, err := findMailServers(host, hostConfig.MXWeights, hostConfig.CNAMEPolicy)
+	if err == nil && len(servers) == 0 {
+		return h.defaultRouteServers()
 	}
-	return servers
+	if err != nil || len(hostConfig.MXPriorities) == 0 {
+		return servers, err
+	}
+	return util.PrioritizeMailServers(servers, hostConfig.MXPriorities), nil
 }
 
-// Attempt to connect to one of the mail servers.
-func (h *Host) connectToMailServer(hostname string) (*smtp.Client, error) {
-	for _, s := range h.findMailServers(h.host) {
-		c, err := h.tryMailServer(s, hostname)
+// Attempt to connect to one of the mail servers using a source IP suitable
+// for the tier, unless the message is pinned to an identity, in which case
+// its source IP and hostname are used (and a cooldownError is returned if
+// the source IP is cooling down). If the host has no mail servers (and the
+// default route does not relay), errNoMailServers is returned, or
+// errDiscardedRoute if the default route discards messages. Mail servers
+// that refer to this server are skipped and errSelfDelivery is returned if
+// no others exist. Likewise, mail servers that resolve to private addresses
+// are skipped and errPrivateDelivery is returned if no others exist. If a
+// server rejects EHLO when the host requires it, the remaining servers are
+// tried and errEHLORequired is returned if every other server was skipped or
+// also rejected it. If TLS handshakes timed out, the last such failure is
+// returned once the remaining servers have been tried. If connections were
+// refused or timed out, the last such failure is returned.
+func (h *Host) connectToMailServer(hostname, tier, identity string) (*connection, error) {
+	servers, err := h.mailServers()
+	if err == errDiscardedRoute {
+		return nil, err
+	}
+	if _, ok := err.(*idnaError); ok {
+		return nil, err
+	}
+	if err != nil {
+		h.logIDN()
+		return nil, &dnsError{err}
+	}
+	if len(servers) == 0 {
+		h.logIDN()
+		return nil, errNoMailServers
+	}
+	if n := h.config.hostConfig(h.host).Hostname; n != "" {
+		hostname = n
+	}
+	var sourceIP, identityHostname string
+	if identity != "" {
+		i, ok := h.config.SendingIdentities[identity]
+		if !ok {
+			return nil, &unknownIdentityError{identity}
+		}
+		if i.Hostname != "" {
+			hostname = i.Hostname
+			identityHostname = i.Hostname
+		}
+		sourceIP = i.SourceIP
+		if v := h.sourceIPCooldown(sourceIP); v != nil {
+			return nil, &cooldownError{v}
+		}
+	} else if sourceIP, err = h.selectSourceIP(tier); err != nil {
+		return nil, err
+	}
+	var (
+		self, private, helo = 0, 0, 0
+		failure             *connectError
+		timeout             *tlsTimeoutError
+	)
+	for _, s := range servers {
+		name, _, err := serverAddr(s)
+		if err != nil {
+			h.log.Error(err.Error())
+			continue
+		}
+		loop, ok := h.isSelf(name, identityHostname, sourceIP)
+		if !ok {
+			return nil, nil
+		}
+		if loop {
+			h.log.Errorf("%s refers to this server", s)
+			self++
+			continue
+		}
+		if !h.waitToConnect() {
+			return nil, nil
+		}
+		c, err := h.tryMailServer(s, hostname, sourceIP, false)
+		if errors.Is(err, errPrivateAddress) {
+			h.log.Errorf("%s resolves to a private address", s)
+			private++
+			continue
+		}
+		switch e := err.(type) {
+		case *invalidCertError, *idnaError:
+			return nil, err
+		case *tlsTimeoutError:
+			h.log.Debugf("unable to connect to %s: %s", s, err)
+			timeout = e
+			continue
+		}
+		if err == errEHLORequired {
+			h.log.Debugf("%s: %s", s, err)
+			helo++
+			continue
+		}
 		if err != nil {
-			h.log.Debugf("unable to connect to %s", s)
+			h.log.Debugf("unable to connect to %s: %s", s, err)
+			h.checkRateLimit(err, sourceIP)
+			if e := h.connectFailure(err); e != nil {
+				failure = e
+			}
 			continue
 		}
+		if c != nil {
+			c.tier = tier
+			c.identity = identity
+			c.update(func(info *ConnInfo) {
+				info.Tier = tier
+			})
+		}
 		return c, nil
 	}
+	if self == len(servers) {
+		return nil, errSelfDelivery
+	}
+	if self+private == len(servers) && private > 0 {
+		return nil, errPrivateDelivery
+	}
+	if self+private+helo == len(servers) && helo > 0 {
+		return nil, errEHLORequired
+	}
+	if timeout != nil {
+		return nil, timeout
+	}
+	if failure != nil {
+		return nil, failure
+	}
 	return nil, errors.New("unable to connect to a mail server")
 }
 
-// Attempt to send the specified message to the specified client.
-func (h *Host) deliverToMailServer(c *smtp.Client, m *Message) error {
+// Error indicating that the server's certificate failed validation and that
+// delivery should be deferred.
+type invalidCertError struct {
+	error
+}
+
+// Error that occurred after the message body was sent but before the server
+// confirmed receipt of the message.
+type dataError struct {
+	error
+}
+
+// Determine the policy for errors after the message body was sent.
+func (h *Host) dataErrorPolicy(m *Message) string {
+	switch {
+	case m.DataErrorPolicy != "":
+		return m.DataErrorPolicy
+	case h.config.DataErrorPolicy != "":
+		return h.config.DataErrorPolicy
+	default:
+		return DataAssumeFailed
+	}
+}
+
+// Determine which recipients to deliver to in the current session. If the
+// host limits the number of recipients per session, only the first chunk of
+// the remaining recipients is returned.
+func (h *Host) recipients(m *Message) []string {
+	n := h.config.hostConfig(h.host).ChunkSize
+	if n > 0 && len(m.To) > n {
+		return m.To[:n]
+	}
+	return m.To
+}
+
+// Open the body of the message as it will be delivered, with line endings
+// normalized, long lines wrapped, missing headers added and a DKIM signature
+// added if configured. Headers are added before signing so that they are
+// included in the signature.
+func (h *Host) openBody(m *Message) (io.ReadCloser, error) {
 	r, err := h.storage.GetMessageBody(m)
+	if err != nil {
+		return nil, err
+	}
+	if h.config.NormalizeLineEndings {
+		r = newCRLFReader(r)
+	}
+	if h.config.LongLines == LongLinesWrap {
+		r = newWrapReader(r)
+	}
+	c, err := h.completeHeaders(m, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r = c
+	var s io.ReadCloser
+	if i := h.config.sendingIdentity(m); i != nil && i.DKIM != "" {
+		s, err = dkimSignedBy(i.DKIM, r, h.config)
+	} else {
+		s, err = dkimSigned(m.From, r, h.config)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Attempt to send the specified message to the specified client.
+func (h *Host) deliverToMailServer(c *connection, m *Message) error {
+	r, err := h.openBody(m)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	r, err = dkimSigned(m.From, r, h.config)
+	return h.sendMessage(c, m, r)
+}
+
+// Send the message with the specified body to the client. Errors that leave
+// the delivery status of the message unknown are wrapped in dataError.
+// Recipients that permanently reject the message are bounced and those that
+// temporarily reject it are kept for a later attempt. If the message is sent
+// to the remaining recipients, partialError is returned if any were deferred.
+func (h *Host) sendMessage(c *connection, m *Message, r io.Reader) error {
+	start := time.Now()
+	recipients := h.recipients(m)
+	rcpt, err := h.beginTransaction(c, h.envelopeSender(m), recipients)
 	if err != nil {
 		return err
 	}
-	if err := c.Mail(m.From); err != nil {
-		return err
+	var (
+		accepted, bounced     []string
+		forwarded, unverified []string
+		deferred              int
+		deferErr, bounceErr   error
+		restart               bool
+	)
+	for _, t := range recipients {
+		code, err := rcpt(t)
+		if err == nil {
+			switch h.recipientPolicy(code) {
+			case RecipientAccept:
+				accepted = append(accepted, t)
+				switch code {
+				case 251:
+					forwarded = append(forwarded, t)
+				case 252:
+					unverified = append(unverified, t)
+				}
+			case RecipientBounce:
+				h.logError(m, LogPermanent, fmt.Errorf("%s bounced: server replied %d", t, code))
+				bounced = append(bounced, t)
+				bounceErr = &recipientError{t, code}
+				h.recordBounce(m, []string{t}, bounceErr)
+				restart = true
+			default:
+				deferred++
+				deferErr = &recipientError{t, code}
+				restart = true
+			}
+			continue
+		}
+		e, ok := err.(*textproto.Error)
+		if !ok {
+			return err
+		}
+		if e.Code >= 500 {
+			h.logError(m, LogPermanent, fmt.Errorf("%s bounced: %s", t, err))
+			bounced = append(bounced, t)
+			bounceErr = err
+			h.recordBounce(m, []string{t}, err)
+		} else {
+			deferred++
+			deferErr = err
+		}
 	}
-	for _, t := range m.To {
-		if err := c.Rcpt(t); err != nil {
+	h.settleRecipients(m, nil, bounced)
+	if len(accepted) == 0 {
+		c.Reset()
+		switch {
+		case deferErr != nil:
+			if _, ok := deferErr.(*recipientError); ok {
+				return &partialError{deferred, deferErr}
+			}
+			return deferErr
+		case len(m.To) > 0 || len(m.Delivered) > 0:
+			return nil
+		default:
+			return bounceErr
+		}
+	}
+	if restart {
+		if err := h.restartTransaction(c, m, accepted); err != nil {
+			switch err.(type) {
+			case *textproto.Error, *recipientError:
+				return &partialError{deferred + len(accepted), err}
+			}
 			return err
 		}
 	}
+	c.conn.timeout = h.config.dataTimeout(h.host)
+	defer func() {
+		c.conn.timeout = h.config.commandTimeout(h.host)
+	}()
 	w, err := c.Data()
 	if err != nil {
 		return err
 	}
-	defer w.Close()
-	if _, err := io.Copy(w, r); err != nil {
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
 		return err
 	}
+	if err := w.Close(); err != nil {
+		if _, ok := err.(*textproto.Error); ok {
+			return err
+		}
+		return &dataError{err}
+	}
+	c.delivered++
+	c.update(func(info *ConnInfo) {
+		info.Delivered++
+	})
+	h.recordDelivery(start, n)
+	h.history.add(redactRecord(m, &DeliveryRecord{
+		ID:          m.id,
+		Host:        h.host,
+		Server:      c.server,
+		Recipients:  accepted,
+		Forwarded:   forwarded,
+		Unverified:  unverified,
+		Time:        time.Now(),
+		TLS:         c.tls,
+		TLSTimedOut: c.tlsTimedOut,
+		Extensions:  c.extensions,
+		Submission:  m.Submission,
+	}))
+	h.settleRecipients(m, accepted, nil)
+	h.confirmDelivery(c, m, accepted)
+	if deferErr != nil {
+		return &partialError{deferred, deferErr}
+	}
 	return nil
 }
 
+// Error indicating that a panic occurred during delivery.
+type panicError struct {
+	value interface{}
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("panic during delivery: %v", p.value)
+}
+
+// Determine if the message has too many incomplete delivery attempts.
+func (h *Host) isPoison(m *Message) bool {
+	max := h.config.MaxIncompleteAttempts
+	return max > 0 && m.Incomplete >= max
+}
+
+// Determine if the message has exhausted its delivery attempts or lifetime.
+// Limits set on the message take precedence over those for the host, which in
+// turn take precedence over the global ones.
+func (h *Host) isExpired(m *Message) bool {
+	var (
+		hc          = h.config.hostConfig(h.host)
+		maxAttempts = h.config.MaxAttempts
+		maxLifetime = h.config.MaxLifetime
+	)
+	if hc.MaxAttempts > 0 {
+		maxAttempts = hc.MaxAttempts
+	}
+	if hc.MaxLifetime > 0 {
+		maxLifetime = hc.MaxLifetime
+	}
+	if m.MaxAttempts > 0 {
+		maxAttempts = m.MaxAttempts
+	}
+	if m.MaxLifetime > 0 {
+		maxLifetime = m.MaxLifetime
+	}
+	if maxAttempts == 0 {
+		maxAttempts = 18
+	}
+	if m.Attempts >= maxAttempts {
+		return true
+	}
+	// Messages queued before their creation time was recorded have no known
+	// age, so only the number of attempts applies to them
+	if maxLifetime == 0 || m.Created.IsZero() {
+		return false
+	}
+	return time.Since(m.Created) >= time.Duration(maxLifetime)*time.Second
+}
+
+// Determine how long to wait before the next delivery attempt. We differ a
+// tiny bit from the RFC spec here but this should work well enough - the goal
+// is to retry lots of times early on and space out the remaining attempts as
+// time goes on. (Roughly 48 hours total.)
+var retryDelay = func(attempts int) time.Duration {
+	if attempts > 8 {
+		attempts = 8
+	}
+	return time.Minute << uint(attempts)
+}
+
+// Attempt delivery of the message, recovering from any panic that occurs. The
+// attempt is recorded on disk before it begins and removed once it completes
+// so that attempts interrupted by a crash can be detected after a restart.
+func (h *Host) tryDelivery(c *connection, m *Message) (err error) {
+	c.update(func(info *ConnInfo) {
+		info.Active = true
+	})
+	defer c.update(func(info *ConnInfo) {
+		info.Active = false
+	})
+	if h.config.MaxIncompleteAttempts > 0 {
+		m.Incomplete++
+		if err := h.storage.UpdateMessage(m); err != nil {
+			h.log.Error(err.Error())
+		}
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = &panicError{v}
+			return
+		}
+		if h.config.MaxIncompleteAttempts > 0 {
+			m.Incomplete--
+			if err := h.storage.UpdateMessage(m); err != nil {
+				h.log.Error(err.Error())
+			}
+		}
+	}()
+	return h.deliverToMailServer(c, m)
+}
+
 // Receive message and deliver them to their recipients. Due to the complicated
 // algorithm for message delivery, the body of the method is broken up into a
 // sequence of labeled sections.
@@ -171,10 +767,13 @@ func (h *Host) run() {
 	var (
 		m        *Message
 		hostname string
-		c        *smtp.Client
+		c        *connection
 		err      error
-		tries    int
-		duration = time.Minute
+		duration time.Duration
+		t        Transport
+		result   Result
+		dnsRetry bool
+		local    bool
 	)
 receive:
 	if m == nil {
@@ -182,114 +781,404 @@ receive:
 		if m == nil {
 			goto shutdown
 		}
-		h.log.Info("message received in queue")
+		if m.Monitor {
+			h.log.Info("test message received in queue")
+		} else {
+			h.log.Info("message received in queue")
+		}
+		h.emit(m, stateReceived)
+	}
+	h.applyConfig()
+	h.updateLogger()
+	if c != nil && c.generation != h.generation {
+		h.log.Debug("closing connection established with old configuration")
+		c.Quit()
+		c = nil
+	}
+	if c != nil && c.tier != h.tier(m) {
+		h.log.Debug("closing connection established for a different tier")
+		c.Quit()
+		c = nil
+	}
+	if c != nil && c.identity != m.SendingIdentity {
+		h.log.Debug("closing connection established for a different identity")
+		c.Quit()
+		c = nil
 	}
 	hostname, err = h.parseHostname(m.From)
 	if err != nil {
-		h.log.Error(err.Error())
+		h.logError(m, LogPermanent, err)
+		h.record(m, resultFailed)
 		goto cleanup
 	}
+	if h.isPoison(m) {
+		h.log.Errorf("message failed to complete delivery %d time(s)", m.Incomplete)
+		goto quarantine
+	}
+	if h.storage.bodyMissing(m) {
+		h.log.Error("message body is missing, removing message")
+		h.metrics.IncCounter(metricOrphaned, map[string]string{
+			labelHost: h.hostLabel(),
+		})
+		h.record(m, resultFailed)
+		goto cleanup
+	}
+	if h.config.hostConfig(h.host).Blackhole {
+		h.log.Info("discarding message for blackhole host")
+		h.record(m, resultDelivered)
+		goto cleanup
+	}
+	t = h.transport()
+	if h.isOversize(m) {
+		if t = h.oversizeTransport(); t == nil {
+			err = errMessageTooLarge
+			h.logError(m, LogPermanent, err)
+			h.record(m, resultFailed)
+			goto cleanup
+		}
+	}
+	if _, ok := t.(smtpTransport); !ok {
+		if !h.waitWhilePaused() || !h.waitToSend() {
+			goto shutdown
+		}
+		h.emit(m, stateAttempting)
+		result, err = h.deliverWithTransport(t, m)
+		if err == errStopped {
+			goto shutdown
+		}
+		switch result {
+		case Delivered:
+			h.logOutcome(LogSuccess, "message delivered successfully")
+			h.record(m, resultDelivered)
+			goto cleanup
+		case Deferred:
+			h.logError(m, LogTransient, err)
+			goto wait
+		default:
+			h.logError(m, LogPermanent, err)
+			h.recordBounce(m, m.To, err)
+			h.record(m, resultFailed)
+			goto cleanup
+		}
+	}
 deliver:
+	dnsRetry = false
+	if !h.waitWhilePaused() {
+		goto shutdown
+	}
+	if err = h.hostCooldown(); err != nil {
+		h.log.Log(h.config.logLevel(LogTransient), err)
+		if c != nil {
+			c.Quit()
+			c = nil
+		}
+		goto wait
+	}
 	if c == nil {
 		h.log.Debug("connecting to mail server")
-		c, err = h.connectToMailServer(hostname)
+		c, err = h.connectToMailServer(hostname, h.tier(m), m.SendingIdentity)
 		if c == nil {
+			if err == errDiscardedRoute {
+				h.log.Info(err)
+				h.record(m, resultDelivered)
+				goto cleanup
+			}
+			if err == errNoMailServers || err == errSelfDelivery ||
+				err == errPrivateDelivery || err == errEHLORequired {
+				h.log.Log(h.config.logLevel(LogPermanent), err)
+				h.record(m, resultFailed)
+				goto cleanup
+			}
+			switch err.(type) {
+			case *unknownIdentityError, *idnaError:
+				h.log.Log(h.config.logLevel(LogPermanent), err)
+				h.record(m, resultFailed)
+				goto cleanup
+			}
 			if err != nil {
-				h.log.Error(err)
+				h.log.Log(h.config.logLevel(LogTransient), err)
+				if _, ok := err.(*dnsError); ok {
+					dnsRetry = true
+					h.metrics.IncCounter(metricDNSFailures, map[string]string{
+						labelHost: h.hostLabel(),
+					})
+				}
 				goto wait
 			} else {
 				goto shutdown
 			}
 		}
 		h.log.Debug("connection established")
+		if h.shouldProbe(m) {
+			if err = h.probe(c, m); err != nil {
+				h.log.Log(h.config.logLevel(LogTransient), err)
+				c.Close()
+				c = nil
+				goto wait
+			}
+		}
+	} else if err = h.checkReuse(c); err != nil {
+		h.log.Warnf("discarding connection: %s", err)
+		c.Close()
+		c = nil
+		goto deliver
+	}
+	if !h.waitToSend() {
+		goto shutdown
 	}
-	err = h.deliverToMailServer(c, m)
+	h.emit(m, stateAttempting)
+	err = h.tryDelivery(c, m)
 	if err != nil {
-		h.log.Error(err)
+		h.checkRateLimit(err, c.sourceIP)
+		if _, ok := err.(*panicError); ok {
+			h.logError(m, LogTransient, err)
+			c.Close()
+			c = nil
+			goto wait
+		}
+		if _, ok := err.(*replyLimitError); ok {
+			h.logError(m, LogTransient, err)
+			c.Close()
+			c = nil
+			goto wait
+		}
+		if _, ok := err.(*partialError); ok {
+			h.logError(m, LogTransient, err)
+			c.Quit()
+			c = nil
+			goto wait
+		}
+		if e, ok := err.(*dkimRequiredError); ok && e.policy == DKIMRequireDefer {
+			h.logError(m, LogTransient, err)
+			goto wait
+		}
+		if _, ok := err.(*dataError); ok {
+			h.logError(m, LogTransient, err)
+			c.Close()
+			c = nil
+			switch h.dataErrorPolicy(m) {
+			case DataAssumeDelivered:
+				h.log.Warn("assuming message was delivered")
+				h.record(m, resultDelivered)
+				goto cleanup
+			case DataQuarantine:
+				goto quarantine
+			default:
+				goto wait
+			}
+		}
 		if _, ok := err.(syscall.Errno); ok {
+			h.logError(m, LogTransient, err)
+			c.Close()
 			c = nil
 			goto deliver
 		}
 		if e, ok := err.(*textproto.Error); ok {
 			if e.Code >= 400 && e.Code <= 499 {
+				h.logError(m, LogTransient, err)
 				c.Close()
 				c = nil
 				goto wait
 			}
 			c.Reset()
 		}
-		h.log.Error(err.Error())
+		h.logError(m, LogPermanent, err)
+		h.recordBounce(m, m.To, err)
+		h.record(m, resultFailed)
 		goto cleanup
 	}
-	h.log.Info("message delivered successfully")
+	if len(m.To) > 0 {
+		h.logOutcome(LogSuccess, "delivered to %d recipient(s), %d remaining", len(m.Delivered), len(m.To))
+		// The server has already accepted the chunk, so an error ending the
+		// session must not cause it to be delivered again
+		c.Quit()
+		c = nil
+		if !h.sleep(time.Duration(h.config.hostConfig(h.host).ChunkDelay) * time.Second) {
+			goto shutdown
+		}
+		goto deliver
+	}
+	h.logOutcome(LogSuccess, "message delivered successfully")
+	h.record(m, resultDelivered)
+	if h.connectionExhausted(c) {
+		h.log.Debugf("closing connection after %d message(s)", c.delivered)
+		c.Quit()
+		c = nil
+	}
 cleanup:
+	h.notify(m, cleanupOutcomes[m.outcome], err)
+	h.ages.remove(m)
 	h.log.Debug("deleting message from disk")
 	err = h.storage.DeleteMessage(m)
+	if err != nil {
+		h.log.Error(err.Error())
+		err = h.storage.TombstoneMessage(m)
+		if err != nil {
+			h.log.Errorf("unable to mark message as a tombstone: %s", err)
+		}
+	}
+	m = nil
+	goto receive
+quarantine:
+	h.log.Warn("quarantining message")
+	h.record(m, resultQuarantined)
+	h.notify(m, OutcomeQuarantined, err)
+	h.ages.remove(m)
+	err = h.storage.QuarantineMessage(m)
 	if err != nil {
 		h.log.Error(err.Error())
 	}
 	m = nil
-	tries = 0
 	goto receive
 wait:
-	// We differ a tiny bit from the RFC spec here but this should work well
-	// enough - the goal is to retry lots of times early on and space out the
-	// remaining attempts as time goes on. (Roughly 48 hours total.)
-	switch {
-	case tries < 8:
-		duration *= 2
-	case tries < 18:
-	default:
-		h.log.Error("maximum retry count exceeded")
+	if h.isExpired(m) {
+		h.log.Error("maximum retry count or lifetime exceeded")
+		h.record(m, resultFailed)
+		h.notify(m, OutcomeExpired, err)
 		goto cleanup
 	}
-	select {
-	case <-h.stop:
-	case <-time.After(duration):
-		goto receive
+	local = isLocalDeferral(err)
+	if !local {
+		m.Attempts++
+	}
+	m.deferred = time.Now()
+	duration = retryDelay(m.Attempts)
+	if e, ok := err.(*connectError); ok {
+		if d := h.config.connectRetryDelay(e.reason); d > 0 {
+			duration = d
+		}
+	}
+	if e, ok := err.(*cooldownError); ok {
+		duration = time.Until(e.cooldown.Until)
+	}
+	if dnsRetry {
+		duration += h.dnsRetries.randomJitter()
+	}
+	m.NextAttempt = h.nextAttempt(duration)
+	duration = m.NextAttempt.Sub(time.Now())
+	err = h.storage.UpdateMessage(m)
+	if err != nil {
+		h.log.Error(err.Error())
+	}
+	if !local {
+		h.record(m, resultDeferred)
+	}
+	if h.shouldSpill(m, duration) {
+		h.log.Debugf("moving message to cold storage for %s", duration)
+		err = h.storage.SpillMessage(m)
+		if err != nil {
+			h.log.Error(err.Error())
+		} else {
+			m = nil
+			goto receive
+		}
+	}
+	if !h.sleepUntilRetry(m, duration) {
+		goto shutdown
+	}
+	if dnsRetry {
+		if d := h.dnsRetries.reserve(); d > 0 {
+			h.log.Debugf("waiting %s to limit DNS retries", d)
+			if !h.sleep(d) {
+				goto shutdown
+			}
+		}
 	}
-	tries++
+	goto receive
 shutdown:
 	h.log.Debug("shutting down")
 	if c != nil {
 		c.Close()
 	}
+	h.cancelScheduled()
+	h.closePending()
 }
 
 // Create a new host connection.
 func NewHost(host string, s *Storage, c *Config) *Host {
+	return newHost(host, laneDefault, s, c, newShared(c))
+}
+
+// Create a new host connection for the specified lane that uses the shared
+// state.
+func newHost(host, lane string, s *Storage, c *Config, sh *shared) *Host {
 	h := &Host{
+		shared:     sh,
 		config:     c,
 		storage:    s,
-		log:        logrus.WithField("context", host),
+		log:        logrus.WithField("context", queueName(host, lane)),
 		host:       host,
-		newMessage: nbc.New(),
+		lane:       lane,
+		newMessage: newMessageQueue(),
+		scheduled:  make(map[*Message]*time.Timer),
+		retry:      make(chan bool, 1),
 		stop:       make(chan bool),
 	}
 	go h.run()
 	return h
 }
 
-// Attempt to deliver a message to the host.
+// Provide a new configuration for the host. It takes effect before the next
+// message is delivered and any connection established with settings that have
+// since changed is closed once the current message is delivered.
+func (h *Host) Reload(c *Config) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.newConfig = c
+}
+
+// Attempt to deliver a message to the host. A message whose next attempt is
+// in the future is held until then.
 func (h *Host) Deliver(m *Message) {
-	h.newMessage.Send <- m
+	h.addPending(m)
+	if d := time.Until(m.NextAttempt); d > 0 {
+		h.schedule(m, d)
+		return
+	}
+	h.newMessage.push(m)
+}
+
+// Attempt to deliver a message to the host and provide its result once it
+// reaches a terminal state. The channel receives a single value and is then
+// closed; it is closed without a value if the host is stopped first.
+func (h *Host) DeliverWithResult(m *Message) <-chan *DeliveryResult {
+	c := make(chan *DeliveryResult, 1)
+	m.result = c
+	h.Deliver(m)
+	return c
 }
 
-// Retrieve the connection idle time.
+// Retrieve the connection idle time. The host is never idle while messages are
+// scheduled.
 func (h *Host) Idle() time.Duration {
 	h.m.Lock()
 	defer h.m.Unlock()
-	if h.lastActivity.IsZero() {
+	if h.lastActivity.IsZero() || len(h.scheduled) > 0 {
 		return 0
 	}
 	return time.Since(h.lastActivity)
 }
 
+// Retrieve the capabilities most recently advertised by the host's mail
+// server or nil if no connection has been established.
+func (h *Host) Capabilities() *Capabilities {
+	return h.capabilities.get(h.host)
+}
+
 // Return the status of the host connection.
 func (h *Host) Status() *HostStatus {
+	h.m.Lock()
+	c := h.config
+	h.m.Unlock()
 	return &HostStatus{
 		Active: h.Idle() == 0,
-		Length: h.newMessage.Len(),
+		Length: h.newMessage.len() + h.scheduledLen(),
+		Timeouts: &HostTimeouts{
+			Dial:     int(c.dialTimeout(h.host).Seconds()),
+			Greeting: int(c.greetingTimeout().Seconds()),
+			Command:  int(c.commandTimeout(h.host).Seconds()),
+			Data:     int(c.dataTimeout(h.host).Seconds()),
+		},
 	}
 }
 
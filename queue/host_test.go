@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsExpired(t *testing.T) {
+	h := &Host{config: &Config{MaxLifetime: 3600}}
+	for _, v := range []struct {
+		m       *Message
+		expired bool
+	}{
+		{&Message{Created: time.Now()}, false},
+		{&Message{Created: time.Now().Add(-2 * time.Hour)}, true},
+		{&Message{}, false},
+		{&Message{Attempts: 18}, true},
+	} {
+		if e := h.isExpired(v.m); e != v.expired {
+			t.Fatalf("%t != %t", e, v.expired)
+		}
+	}
+}
+
+func TestMailServersIDNA(t *testing.T) {
+	defer func(f func(string, map[string]int, string) ([]string, error)) {
+		findMailServers = f
+	}(findMailServers)
+	var looked string
+	findMailServers = func(host string, _ map[string]int, _ string) ([]string, error) {
+		looked = host
+		return []string{"mx." + host}, nil
+	}
+	c := &Config{}
+	h := &Host{config: c, host: "Bücher.example"}
+	if _, err := h.mailServers(); err != nil {
+		t.Fatal(err)
+	}
+	if looked != "xn--bcher-kva.example" {
+		t.Fatalf("%s != xn--bcher-kva.example", looked)
+	}
+	h.host = "exa mple.com"
+	if _, err := h.mailServers(); err == nil {
+		t.Fatal("error expected")
+	} else if _, ok := err.(*idnaError); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
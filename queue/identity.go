@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Sending identity that a message can be pinned to, overriding the source IP
+// and EHLO hostname that would otherwise be selected for the host and the
+// domain whose DKIM key signs the message. NotifySuccess requests delivery
+// confirmations for every message pinned to the identity.
+type SendingIdentity struct {
+	SourceIP      string `json:"source-ip"`
+	Hostname      string `json:"hostname"`
+	DKIM          string `json:"dkim"`
+	NotifySuccess bool   `json:"notify-success"`
+}
+
+// Error indicating that a message refers to an identity that does not exist.
+type unknownIdentityError struct {
+	name string
+}
+
+func (u *unknownIdentityError) Error() string {
+	return fmt.Sprintf("sending identity %q does not exist", u.name)
+}
+
+// Determine the identity the message is pinned to or nil if it is not pinned
+// to one.
+func (c *Config) sendingIdentity(m *Message) *SendingIdentity {
+	if m.SendingIdentity == "" {
+		return nil
+	}
+	return c.SendingIdentities[m.SendingIdentity]
+}
+
+// Names of the configured sending identities, used to validate messages as
+// they are submitted. All methods are safe to call from multiple goroutines.
+type identitySet struct {
+	m     sync.Mutex
+	names map[string]bool
+}
+
+// Create a set using the specified configuration.
+func newIdentitySet(c *Config) *identitySet {
+	i := &identitySet{}
+	i.setConfig(c)
+	return i
+}
+
+// Switch to the specified configuration.
+func (i *identitySet) setConfig(c *Config) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.names = make(map[string]bool)
+	for n := range c.SendingIdentities {
+		i.names[n] = true
+	}
+}
+
+// Ensure that the identity exists. An empty name is always valid.
+func (i *identitySet) check(name string) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if name != "" && !i.names[name] {
+		return &unknownIdentityError{name}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestIdentitySet(t *testing.T) {
+	i := newIdentitySet(&Config{
+		SendingIdentities: map[string]*SendingIdentity{
+			"compliance": {SourceIP: "192.0.2.1"},
+		},
+	})
+	for _, v := range []struct {
+		name  string
+		valid bool
+	}{
+		{"", true},
+		{"compliance", true},
+		{"missing", false},
+	} {
+		if err := i.check(v.name); (err == nil) != v.valid {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+	}
+	i.setConfig(&Config{})
+	if err := i.check("compliance"); err == nil {
+		t.Fatal("error expected")
+	}
+}
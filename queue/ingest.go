@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sync"
+)
+
+// Error indicating that a message was refused as it was submitted. The code
+// and message are suitable for an SMTP reply.
+type RejectError struct {
+	Code    int
+	Message string
+}
+
+func (r *RejectError) Error() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
+}
+
+// Policies applied to message bodies as they are submitted. All methods are
+// safe to call from multiple goroutines.
+type ingestPolicy struct {
+	m      sync.Mutex
+	config *Config
+}
+
+// Create a policy using the specified configuration.
+func newIngestPolicy(c *Config) *ingestPolicy {
+	return &ingestPolicy{config: c}
+}
+
+// Switch to the specified configuration.
+func (i *ingestPolicy) setConfig(c *Config) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.config = c
+}
+
+// Retrieve the current configuration.
+func (i *ingestPolicy) get() *Config {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.config
+}
+
+// Writer for a submitted message body that checks the body against the
+// policies as it is written. The names of header fields are collected as
+// each line is written so that the header section need not be buffered. The
+// body is removed and the error returned by Close if the message is refused.
+type ingestWriter struct {
+	io.WriteCloser
+	storage *Storage
+	body    string
+	config  *Config
+	log     *logrus.Entry
+	n       int
+	long    bool
+	inBody  bool
+	naming  bool
+	name    []byte
+	hasFrom bool
+}
+
+// Process a byte of the header section.
+func (w *ingestWriter) header(c byte) {
+	switch c {
+	case '\n':
+		w.inBody = w.n == 0
+		w.naming = false
+		return
+	case '\r':
+		return
+	}
+	if w.n == 0 {
+		// Continuation lines begin with whitespace
+		w.naming = c != ' ' && c != '\t'
+		w.name = w.name[:0]
+	}
+	if !w.naming {
+		return
+	}
+	if c == ':' {
+		w.naming = false
+		if textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(w.name))) == "From" {
+			w.hasFrom = true
+		}
+	} else if len(w.name) < maxLineLength {
+		w.name = append(w.name, c)
+	}
+}
+
+func (w *ingestWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if !w.inBody {
+			w.header(c)
+		}
+		switch c {
+		case '\n':
+			w.n = 0
+		case '\r':
+		default:
+			if w.n++; w.n > maxLineLength {
+				w.long = true
+			}
+		}
+	}
+	return w.WriteCloser.Write(p)
+}
+
+// Determine the error for refusing the message or nil if it is accepted.
+func (w *ingestWriter) check() error {
+	if w.long && w.config.LongLines == LongLinesReject {
+		return &RejectError{
+			Code:    w.config.longLinesCode(),
+			Message: w.config.longLinesMessage(),
+		}
+	}
+	if !w.hasFrom {
+		switch w.config.MissingFromPolicy {
+		case MissingFromLog:
+			w.log.Warn("message does not have a From header")
+		case MissingFromReject:
+			return &RejectError{
+				Code:    550,
+				Message: "message does not have a From header",
+			}
+		}
+	}
+	return nil
+}
+
+func (w *ingestWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	err := w.check()
+	if err != nil {
+		w.log.Warnf("message refused: %s", err)
+		w.storage.m.Lock()
+		defer w.storage.m.Unlock()
+		if e := w.storage.removeBody(&Message{body: w.body}); e != nil {
+			w.log.Error(e.Error())
+		}
+	}
+	return err
+}
+
+// Create a new body for a submitted message. The body is checked against the
+// policies for submitted messages as it is written and Close returns a
+// *RejectError if the message is refused, in which case the body is removed.
+func (q *Queue) NewBody() (io.WriteCloser, string, error) {
+	w, body, err := q.Storage.NewBody()
+	if err != nil {
+		return nil, "", err
+	}
+	return &ingestWriter{
+		WriteCloser: w,
+		storage:     q.Storage,
+		body:        body,
+		config:      q.ingest.get(),
+		log:         q.log,
+	}, body, nil
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIngestLongLines(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		max    = strings.Repeat("a", maxLineLength)
+		header = "Subject: x\r\n\r\n"
+	)
+	for _, v := range []struct {
+		config *Config
+		body   []string
+		code   int
+	}{
+		{&Config{}, []string{header, max + "b\r\n"}, 0},
+		{&Config{LongLines: LongLinesReject}, []string{header, max, "\r\n", max}, 0},
+		{&Config{LongLines: LongLinesReject}, []string{header, max, "b\r\n"}, 550},
+		{&Config{LongLines: LongLinesReject, LongLinesCode: 554}, []string{header + max + "b"}, 554},
+	} {
+		v.config.Directory = d
+		q, err := NewQueue(v.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Stop()
+		w, body, err := q.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range v.body {
+			if _, err := w.Write([]byte(b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.Close()
+		if v.code == 0 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		e, ok := err.(*RejectError)
+		if !ok {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if e.Code != v.code {
+			t.Fatalf("%d != %d", e.Code, v.code)
+		}
+		if _, err := os.Stat(q.Storage.bodyDirectory(body)); !os.IsNotExist(err) {
+			t.Fatal("body of refused message was not removed")
+		}
+	}
+}
+
+func TestIngestMissingFrom(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	q, err := NewQueue(&Config{
+		Directory:         d,
+		MissingFromPolicy: MissingFromReject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Stop()
+	for _, v := range []struct {
+		body     []string
+		rejected bool
+	}{
+		{[]string{"From: me@example.com\r\n\r\ntest\r\n"}, false},
+		{[]string{"Subject: x\r\n", "fr", "om : me@example.com\r\n", "\r\n"}, false},
+		{[]string{"Subject: x\r\n\r\nFrom: me@example.com\r\n"}, true},
+		{[]string{"Subject: x\r\n From: me@example.com\r\n\r\n"}, true},
+		{[]string{"X-From: me@example.com\r\n\r\n"}, true},
+	} {
+		w, _, err := q.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range v.body {
+			if _, err := w.Write([]byte(b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, rejected := w.Close().(*RejectError)
+		if rejected != v.rejected {
+			t.Fatalf("%q: %t != %t", v.body, rejected, v.rejected)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"sync"
+)
+
+// Number of open connections using each source IP, limiting them across all
+// hosts so that no address opens too many at once. All methods are safe to
+// call from multiple goroutines.
+type ipSlots struct {
+	m        sync.Mutex
+	metrics  Metrics
+	inUse    map[string]int
+	released chan bool
+}
+
+// Create a new set of slots that records its counts in the metrics.
+func newIPSlots(m Metrics) *ipSlots {
+	return &ipSlots{
+		metrics:  m,
+		inUse:    make(map[string]int),
+		released: make(chan bool),
+	}
+}
+
+// Record the number of connections using the IP address.
+func (i *ipSlots) update(ip string) {
+	i.metrics.SetGauge(metricSourceIPConns, float64(i.inUse[ip]), map[string]string{
+		labelIP: ip,
+	})
+}
+
+// Wait until fewer than max connections use the IP address and take a slot.
+// False is returned if the stop channel receives a value first.
+func (i *ipSlots) acquire(ip string, max int, stop <-chan bool) bool {
+	for {
+		i.m.Lock()
+		if i.inUse[ip] < max {
+			i.inUse[ip]++
+			i.update(ip)
+			i.m.Unlock()
+			return true
+		}
+		released := i.released
+		i.m.Unlock()
+		select {
+		case <-released:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// Release a slot for the IP address, waking anything waiting for one.
+func (i *ipSlots) release(ip string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.inUse[ip]--
+	i.update(ip)
+	close(i.released)
+	i.released = make(chan bool)
+}
+
+// Take a slot for the source IP if connections using it are limited. The
+// function returned releases the slot and nil is returned if the host queue
+// was shut down while waiting.
+func (h *Host) acquireIPSlot(sourceIP string) func() {
+	max := h.config.MaxConnectionsPerIP
+	if sourceIP == "" || max <= 0 {
+		return func() {}
+	}
+	if !h.ipSlots.acquire(sourceIP, max, h.stop) {
+		return nil
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.ipSlots.release(sourceIP)
+		})
+	}
+}
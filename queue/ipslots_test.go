@@ -0,0 +1,39 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIPSlots(t *testing.T) {
+	var (
+		i    = newIPSlots(nopMetrics{})
+		stop = make(chan bool)
+		done = make(chan bool)
+	)
+	if !i.acquire("192.0.2.1", 1, stop) {
+		t.Fatal("slot not acquired")
+	}
+	if !i.acquire("192.0.2.2", 1, stop) {
+		t.Fatal("slot for other IP not acquired")
+	}
+	go func() {
+		done <- i.acquire("192.0.2.1", 1, stop)
+	}()
+	select {
+	case <-done:
+		t.Fatal("slot acquired while in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+	i.release("192.0.2.1")
+	if !<-done {
+		t.Fatal("slot not acquired after release")
+	}
+	go func() {
+		done <- i.acquire("192.0.2.1", 1, stop)
+	}()
+	stop <- true
+	if <-done {
+		t.Fatal("acquire did not stop")
+	}
+}
@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// Maximum number of characters in a line, excluding the CRLF (RFC 5321,
+// section 4.5.3.1.6).
+const maxLineLength = 998
+
+// Policies for lines that exceed the maximum length.
+const (
+	LongLinesPass   = "pass"
+	LongLinesReject = "reject"
+	LongLinesWrap   = "wrap"
+)
+
+// Reader that breaks lines exceeding the maximum length while streaming. Long
+// header lines are folded before whitespace where possible so that the
+// header is unchanged once unfolded. Long lines of body text are broken by
+// inserting CRLF, but lines in parts using base64 or quoted-printable
+// encoding are left alone since breaking them would change their content.
+// Each header section is buffered to determine the encoding and boundary of
+// the part that follows it.
+type wrapReader struct {
+	io.Closer
+	r          *bufio.Reader
+	out        bytes.Buffer
+	err        error
+	header     []byte
+	inHeader   bool
+	encoded    bool
+	boundaries []string
+}
+
+// Create a reader that wraps long lines in the specified reader.
+func newWrapReader(r io.ReadCloser) io.ReadCloser {
+	return &wrapReader{
+		Closer:   r,
+		r:        bufio.NewReader(r),
+		inHeader: true,
+	}
+}
+
+// Split the line into its content and line ending.
+func splitLine(line []byte) ([]byte, []byte) {
+	content := bytes.TrimRight(line, "\r\n")
+	return content, line[len(content):]
+}
+
+// Fold the header line so that no line exceeds the maximum length. Each
+// continuation line begins with the whitespace that the line was folded
+// before. A line without suitable whitespace is folded by inserting a space.
+func foldHeader(line []byte) []byte {
+	content, end := splitLine(line)
+	if len(content) <= maxLineLength {
+		return line
+	}
+	folded := []byte{}
+	for len(content) > maxLineLength {
+		i := bytes.LastIndexAny(content[1:maxLineLength+1], " \t") + 1
+		if i > 0 {
+			folded = append(append(folded, content[:i]...), "\r\n"...)
+			content = content[i:]
+		} else {
+			folded = append(append(folded, content[:maxLineLength]...), "\r\n"...)
+			content = append([]byte{' '}, content[maxLineLength:]...)
+		}
+	}
+	return append(append(folded, content...), end...)
+}
+
+// Break the line of body text so that no line exceeds the maximum length.
+func wrapBody(line []byte) []byte {
+	content, end := splitLine(line)
+	wrapped := []byte{}
+	for len(content) > maxLineLength {
+		wrapped = append(append(wrapped, content[:maxLineLength]...), "\r\n"...)
+		content = content[maxLineLength:]
+	}
+	return append(append(wrapped, content...), end...)
+}
+
+// Write the buffered header section with long lines folded and determine the
+// encoding and any boundary of the part that follows it.
+func (w *wrapReader) endHeader() {
+	b := bufio.NewReader(bytes.NewReader(w.header))
+	for {
+		line, err := b.ReadBytes('\n')
+		w.out.Write(foldHeader(line))
+		if err != nil {
+			break
+		}
+	}
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(w.header, "\r\n"...)))).ReadMIMEHeader()
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64", "quoted-printable":
+		w.encoded = true
+	default:
+		w.encoded = false
+	}
+	if t, params, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil &&
+		strings.HasPrefix(t, "multipart/") && params["boundary"] != "" {
+		w.boundaries = append(w.boundaries, params["boundary"])
+	}
+	w.header = nil
+	w.inHeader = false
+}
+
+// Process a line read from the message.
+func (w *wrapReader) process(line []byte) {
+	content, _ := splitLine(line)
+	if w.inHeader {
+		if len(content) == 0 {
+			w.endHeader()
+			w.out.Write(line)
+			return
+		}
+		w.header = append(w.header, line...)
+		return
+	}
+	if n := len(w.boundaries); n > 0 {
+		delimiter := "--" + w.boundaries[n-1]
+		switch string(bytes.TrimRight(content, " \t")) {
+		case delimiter:
+			w.out.Write(line)
+			w.inHeader = true
+			return
+		case delimiter + "--":
+			w.out.Write(line)
+			w.boundaries = w.boundaries[:n-1]
+			w.encoded = false
+			return
+		}
+	}
+	if w.encoded {
+		w.out.Write(line)
+		return
+	}
+	w.out.Write(wrapBody(line))
+}
+
+func (w *wrapReader) Read(p []byte) (int, error) {
+	for w.out.Len() == 0 && w.err == nil {
+		line, err := w.r.ReadBytes('\n')
+		if len(line) > 0 {
+			w.process(line)
+		}
+		if err != nil {
+			if w.inHeader {
+				w.endHeader()
+			}
+			w.err = err
+		}
+	}
+	if w.out.Len() > 0 {
+		return w.out.Read(p)
+	}
+	return 0, w.err
+}
@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLongLines(t *testing.T) {
+	var (
+		max    = strings.Repeat("a", maxLineLength)
+		long   = max + "b"
+		header = "Subject: x\r\n\r\n"
+	)
+	data := []struct {
+		i, o string
+	}{
+		{header + max + "\r\n" + max, header + max + "\r\n" + max},
+		{header + long + "\r\n", header + max + "\r\nb\r\n"},
+		{header + long + long, header + max + "\r\nb" + max[1:] + "\r\nab"},
+	}
+	for _, d := range data {
+		b, err := ioutil.ReadAll(newWrapReader(ioutil.NopCloser(strings.NewReader(d.i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != d.o {
+			t.Fatalf("%q != %q", b, d.o)
+		}
+	}
+}
+
+func TestWrapHeadersAndParts(t *testing.T) {
+	var (
+		words   = strings.Repeat("word ", 300)
+		encoded = strings.Repeat("A", 1200)
+		text    = strings.Repeat("b", 1200)
+	)
+	i := "To: " + words + "\r\n" +
+		"X-Token: " + encoded + "\r\n" +
+		"Content-Type: multipart/mixed; boundary=x\r\n\r\n" +
+		"--x\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		encoded + "\r\n" +
+		"--x\r\n\r\n" +
+		text + "\r\n" +
+		"--x--\r\n"
+	b, err := ioutil.ReadAll(newWrapReader(ioutil.NopCloser(strings.NewReader(i))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := string(b)
+	for _, l := range strings.Split(o, "\r\n") {
+		if len(l) > maxLineLength && l != encoded {
+			t.Fatalf("line of %d characters not wrapped", len(l))
+		}
+	}
+	if !strings.Contains(o, "\r\n"+encoded+"\r\n") {
+		t.Fatal("encoded part was wrapped")
+	}
+	if !strings.Contains(o, "\r\n"+text[:maxLineLength]+"\r\n"+text[maxLineLength:]+"\r\n") {
+		t.Fatal("text part was not wrapped")
+	}
+	unfolded := strings.Replace(o[:strings.Index(o, "\r\n\r\n")], "\r\n", "", -1)
+	if !strings.HasPrefix(unfolded, "To: "+words+"X-Token: ") {
+		t.Fatal("folding changed the header")
+	}
+	for _, l := range strings.Split(o[:strings.Index(o, "\r\n\r\n")], "\r\n")[1:] {
+		if l[0] != ' ' && l[0] != '\t' && !strings.Contains(l, ":") {
+			t.Fatalf("continuation line %q does not begin with whitespace", l)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Configuration for delivering messages through the Mailgun HTTP API.
+type MailgunConfig struct {
+	// Sending domain and API key for the account
+	Domain string `json:"domain"`
+	APIKey string `json:"api-key"`
+
+	// Base URL of the API (defaults to https://api.mailgun.net/v3)
+	URL string `json:"url"`
+}
+
+// Transport that submits messages to Mailgun as MIME documents.
+type MailgunTransport struct {
+	config *MailgunConfig
+	client *http.Client
+}
+
+// Create a transport using the specified configuration.
+func NewMailgunTransport(c *MailgunConfig) *MailgunTransport {
+	return &MailgunTransport{
+		config: c,
+		client: &http.Client{
+			Timeout: 2 * time.Minute,
+		},
+	}
+}
+
+// Submit the message. The body is streamed to the API as it is read. Rate
+// limiting and server errors are treated as temporary failures and all other
+// errors as permanent ones.
+func (t *MailgunTransport) Deliver(ctx context.Context, m *Message, body io.Reader) (Result, error) {
+	u := t.config.URL
+	if u == "" {
+		u = "https://api.mailgun.net/v3"
+	}
+	var (
+		pr, pw = io.Pipe()
+		w      = multipart.NewWriter(pw)
+	)
+	go func() {
+		pw.CloseWithError(func() error {
+			for _, to := range m.To {
+				if err := w.WriteField("to", to); err != nil {
+					return err
+				}
+			}
+			f, err := w.CreateFormFile("message", "message.mime")
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, body); err != nil {
+				return err
+			}
+			return w.Close()
+		}())
+	}()
+	req, err := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/%s/messages.mime", strings.TrimSuffix(u, "/"), t.config.Domain),
+		pr,
+	)
+	if err != nil {
+		pr.Close()
+		return Deferred, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.SetBasicAuth("api", t.config.APIKey)
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		pr.Close()
+		return Deferred, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return Delivered, nil
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("mailgun returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return Deferred, err
+	}
+	return Failed, err
+}
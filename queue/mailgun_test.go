@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMailgunTransport(t *testing.T) {
+	var (
+		body   = []byte("Subject: test\r\n\r\ntest\r\n")
+		status int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example.com/messages.mime" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if _, key, _ := r.BasicAuth(); key != "key" {
+			t.Errorf("unexpected API key %s", key)
+		}
+		f, _, err := r.FormFile("message")
+		if err != nil {
+			t.Error(err)
+		} else if b, _ := ioutil.ReadAll(f); !bytes.Equal(b, body) {
+			t.Errorf("%q != %q", b, body)
+		}
+		if to := r.FormValue("to"); to != "you@example.org" {
+			t.Errorf("unexpected recipient %s", to)
+		}
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+	transport := NewMailgunTransport(&MailgunConfig{
+		Domain: "example.com",
+		APIKey: "key",
+		URL:    s.URL,
+	})
+	for _, d := range []struct {
+		status int
+		result Result
+	}{
+		{http.StatusOK, Delivered},
+		{http.StatusTooManyRequests, Deferred},
+		{http.StatusInternalServerError, Deferred},
+		{http.StatusBadRequest, Failed},
+	} {
+		status = d.status
+		r, _ := transport.Deliver(context.Background(), &Message{
+			To: []string{"you@example.org"},
+		}, bytes.NewReader(body))
+		if r != d.result {
+			t.Fatalf("%d: %d != %d", d.status, r, d.result)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// Names of the metrics recorded by the queue.
+const (
+	metricMessages       = "cannon_messages_total"
+	metricDuration       = "cannon_delivery_duration_seconds"
+	metricMessageSize    = "cannon_message_size_bytes"
+	metricQueueLength    = "cannon_queue_length"
+	metricActiveHosts    = "cannon_active_hosts"
+	metricQueueAge       = "cannon_queue_age_seconds"
+	metricOrphaned       = "cannon_orphaned_messages_total"
+	metricProbes         = "cannon_probes_total"
+	metricDNSFailures    = "cannon_dns_failures_total"
+	metricSendRate       = "cannon_send_rate"
+	metricTLSTimeouts    = "cannon_tls_timeouts_total"
+	metricMonitorSuccess = "cannon_monitor_delivery_success"
+	metricSourceIPListed = "cannon_source_ip_listed"
+	metricConnFailures   = "cannon_connect_failures_total"
+	metricSourceIPConns  = "cannon_source_ip_connections"
+	metricBounces        = "cannon_bounces_total"
+	metricRateLimits     = "cannon_rate_limits_total"
+	metricCooldowns      = "cannon_cooldowns"
+	metricTLSDowngrades  = "cannon_tls_downgrade_total"
+	metricConnsOpened    = "cannon_connections_total"
+	metricConnThrottled  = "cannon_connect_throttled_total"
+	metricWebhookDropped = "cannon_webhook_dropped_total"
+	resultDelivered      = "delivered"
+	resultDeferred       = "deferred"
+	resultFailed         = "failed"
+	resultQuarantined    = "quarantined"
+	labelResult          = "result"
+	labelHost            = "host"
+	labelQuantile        = "quantile"
+	labelIP              = "ip"
+	labelDNSBL           = "dnsbl"
+	labelReason          = "reason"
+	labelScope           = "scope"
+	tagLabelPrefix       = "tag_"
+)
+
+// Backend for recording metrics. Implementations must be safe to call from
+// multiple goroutines.
+type Metrics interface {
+	IncCounter(name string, labels map[string]string)
+	ObserveHistogram(name string, value float64, labels map[string]string)
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+// Backend that can remove a series that is no longer updated, such as the
+// queue length of a host queue that was shut down. Backends that do not
+// implement it keep the last value of the series.
+type SeriesDeleter interface {
+	DeleteSeries(name string, labels map[string]string)
+}
+
+// Remove the series from the backend if it supports doing so.
+func deleteSeries(m Metrics, name string, labels map[string]string) {
+	if d, ok := m.(SeriesDeleter); ok {
+		d.DeleteSeries(name, labels)
+	}
+}
+
+// Value used in place of hosts that exceed the configured limit in labels.
+const otherHostLabel = "other"
+
+// Hosts used as metric labels. The number of hosts is limited to avoid an
+// unbounded number of series and the hosts that exceed the limit share a
+// single label. All methods are safe to call from multiple goroutines.
+type hostLabels struct {
+	m      sync.Mutex
+	config *Config
+	hosts  map[string]bool
+}
+
+// Create a new set of labels using the specified configuration.
+func newHostLabels(c *Config) *hostLabels {
+	return &hostLabels{
+		config: c,
+		hosts:  make(map[string]bool),
+	}
+}
+
+// Switch to the specified configuration.
+func (h *hostLabels) setConfig(c *Config) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.config = c
+}
+
+// Determine the label for the host and whether the host has its own label.
+func (h *hostLabels) label(host string) (string, bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.hosts[host] {
+		if len(h.hosts) >= h.config.maxHostLabels() {
+			return otherHostLabel, false
+		}
+		h.hosts[host] = true
+	}
+	return host, true
+}
+
+// Determine the label for the host queue.
+func (h *Host) hostLabel() string {
+	l, _ := h.hostLabels.label(h.host)
+	return l
+}
+
+// Metrics backend that discards everything.
+type nopMetrics struct{}
+
+func (nopMetrics) IncCounter(string, map[string]string)                {}
+func (nopMetrics) ObserveHistogram(string, float64, map[string]string) {}
+func (nopMetrics) SetGauge(string, float64, map[string]string)         {}
+
+// Select the metrics backend for the configuration. A backend provided by the
+// application takes precedence over the built-in Prometheus backend.
+func newMetrics(c *Config) Metrics {
+	switch {
+	case c.Metrics != nil:
+		return c.Metrics
+	case c.EnableMetrics:
+		return NewPrometheusMetrics()
+	default:
+		return nopMetrics{}
+	}
+}
+
+// Record the outcome of an attempt to deliver the message. Message tags are
+// included as labels, subject to the configured limits. Test messages sent to
+// monitor delivery are excluded from the statistics.
+func (h *Host) record(m *Message, result string) {
+	if m.Monitor {
+		h.emit(m, result)
+		m.outcome = result
+		return
+	}
+	labels := map[string]string{
+		labelHost:   h.hostLabel(),
+		labelResult: result,
+	}
+	for k, v := range h.tagStats.add(m, result) {
+		labels[tagLabelPrefix+k] = v
+	}
+	h.metrics.IncCounter(metricMessages, labels)
+	h.emit(m, result)
+	h.updateRamp(result)
+	m.outcome = result
+}
+
+// Record the time taken to deliver a message and its size.
+func (h *Host) recordDelivery(start time.Time, size int64) {
+	labels := map[string]string{
+		labelHost: h.hostLabel(),
+	}
+	h.metrics.ObserveHistogram(metricDuration, time.Since(start).Seconds(), labels)
+	h.metrics.ObserveHistogram(metricMessageSize, float64(size), labels)
+}
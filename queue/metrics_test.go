@@ -0,0 +1,23 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestHostLabels(t *testing.T) {
+	l := newHostLabels(&Config{MaxHostLabels: 2})
+	for _, d := range []struct {
+		host  string
+		label string
+		own   bool
+	}{
+		{"a.example.com", "a.example.com", true},
+		{"b.example.com", "b.example.com", true},
+		{"c.example.com", otherHostLabel, false},
+		{"a.example.com", "a.example.com", true},
+	} {
+		if label, own := l.label(d.host); label != d.label || own != d.own {
+			t.Fatalf("%s: %s, %t != %s, %t", d.host, label, own, d.label, d.own)
+		}
+	}
+}
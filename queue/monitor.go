@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Configuration for periodically sending a test message through the normal
+// delivery path to monitor it.
+type MonitorConfig struct {
+	// Sender and recipient of the test message
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Number of seconds between test messages (defaults to 300)
+	Interval int `json:"interval"`
+}
+
+// Determine the interval between test messages.
+func (c *MonitorConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// Create and store a test message. It expires once the next one is due so
+// that test messages do not pile up while delivery is failing.
+func (q *Queue) newMonitorMessage(c *MonitorConfig) (*Message, error) {
+	w, body, err := q.Storage.NewBody()
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", c.From)
+	fmt.Fprintf(b, "To: %s\r\n", c.To)
+	fmt.Fprintf(b, "Subject: Delivery monitor\r\n")
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(b, "X-Cannon-Monitor: true\r\n\r\n")
+	fmt.Fprintf(b, "This message was sent to monitor delivery.\r\n")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Host:        c.To[strings.LastIndex(c.To, "@")+1:],
+		From:        c.From,
+		To:          []string{c.To},
+		MaxLifetime: int(c.interval() / time.Second),
+		Monitor:     true,
+	}
+	if err := q.Storage.SaveMessage(m, body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Send a test message if one is due and record whether it was delivered. A
+// message that is not delivered before the next one is due counts as a
+// failure. This must be called from the queue's goroutine.
+func (q *Queue) sendMonitorMessage() {
+	c := q.config.Monitor
+	if c == nil || time.Since(q.lastMonitor) < c.interval() {
+		return
+	}
+	q.lastMonitor = time.Now()
+	m, err := q.newMonitorMessage(c)
+	if err != nil {
+		q.log.Error(err.Error())
+		q.metrics.SetGauge(metricMonitorSuccess, 0, nil)
+		return
+	}
+	result := make(chan *DeliveryResult, 1)
+	m.result = result
+	q.deliverMessage(m)
+	go func() {
+		var (
+			l       = q.log.WithField("monitor", true)
+			success float64
+		)
+		select {
+		case r := <-result:
+			if r != nil && r.Outcome == OutcomeDelivered {
+				success = 1
+				l.Info("test message delivered")
+			} else if r != nil {
+				l.Errorf("test message %s: %v", r.Outcome, r.Error)
+			}
+		case <-time.After(c.interval()):
+			l.Error("test message was not delivered in time")
+		}
+		q.metrics.SetGauge(metricMonitorSuccess, success, nil)
+	}()
+}
@@ -0,0 +1,39 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMonitorMessageExpires(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		q = &Queue{Storage: NewStorage(d)}
+		c = &MonitorConfig{
+			From:     "me@example.org",
+			To:       "you@example.com",
+			Interval: 60,
+		}
+		h = &Host{config: &Config{MaxLifetime: 3600}}
+	)
+	m, err := q.newMonitorMessage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxLifetime != 60 {
+		t.Fatalf("%d != 60", m.MaxLifetime)
+	}
+	if h.isExpired(m) {
+		t.Fatal("new message expired")
+	}
+	m.Created = m.Created.Add(-time.Minute)
+	if !h.isExpired(m) {
+		t.Fatal("message outlived the interval")
+	}
+}
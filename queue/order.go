@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// Orderings for choosing the next message to deliver to a host.
+//
+// FIFO delivers messages in the order they arrived, which is fair to every
+// sender and bounds the time any message waits behind a backlog.
+//
+// LIFO delivers the most recent message first, which keeps fresh mail (such
+// as password resets) timely while a backlog drains but can leave older
+// messages waiting until they expire.
+//
+// Priority delivers messages with the highest priority first, arriving order
+// breaking ties. Low priority messages are starved for as long as higher
+// priority ones keep arriving.
+const (
+	OrderFIFO     = "fifo"
+	OrderLIFO     = "lifo"
+	OrderPriority = "priority"
+)
+
+// Message waiting in a queue along with its position in the arrival order.
+type queuedMessage struct {
+	m   *Message
+	seq uint64
+}
+
+// Ring buffer of messages in arrival order that can be removed from either
+// end. Removed slots are cleared so that delivered messages can be collected.
+type messageRing struct {
+	items []*queuedMessage
+	head  int
+	n     int
+}
+
+func (r *messageRing) push(q *queuedMessage) {
+	if r.n == len(r.items) {
+		items := make([]*queuedMessage, 2*len(r.items)+1)
+		for i := 0; i < r.n; i++ {
+			items[i] = r.items[(r.head+i)%len(r.items)]
+		}
+		r.items, r.head = items, 0
+	}
+	r.items[(r.head+r.n)%len(r.items)] = q
+	r.n++
+}
+
+// Remove the oldest message or the newest one if last is true.
+func (r *messageRing) pop(last bool) *queuedMessage {
+	i := r.head
+	if last {
+		i = (r.head + r.n - 1) % len(r.items)
+	} else {
+		r.head = (r.head + 1) % len(r.items)
+	}
+	q := r.items[i]
+	r.items[i] = nil
+	r.n--
+	return q
+}
+
+// Heap of messages with the highest priority first, arrival order breaking
+// ties. It implements heap.Interface.
+type messageHeap []*queuedMessage
+
+func (h messageHeap) Len() int { return len(h) }
+
+func (h messageHeap) Less(i, j int) bool {
+	if h[i].m.Priority != h[j].m.Priority {
+		return h[i].m.Priority > h[j].m.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h messageHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *messageHeap) Push(x interface{}) {
+	*h = append(*h, x.(*queuedMessage))
+}
+
+func (h *messageHeap) Pop() interface{} {
+	var (
+		old = *h
+		n   = len(old)
+		q   = old[n-1]
+	)
+	old[n-1] = nil
+	*h = old[:n-1]
+	return q
+}
+
+// Messages waiting to be delivered to a host. Adding a message never blocks
+// and the next message is chosen according to an ordering when it is
+// removed. Messages are kept in a ring buffer for FIFO and LIFO ordering and
+// in a heap for priority ordering, moving between them when the ordering
+// changes. All methods are safe to call from multiple goroutines.
+type messageQueue struct {
+	m        sync.Mutex
+	priority bool
+	ring     messageRing
+	heap     messageHeap
+	seq      uint64
+	ready    chan bool
+}
+
+// Create a new, empty queue.
+func newMessageQueue() *messageQueue {
+	return &messageQueue{
+		ready: make(chan bool, 1),
+	}
+}
+
+// Signal that messages are waiting without blocking if a signal is already
+// pending.
+func (q *messageQueue) signal() {
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// Add a message to the queue.
+func (q *messageQueue) push(m *Message) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	v := &queuedMessage{m, q.seq}
+	q.seq++
+	if q.priority {
+		heap.Push(&q.heap, v)
+	} else {
+		q.ring.push(v)
+	}
+	q.signal()
+}
+
+// Move the messages to the structure used for the ordering if they are not
+// already in it. The mutex must be held.
+func (q *messageQueue) setOrder(order string) {
+	priority := order == OrderPriority
+	if priority == q.priority {
+		return
+	}
+	q.priority = priority
+	if priority {
+		for q.ring.n > 0 {
+			q.heap = append(q.heap, q.ring.pop(false))
+		}
+		heap.Init(&q.heap)
+		return
+	}
+	sort.Slice(q.heap, func(i, j int) bool {
+		return q.heap[i].seq < q.heap[j].seq
+	})
+	for i, v := range q.heap {
+		q.ring.push(v)
+		q.heap[i] = nil
+	}
+	q.heap = q.heap[:0]
+}
+
+// Remove the next message according to the ordering. Nil is returned if the
+// queue is empty.
+func (q *messageQueue) pop(order string) *Message {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.setOrder(order)
+	var v *queuedMessage
+	switch {
+	case q.priority && len(q.heap) > 0:
+		v = heap.Pop(&q.heap).(*queuedMessage)
+	case !q.priority && q.ring.n > 0:
+		v = q.ring.pop(order == OrderLIFO)
+	default:
+		return nil
+	}
+	if q.ring.n+len(q.heap) > 0 {
+		q.signal()
+	}
+	return v.m
+}
+
+// Retrieve the number of messages in the queue.
+func (q *messageQueue) len() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.ring.n + len(q.heap)
+}
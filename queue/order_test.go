@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestMessageQueue(t *testing.T) {
+	for _, v := range []struct {
+		order    string
+		expected []int
+	}{
+		{OrderFIFO, []int{0, 1, 2, 3}},
+		{OrderLIFO, []int{3, 2, 1, 0}},
+		{OrderPriority, []int{1, 3, 0, 2}},
+	} {
+		var (
+			q        = newMessageQueue()
+			messages = []*Message{
+				{Priority: 0},
+				{Priority: 2},
+				{Priority: 0},
+				{Priority: 1},
+			}
+		)
+		for _, m := range messages {
+			q.push(m)
+		}
+		for _, i := range v.expected {
+			if m := q.pop(v.order); m != messages[i] {
+				t.Fatalf("%s: unexpected message", v.order)
+			}
+		}
+		if m := q.pop(v.order); m != nil {
+			t.Fatalf("%s: queue not empty", v.order)
+		}
+	}
+}
+
+func TestMessageQueueOrderChange(t *testing.T) {
+	var (
+		q        = newMessageQueue()
+		messages []*Message
+	)
+	for i := 0; i < 10; i++ {
+		messages = append(messages, &Message{Priority: i % 3})
+		q.push(messages[i])
+	}
+	for _, v := range []struct {
+		order string
+		i     int
+	}{
+		{OrderFIFO, 0},
+		{OrderLIFO, 9},
+		{OrderPriority, 2},
+		{OrderPriority, 5},
+		{OrderFIFO, 1},
+		{OrderLIFO, 8},
+	} {
+		if m := q.pop(v.order); m != messages[v.i] {
+			t.Fatalf("%s: expected message %d", v.order, v.i)
+		}
+	}
+	if l := q.len(); l != 4 {
+		t.Fatalf("%d != 4", l)
+	}
+	for q.pop(OrderFIFO) != nil {
+	}
+	for _, v := range q.ring.items {
+		if v != nil {
+			t.Fatal("removed message still referenced")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// Details of a queue-wide pause.
+type PauseStatus struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// Gate that prevents all hosts from attempting delivery while the queue is
+// paused. All methods are safe to call from multiple goroutines.
+type pauseGate struct {
+	m       sync.Mutex
+	status  *PauseStatus
+	resumed chan struct{}
+}
+
+// Create a new gate that is open.
+func newPauseGate() *pauseGate {
+	return &pauseGate{}
+}
+
+// Close the gate for the specified reason. If the gate is already closed, the
+// reason is replaced.
+func (p *pauseGate) pause(reason string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.status == nil {
+		p.resumed = make(chan struct{})
+	}
+	p.status = &PauseStatus{
+		Reason: reason,
+		Since:  time.Now(),
+	}
+}
+
+// Open the gate, allowing waiting hosts to continue.
+func (p *pauseGate) resume() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.status != nil {
+		close(p.resumed)
+		p.status = nil
+	}
+}
+
+// Provide the details of the pause or nil if the gate is open.
+func (p *pauseGate) get() *PauseStatus {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.status == nil {
+		return nil
+	}
+	s := *p.status
+	return &s
+}
+
+// Wait until the gate is open. False is returned if the stop channel receives
+// a value first.
+func (p *pauseGate) wait(stop <-chan bool) bool {
+	p.m.Lock()
+	if p.status == nil {
+		p.m.Unlock()
+		return true
+	}
+	resumed := p.resumed
+	p.m.Unlock()
+	select {
+	case <-resumed:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Wait until the queue is no longer paused before attempting delivery. False
+// is returned if the host queue was shut down while waiting.
+func (h *Host) waitWhilePaused() bool {
+	if s := h.pause.get(); s != nil {
+		h.log.Infof("delivery paused: %s", s.Reason)
+	}
+	return h.pause.wait(h.stop)
+}
@@ -0,0 +1,41 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	var (
+		p    = newPauseGate()
+		stop = make(chan bool)
+		done = make(chan bool)
+	)
+	if !p.wait(stop) {
+		t.Fatal("open gate did not allow delivery")
+	}
+	p.pause("maintenance")
+	if s := p.get(); s == nil || s.Reason != "maintenance" {
+		t.Fatalf("unexpected status: %v", s)
+	}
+	go func() {
+		done <- p.wait(stop)
+	}()
+	select {
+	case <-done:
+		t.Fatal("closed gate allowed delivery")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.resume()
+	if !<-done {
+		t.Fatal("gate did not open")
+	}
+	p.pause("blocklisted")
+	go func() {
+		done <- p.wait(stop)
+	}()
+	stop <- true
+	if <-done {
+		t.Fatal("wait did not stop")
+	}
+}
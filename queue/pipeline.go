@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+)
+
+// Reply to a RCPT command sent as part of a pipelined envelope.
+type rcptReply struct {
+	code int
+	err  error
+}
+
+// Send MAIL and RCPT for each recipient without waiting for the replies
+// (RFC 2920) and then read the reply to each command in turn. If MAIL is
+// rejected, the replies to the remaining commands are still read so that
+// the session stays in step with the server.
+func (c *connection) pipelineEnvelope(from string, to []string) ([]rcptReply, error) {
+	for _, a := range append([]string{from}, to...) {
+		if strings.ContainsAny(a, "\r\n") {
+			return nil, errors.New("smtp: A line must not contain CR or LF")
+		}
+	}
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	id, err := c.Text.Cmd(cmd, from)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint{id}
+	for _, t := range to {
+		id, err := c.Text.Cmd("RCPT TO:<%s>", t)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	var (
+		replies = make([]rcptReply, 0, len(to))
+		mailErr error
+	)
+	for i, id := range ids {
+		expect := 25
+		if i == 0 {
+			expect = 250
+		}
+		c.Text.StartResponse(id)
+		code, _, err := c.Text.ReadResponse(expect)
+		c.Text.EndResponse(id)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			return nil, err
+		}
+		if i == 0 {
+			mailErr = err
+			continue
+		}
+		replies = append(replies, rcptReply{code, err})
+	}
+	if mailErr != nil {
+		return nil, mailErr
+	}
+	return replies, nil
+}
+
+// Begin the transaction for the message, providing the function used to
+// specify each recipient. If the host is configured to pipeline commands and
+// the server supports it, MAIL and every RCPT are sent together and the
+// function provides the reply for each recipient in turn.
+func (h *Host) beginTransaction(c *connection, from string, to []string) (func(string) (int, error), error) {
+	if ok, _ := c.Extension("PIPELINING"); !ok || !h.config.hostConfig(h.host).Pipelining {
+		return c.rcpt, c.Mail(from)
+	}
+	replies, err := c.pipelineEnvelope(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return func(string) (int, error) {
+		r := replies[0]
+		replies = replies[1:]
+		return r.code, r.err
+	}, nil
+}
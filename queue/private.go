@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"github.com/hectane/hectane/util"
+
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Policies for mail servers that resolve to loopback, private or link-local
+// addresses.
+const (
+	PrivateRefuse = "refuse"
+	PrivateAllow  = "allow"
+)
+
+// Errors indicating that a connection to a mail server was refused because it
+// resolved to an internal address and that every mail server for the host
+// does.
+var (
+	errPrivateAddress  = errors.New("mail server resolves to a private address")
+	errPrivateDelivery = errors.New("all mail servers resolve to private addresses")
+)
+
+// Determine if the IP address belongs to a range that should not be reachable
+// from the public internet.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified()
+}
+
+// Determine if the allowlist contains the server's name or a network that
+// includes the address.
+func (c *Config) privateAllowed(server string, ip net.IP) bool {
+	for _, a := range c.PrivateAllowlist {
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if p := net.ParseIP(a); p != nil {
+			if p.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if util.NormalizeDomain(a) == util.NormalizeDomain(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// Provide the function used by the dialer to refuse connections to the mail
+// server when the address being dialed is internal and not in the allowlist.
+// Checking the address actually dialed ensures that the server cannot
+// resolve to a different address between the check and the connection. Nil
+// is returned if no check is needed, since servers in the host's config or
+// the default route were chosen by the operator.
+func (h *Host) privateControl(server string) func(string, string, syscall.RawConn) error {
+	if len(h.config.hostConfig(h.host).Servers) > 0 ||
+		h.config.relayServer(server) {
+		return nil
+	}
+	return h.config.privateControl(server)
+}
+
+// Provide the function used by the dialer to refuse connections to internal
+// addresses not in the allowlist when connecting to the server or nil if the
+// policy allows them.
+func (c *Config) privateControl(server string) func(string, string, syscall.RawConn) error {
+	if c.PrivatePolicy == PrivateAllow {
+		return nil
+	}
+	return func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || isPrivateIP(ip) && !c.privateAllowed(server, ip) {
+			return errPrivateAddress
+		}
+		return nil
+	}
+}
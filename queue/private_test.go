@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"net"
+	"testing"
+)
+
+func TestPrivateAllowed(t *testing.T) {
+	c := &Config{
+		PrivateAllowlist: []string{"10.1.0.0/16", "relay.example.com"},
+	}
+	for _, v := range []struct {
+		server  string
+		ip      string
+		private bool
+		allowed bool
+	}{
+		{"mx.example.com", "203.0.113.1", false, false},
+		{"mx.example.com", "127.0.0.1", true, false},
+		{"mx.example.com", "10.1.2.3", true, true},
+		{"mx.example.com", "10.2.0.1", true, false},
+		{"relay.example.com", "192.168.0.1", true, true},
+		{"mx.example.com", "fe80::1", true, false},
+	} {
+		ip := net.ParseIP(v.ip)
+		if p := isPrivateIP(ip); p != v.private {
+			t.Fatalf("%s: %t != %t", v.ip, p, v.private)
+		}
+		if a := c.privateAllowed(v.server, ip); a != v.allowed {
+			t.Fatalf("%s: %t != %t", v.ip, a, v.allowed)
+		}
+	}
+}
+
+func TestConnectPrivate(t *testing.T) {
+	srv, err := newMockServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	defer func(f func(string, map[string]int, string) ([]string, error)) {
+		findMailServers = f
+	}(findMailServers)
+	findMailServers = func(string, map[string]int, string) ([]string, error) {
+		return []string{srv.l.Addr().String()}, nil
+	}
+	c := &Config{}
+	h := &Host{
+		shared: newShared(c),
+		config: c,
+		host:   "example.com",
+		log:    logrus.WithField("context", "example.com"),
+		stop:   make(chan bool),
+	}
+	if _, err := h.connectToMailServer("localhost", "", ""); err != errPrivateDelivery {
+		t.Fatalf("%v != %v", err, errPrivateDelivery)
+	}
+	c.PrivateAllowlist = []string{"127.0.0.0/8"}
+	conn, err := h.connectToMailServer("localhost", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"net/textproto"
+)
+
+// Results of probing a mail server.
+const (
+	probeSucceeded = "succeeded"
+	probeFailed    = "failed"
+)
+
+// Determine if the server should be probed before delivering the message.
+// Probes are only used for messages that were previously deferred, since the
+// mail server may still be recovering.
+func (h *Host) shouldProbe(m *Message) bool {
+	return h.config.hostConfig(h.host).ProbeBeforeFlush && m.Attempts > 0
+}
+
+// Check that the mail server is accepting mail by issuing the MAIL and RCPT
+// commands for the first recipient and then resetting the session. Permanent
+// errors are not considered a failure of the probe since they apply to the
+// message rather than the server.
+func (h *Host) probe(c *connection, m *Message) error {
+	err := c.Mail(h.envelopeSender(m))
+	if err == nil {
+		err = c.Rcpt(m.To[0])
+	}
+	if e, ok := err.(*textproto.Error); ok && e.Code >= 500 {
+		err = nil
+	}
+	if err == nil {
+		err = c.Reset()
+	}
+	result := probeSucceeded
+	if err != nil {
+		result = probeFailed
+	}
+	h.log.Infof("probe %s", result)
+	h.metrics.IncCounter(metricProbes, map[string]string{
+		labelHost:   h.hostLabel(),
+		labelResult: result,
+	})
+	return err
+}
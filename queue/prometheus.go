@@ -0,0 +1,208 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Upper bounds of the buckets used for histograms of durations, sizes and
+// anything else.
+var (
+	durationBuckets = []float64{
+		0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300,
+	}
+	sizeBuckets = []float64{
+		1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+		1 << 20, 4 << 20, 16 << 20, 64 << 20,
+	}
+	defaultBuckets = []float64{
+		0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+	}
+)
+
+// Select the buckets for the histogram based on the unit in its name.
+func histogramBuckets(name string) []float64 {
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return durationBuckets
+	case strings.HasSuffix(name, "_bytes"):
+		return sizeBuckets
+	default:
+		return defaultBuckets
+	}
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Value of a metric for a specific set of labels.
+type promValue struct {
+	labels  map[string]string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// Metric of a single type along with its values and, for histograms, the
+// upper bounds of its buckets.
+type promMetric struct {
+	kind    string
+	values  map[string]*promValue
+	buckets []float64
+}
+
+// Metrics backend that stores metrics in memory and serves them in the
+// Prometheus text format.
+type PrometheusMetrics struct {
+	m       sync.Mutex
+	metrics map[string]*promMetric
+}
+
+// Create a new Prometheus metrics backend.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		metrics: make(map[string]*promMetric),
+	}
+}
+
+// Format the labels for output, sorting them by name.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, invalidLabelChars.ReplaceAllString(k, "_"), v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Retrieve the value for the specified metric and labels, creating it if it
+// does not exist.
+func (p *PrometheusMetrics) value(name, kind string, labels map[string]string) *promValue {
+	m, ok := p.metrics[name]
+	if !ok {
+		m = &promMetric{
+			kind:   kind,
+			values: make(map[string]*promValue),
+		}
+		if kind == "histogram" {
+			m.buckets = histogramBuckets(name)
+		}
+		p.metrics[name] = m
+	}
+	key := formatLabels(labels)
+	v, ok := m.values[key]
+	if !ok {
+		v = &promValue{labels: labels}
+		if kind == "histogram" {
+			v.buckets = make([]uint64, len(m.buckets))
+		}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (p *PrometheusMetrics) IncCounter(name string, labels map[string]string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.value(name, "counter", labels).value++
+}
+
+func (p *PrometheusMetrics) ObserveHistogram(name string, value float64, labels map[string]string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	v := p.value(name, "histogram", labels)
+	for i, b := range p.metrics[name].buckets {
+		if value <= b {
+			v.buckets[i]++
+		}
+	}
+	v.value += value
+	v.count++
+}
+
+func (p *PrometheusMetrics) SetGauge(name string, value float64, labels map[string]string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.value(name, "gauge", labels).value = value
+}
+
+// Remove the value for the specified metric and labels.
+func (p *PrometheusMetrics) DeleteSeries(name string, labels map[string]string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if m, ok := p.metrics[name]; ok {
+		delete(m.values, formatLabels(labels))
+		if len(m.values) == 0 {
+			delete(p.metrics, name)
+		}
+	}
+}
+
+// Write a single sample, adding the extra label if provided.
+func writeSample(w io.Writer, name string, labels map[string]string, extra string, value float64) {
+	l := formatLabels(labels)
+	if extra != "" {
+		if l != "" {
+			l += ","
+		}
+		l += extra
+	}
+	if l != "" {
+		l = "{" + l + "}"
+	}
+	fmt.Fprintf(w, "%s%s %v\n", name, l, value)
+}
+
+// Write all metrics to the writer in the Prometheus text format. The metrics
+// are rendered before writing so that a slow writer does not block the
+// metrics from being recorded.
+func (p *PrometheusMetrics) Write(w io.Writer) {
+	w.Write(p.render())
+}
+
+// Render all metrics in the Prometheus text format.
+func (p *PrometheusMetrics) render() []byte {
+	p.m.Lock()
+	defer p.m.Unlock()
+	w := &bytes.Buffer{}
+	names := make([]string, 0, len(p.metrics))
+	for n := range p.metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		m := p.metrics[n]
+		fmt.Fprintf(w, "# TYPE %s %s\n", n, m.kind)
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := m.values[k]
+			if m.kind != "histogram" {
+				writeSample(w, n, v.labels, "", v.value)
+				continue
+			}
+			for i, b := range m.buckets {
+				writeSample(w, n+"_bucket", v.labels, fmt.Sprintf(`le="%v"`, b), float64(v.buckets[i]))
+			}
+			writeSample(w, n+"_bucket", v.labels, `le="+Inf"`, float64(v.count))
+			writeSample(w, n+"_sum", v.labels, "", v.value)
+			writeSample(w, n+"_count", v.labels, "", float64(v.count))
+		}
+	}
+	return w.Bytes()
+}
+
+// Serve the metrics over HTTP.
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.Write(w)
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	var (
+		p    = NewPrometheusMetrics()
+		buff = &bytes.Buffer{}
+	)
+	p.IncCounter("a", map[string]string{"tag_x-y": "\"z\""})
+	p.IncCounter("a", map[string]string{"tag_x-y": "\"z\""})
+	p.SetGauge("b", 5, nil)
+	p.ObserveHistogram("c", 2, nil)
+	p.Write(buff)
+	for _, l := range []string{
+		"# TYPE a counter",
+		`a{tag_x_y="\"z\""} 2`,
+		"b 5",
+		`c_bucket{le="1"} 0`,
+		`c_bucket{le="5"} 1`,
+		`c_bucket{le="+Inf"} 1`,
+		"c_sum 2",
+		"c_count 1",
+	} {
+		if !strings.Contains(buff.String(), l+"\n") {
+			t.Fatalf("%q not found in output", l)
+		}
+	}
+}
+
+func TestPrometheusBuckets(t *testing.T) {
+	var (
+		p    = NewPrometheusMetrics()
+		buff = &bytes.Buffer{}
+	)
+	p.ObserveHistogram("d_seconds", 45, nil)
+	p.ObserveHistogram("s_bytes", 2000, nil)
+	p.Write(buff)
+	for _, l := range []string{
+		`d_seconds_bucket{le="30"} 0`,
+		`d_seconds_bucket{le="60"} 1`,
+		`s_bytes_bucket{le="1024"} 0`,
+		`s_bytes_bucket{le="4096"} 1`,
+	} {
+		if !strings.Contains(buff.String(), l+"\n") {
+			t.Fatalf("%q not found in output", l)
+		}
+	}
+}
+
+func TestPrometheusDeleteSeries(t *testing.T) {
+	var (
+		p    = NewPrometheusMetrics()
+		buff = &bytes.Buffer{}
+	)
+	p.SetGauge("a", 1, map[string]string{"host": "example.com"})
+	p.SetGauge("a", 2, map[string]string{"host": "example.org"})
+	deleteSeries(p, "a", map[string]string{"host": "example.com"})
+	p.Write(buff)
+	if strings.Contains(buff.String(), "example.com") ||
+		!strings.Contains(buff.String(), "example.org") {
+		t.Fatalf("unexpected output: %q", buff.String())
+	}
+}
+
+// Writer that records a metric while being written to, which blocks if the
+// metrics are locked.
+type recordingWriter struct {
+	p *PrometheusMetrics
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	r.p.IncCounter("b", nil)
+	return len(b), nil
+}
+
+func TestPrometheusWriteUnlocked(t *testing.T) {
+	p := NewPrometheusMetrics()
+	p.IncCounter("a", nil)
+	done := make(chan bool)
+	go func() {
+		p.Write(&recordingWriter{p})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("metrics locked while writing")
+	}
+}
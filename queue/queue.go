@@ -1,8 +1,11 @@
 package queue
 
 import (
+	"github.com/hectane/hectane/util"
 	"github.com/sirupsen/logrus"
 
+	"context"
+	"io"
 	"time"
 )
 
@@ -10,25 +13,133 @@ import (
 type QueueStatus struct {
 	Uptime int                    `json:"uptime"`
 	Hosts  map[string]*HostStatus `json:"hosts"`
+	Tags   []*TagStatus           `json:"tags"`
+	Age    *AgeStatus             `json:"age"`
+	Pause  *PauseStatus           `json:"pause"`
+}
+
+// State shared by the queue and all of its hosts.
+type shared struct {
+	metrics      Metrics
+	tagStats     *tagStats
+	capabilities *capabilityCache
+	sourcePools  *sourcePools
+	fcrdns       *fcrdnsCache
+	connections  *connRegistry
+	events       *eventStream
+	dnsRetries   *dnsRetryLimiter
+	history      *deliveryHistory
+	tlsReports   *tlsReportCollector
+	pause        *pauseGate
+	blocklists   *blocklistMonitor
+	verbosity    *verbosityOverrides
+	captured     *CaptureStorage
+	identities   *identitySet
+	ipSlots      *ipSlots
+	bounceStats  *bounceStats
+	webhooks     *webhookDispatcher
+	cooldowns    *cooldowns
+	downgrades   *downgradeLog
+	connBuckets  *connBuckets
+	ages         *ageTracker
+	serverAddrs  *serverAddrCache
+	hostLabels   *hostLabels
+	ingest       *ingestPolicy
+}
+
+// Create shared state using the specified configuration.
+func newShared(c *Config) *shared {
+	m := newMetrics(c)
+	return &shared{
+		metrics:      m,
+		tagStats:     newTagStats(c),
+		capabilities: newCapabilityCache(),
+		sourcePools:  newSourcePools(),
+		fcrdns:       newFCrDNSCache(),
+		connections:  newConnRegistry(),
+		events:       newEventStream(),
+		dnsRetries:   newDNSRetryLimiter(c),
+		history:      newDeliveryHistory(c),
+		tlsReports:   newTLSReportCollector(),
+		pause:        newPauseGate(),
+		blocklists:   newBlocklistMonitor(),
+		verbosity:    newVerbosityOverrides(),
+		captured:     NewCaptureStorage(),
+		identities:   newIdentitySet(c),
+		ipSlots:      newIPSlots(m),
+		bounceStats:  newBounceStats(),
+		webhooks:     newWebhookDispatcher(m),
+		cooldowns:    newCooldowns(m),
+		downgrades:   newDowngradeLog(),
+		connBuckets:  newConnBuckets(),
+		ages:         newAgeTracker(),
+		serverAddrs:  newServerAddrCache(),
+		hostLabels:   newHostLabels(c),
+		ingest:       newIngestPolicy(c),
+	}
 }
 
 // Mail queue managing the sending of messages to hosts.
 type Queue struct {
+	*shared
 	config     *Config
 	Storage    *Storage
 	log        *logrus.Entry
 	hosts      map[string]*Host
 	newMessage chan *Message
 	getStats   chan chan *QueueStatus
+	newConfig  chan *Config
 	stop       chan bool
+
+	lastMonitor time.Time
+
+	// Host labels of the queue lengths most recently recorded
+	lengthLabels map[string]bool
 }
 
-// Deliver the specified message to the appropriate host queue.
+// Remove duplicate recipients from the message. Addresses are compared in
+// their normalized form but the original address is kept for delivery.
+func (q *Queue) removeDuplicates(m *Message) {
+	var (
+		seen = make(map[string]bool)
+		to   = make([]string, 0, len(m.To))
+	)
+	for _, t := range m.To {
+		n := util.NormalizeAddress(t, q.config.Normalization)
+		if !seen[n] {
+			seen[n] = true
+			to = append(to, t)
+		}
+	}
+	m.To = to
+}
+
+// Determine which lane the message should be delivered through.
+func (q *Queue) lane(m *Message) string {
+	if q.config.LargeMessageSize > 0 {
+		size, err := q.Storage.MessageSize(m)
+		if err == nil && size > q.config.LargeMessageSize {
+			return laneLarge
+		}
+	}
+	return laneDefault
+}
+
+// Deliver the specified message to the appropriate host queue. The host name
+// is normalized to ensure that all messages for a domain share a queue. Each
+// lane for a host has its own queue.
 func (q *Queue) deliverMessage(m *Message) {
-	if _, ok := q.hosts[m.Host]; !ok {
-		q.hosts[m.Host] = NewHost(m.Host, q.Storage, q.config)
+	q.removeDuplicates(m)
+	var (
+		host = util.NormalizeDomain(m.Host)
+		lane = q.lane(m)
+		name = queueName(host, lane)
+	)
+	if _, ok := q.hosts[name]; !ok {
+		q.hosts[name] = newHost(host, lane, q.Storage, q.config, q.shared)
 	}
-	q.hosts[m.Host].Deliver(m)
+	q.ages.add(m)
+	q.hosts[name].Deliver(m)
 }
 
 // Generate stats for the queue. This is done by obtaining the information
@@ -38,6 +149,9 @@ func (q *Queue) stats(c chan *QueueStatus, startTime time.Time) {
 		s := &QueueStatus{
 			Uptime: int(time.Now().Sub(startTime) / time.Second),
 			Hosts:  map[string]*HostStatus{},
+			Tags:   q.tagStats.status(nil),
+			Age:    q.ageStatus(),
+			Pause:  q.pause.get(),
 		}
 		for n, h := range q.hosts {
 			s.Hosts[n] = h.Status()
@@ -47,12 +161,92 @@ func (q *Queue) stats(c chan *QueueStatus, startTime time.Time) {
 	}()
 }
 
-// Check for inactive host queues and shut them down.
+// Switch to the specified configuration and provide it to the host queues.
+// Deferred messages affected by the change are retried if configured.
+func (q *Queue) reload(c *Config) {
+	var (
+		old     = q.config
+		domains = changedDKIMDomains(old, c)
+	)
+	q.config = c
+	q.tagStats.setConfig(c)
+	q.dnsRetries.setConfig(c)
+	q.history.setConfig(c)
+	q.identities.setConfig(c)
+	q.hostLabels.setConfig(c)
+	q.ingest.setConfig(c)
+	resetDKIM()
+	for _, h := range q.hosts {
+		h.Reload(c)
+		if !c.RetryOnReload {
+			continue
+		}
+		if old.connectionChanged(c, h.host) {
+			h.retryDeferred(nil)
+		} else if len(domains) > 0 {
+			h.retryDeferred(domains)
+		}
+	}
+	q.log.Info("configuration reloaded")
+}
+
+// Update the gauges for the number of messages waiting in each host queue and
+// the age of queued messages. The lengths of queues sharing a label are
+// combined and the series for labels without a queue are removed.
+func (q *Queue) updateGauges() {
+	var (
+		active  = 0
+		lengths = make(map[string]int)
+	)
+	for _, h := range q.hosts {
+		s := h.Status()
+		if s.Active {
+			active++
+		}
+		lengths[h.hostLabel()] += s.Length
+	}
+	for l, n := range lengths {
+		q.metrics.SetGauge(metricQueueLength, float64(n), map[string]string{
+			labelHost: l,
+		})
+	}
+	for l := range q.lengthLabels {
+		if _, ok := lengths[l]; !ok {
+			deleteSeries(q.metrics, metricQueueLength, map[string]string{
+				labelHost: l,
+			})
+		}
+	}
+	q.lengthLabels = make(map[string]bool)
+	for l := range lengths {
+		q.lengthLabels[l] = true
+	}
+	q.metrics.SetGauge(metricActiveHosts, float64(active), nil)
+	a := q.ageStatus()
+	for quantile, v := range map[string]int{
+		"0.5":  a.P50,
+		"0.9":  a.P90,
+		"0.99": a.P99,
+		"1":    a.Max,
+	} {
+		q.metrics.SetGauge(metricQueueAge, float64(v), map[string]string{
+			labelQuantile: quantile,
+		})
+	}
+}
+
+// Check for inactive host queues and shut them down. The send rate of each
+// is removed from the metrics.
 func (q *Queue) checkForInactiveQueues() {
 	for n, h := range q.hosts {
 		if h.Idle() > time.Minute {
 			h.Stop()
 			delete(q.hosts, n)
+			if l, ok := q.hostLabels.label(h.host); ok {
+				deleteSeries(q.metrics, metricSendRate, map[string]string{
+					labelHost: l,
+				})
+			}
 		}
 	}
 }
@@ -71,8 +265,17 @@ loop:
 			q.deliverMessage(m)
 		case c := <-q.getStats:
 			q.stats(c, startTime)
+		case c := <-q.newConfig:
+			q.reload(c)
 		case <-ticker.C:
 			q.checkForInactiveQueues()
+			q.updateGauges()
+			q.sendTLSReports()
+			q.promoteColdMessages()
+			q.sendMonitorMessage()
+			q.checkBlocklists()
+			q.cooldowns.expire()
+			q.collectTombstones()
 		case <-q.stop:
 			break loop
 		}
@@ -85,25 +288,45 @@ loop:
 }
 
 // Create a new message queue. Any undelivered messages on disk will be added
-// to the appropriate queue.
+// to the appropriate queue and delivery will resume according to their retry
+// schedule. Messages that are already due are spread out according to the
+// recovery rate.
 func NewQueue(c *Config) (*Queue, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
 	q := &Queue{
+		shared:     newShared(c),
 		config:     c,
 		Storage:    NewStorage(c.Directory),
 		log:        logrus.WithField("context", "Queue"),
 		hosts:      make(map[string]*Host),
 		newMessage: make(chan *Message),
 		getStats:   make(chan chan *QueueStatus),
+		newConfig:  make(chan *Config),
 		stop:       make(chan bool),
 	}
-	messages, err := q.Storage.LoadMessages()
+	if err := q.Storage.indexColdMessages(); err != nil {
+		return nil, err
+	}
+	messages, err := q.Storage.loadMessagesConcurrently(c.RecoveryConcurrency)
 	if err != nil {
 		return nil, err
 	}
-	q.log.Infof("loaded %d message(s) from %s", len(messages), c.Directory)
-	for _, m := range messages {
+	var (
+		start = time.Now()
+		count = 0
+		due   = 0
+	)
+	for m := range messages {
+		if c.RecoveryRate > 0 && !m.NextAttempt.After(start) {
+			m.NextAttempt = start.Add(time.Duration(float64(due) / c.RecoveryRate * float64(time.Second)))
+			due++
+		}
 		q.deliverMessage(m)
+		count++
 	}
+	q.log.Infof("loaded %d message(s) from %s", count, c.Directory)
 	go q.run()
 	return q, nil
 }
@@ -115,9 +338,158 @@ func (q *Queue) Status() *QueueStatus {
 	return <-c
 }
 
+// Provide delivery counts for messages with tags matching the filter.
+func (q *Queue) TagStatus(filter map[string]string) []*TagStatus {
+	return q.tagStats.status(filter)
+}
+
+// Provide the backend used for recording metrics.
+func (q *Queue) Metrics() Metrics {
+	return q.metrics
+}
+
+// Provide the most recently observed capabilities of each host.
+func (q *Queue) Capabilities() map[string]*Capabilities {
+	return q.capabilities.all()
+}
+
+// Override the log level for the host, which takes effect before the next
+// message for the host is delivered. An empty level removes the override.
+func (q *Queue) SetVerbosity(host, level string) error {
+	return q.verbosity.set(host, level)
+}
+
+// Provide the log level overrides for each host.
+func (q *Queue) Verbosity() map[string]string {
+	return q.verbosity.all()
+}
+
+// Ensure that the sending identity a message is pinned to exists. Messages
+// that are not pinned to an identity (the name is empty) are always valid.
+func (q *Queue) CheckIdentity(name string) error {
+	return q.identities.check(name)
+}
+
+// Provide the number of bounced recipients for each reason.
+func (q *Queue) BounceStatus() map[string]int {
+	return q.bounceStats.all()
+}
+
+// Provide the messages retained for hosts configured to capture them.
+func (q *Queue) Captured() []CapturedMessage {
+	return q.captured.Messages()
+}
+
+// Discard the messages retained for hosts configured to capture them.
+func (q *Queue) ClearCaptured() {
+	q.captured.Clear()
+}
+
+// Provide the result of checking each source IP against each DNSBL.
+func (q *Queue) Blocklists() []*BlocklistStatus {
+	return q.blocklists.all()
+}
+
+// Provide information about each open connection to a mail server.
+func (q *Queue) Connections() []*ConnInfo {
+	return q.connections.all()
+}
+
+// Provide the active cooldowns for hosts and source IPs that were rate
+// limited.
+func (q *Queue) Cooldowns() []*Cooldown {
+	return q.cooldowns.all()
+}
+
+// Provide the TLS downgrades observed for each host.
+func (q *Queue) Downgrades() map[string]*DowngradeStatus {
+	return q.downgrades.all()
+}
+
+// Provide the most recent deliveries, oldest first.
+func (q *Queue) History() []*DeliveryRecord {
+	return q.history.all()
+}
+
+// Subscribe to delivery events. The channel must be passed to Unsubscribe once
+// events are no longer needed. Events are dropped if the channel's buffer is
+// full.
+func (q *Queue) Subscribe() <-chan *Event {
+	return q.events.subscribe()
+}
+
+// Cancel a subscription created with Subscribe.
+func (q *Queue) Unsubscribe(c <-chan *Event) {
+	q.events.unsubscribe(c)
+}
+
+// Deliver the specified message to the appropriate host queue. If the context
+// is cancelled before the queue accepts the message, the context's error is
+// returned.
+func (q *Queue) DeliverContext(ctx context.Context, m *Message) error {
+	select {
+	case q.newMessage <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Deliver the specified message to the appropriate host queue.
 func (q *Queue) Deliver(m *Message) {
-	q.newMessage <- m
+	q.DeliverContext(context.Background(), m)
+}
+
+// Deliver the specified message to the appropriate host queue and provide its
+// result once it reaches a terminal state, as with Host.DeliverWithResult.
+func (q *Queue) DeliverWithResult(m *Message) <-chan *DeliveryResult {
+	c := make(chan *DeliveryResult, 1)
+	m.result = c
+	q.Deliver(m)
+	return c
+}
+
+// Stop all hosts from attempting delivery until Resume is called. Messages
+// continue to be accepted and stored while the queue is paused.
+func (q *Queue) Pause(reason string) {
+	q.pause.pause(reason)
+	q.log.Warnf("delivery paused: %s", reason)
+}
+
+// Resume delivery after the queue was paused.
+func (q *Queue) Resume() {
+	q.pause.resume()
+	q.log.Info("delivery resumed")
+}
+
+// Write all messages in the queue to the specified writer as a tar archive.
+// Delivery continues during the export.
+func (q *Queue) Export(w io.Writer) error {
+	return q.Storage.Export(w)
+}
+
+// Load messages from an archive created with Export and deliver them.
+func (q *Queue) Import(r io.Reader) error {
+	messages, err := q.Storage.Import(r, q.config.ImportPolicy)
+	if err != nil {
+		return err
+	}
+	q.log.Infof("imported %d message(s)", len(messages))
+	for _, m := range messages {
+		q.Deliver(m)
+	}
+	return nil
+}
+
+// Replace the configuration used by the queue. The storage directory cannot
+// be changed this way. The current configuration is kept if the new one
+// cannot be loaded.
+func (q *Queue) Reload(c *Config) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+	q.newConfig <- c
+	return nil
 }
 
 // Stop all active host queues.
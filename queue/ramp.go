@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"math"
+	"time"
+)
+
+// Curves for increasing the message rate after a host recovers.
+const (
+	RampLinear      = "linear"
+	RampExponential = "exponential"
+)
+
+// Gradual increase of a host's message rate after it recovers from deferring
+// every message, which avoids tripping rate-based blocking by releasing the
+// backlog at full speed.
+type RateRamp struct {
+	// Number of consecutive deferrals after which a successful delivery is
+	// treated as a recovery (defaults to 3)
+	Deferrals int `json:"deferrals"`
+
+	// Fraction of the message rate used once the host recovers (defaults to
+	// 0.1)
+	Initial float64 `json:"initial"`
+
+	// Amount added to (linear) or multiplying (exponential) the fraction
+	// after each successful delivery (defaults to 0.1 and 2)
+	Step float64 `json:"step"`
+
+	// Curve used for the increase (defaults to linear)
+	Curve string `json:"curve"`
+}
+
+// Determine the fraction of the message rate used after the specified number
+// of successful deliveries since the host recovered.
+func (r *RateRamp) fraction(successes int) float64 {
+	initial := r.Initial
+	if initial <= 0 {
+		initial = 0.1
+	}
+	var f float64
+	switch r.Curve {
+	case RampExponential:
+		step := r.Step
+		if step <= 1 {
+			step = 2
+		}
+		f = initial * math.Pow(step, float64(successes))
+	default:
+		step := r.Step
+		if step <= 0 {
+			step = 0.1
+		}
+		f = initial + step*float64(successes)
+	}
+	return math.Min(f, 1)
+}
+
+// State of the ramp for a host queue.
+type rampState struct {
+	deferrals int
+	ramping   bool
+	successes int
+	lastSend  time.Time
+}
+
+// Determine the number of messages per second that may currently be sent to
+// the host or zero if the rate is unlimited.
+func (h *Host) effectiveRate() float64 {
+	hostConfig := h.config.hostConfig(h.host)
+	if hostConfig.MessageRate <= 0 {
+		return 0
+	}
+	if hostConfig.RateRamp == nil || !h.ramp.ramping {
+		return hostConfig.MessageRate
+	}
+	return hostConfig.MessageRate * hostConfig.RateRamp.fraction(h.ramp.successes)
+}
+
+// Update the ramp with the outcome of a delivery attempt and record the
+// effective rate unless the host shares its label with other hosts, whose
+// rates cannot be combined.
+func (h *Host) updateRamp(result string) {
+	hostConfig := h.config.hostConfig(h.host)
+	if hostConfig.RateRamp == nil {
+		// The ramp may have been removed by a reload while ramping
+		h.ramp.ramping = false
+		h.ramp.successes = 0
+	}
+	switch result {
+	case resultDeferred:
+		h.ramp.deferrals++
+		h.ramp.ramping = false
+	case resultDelivered:
+		threshold := 3
+		if r := hostConfig.RateRamp; r != nil && r.Deferrals > 0 {
+			threshold = r.Deferrals
+		}
+		switch {
+		case h.ramp.deferrals >= threshold && hostConfig.RateRamp != nil:
+			h.log.Info("host recovered, ramping up message rate")
+			h.ramp.ramping = true
+			h.ramp.successes = 0
+		case h.ramp.ramping:
+			h.ramp.successes++
+			if hostConfig.RateRamp.fraction(h.ramp.successes) >= 1 {
+				h.ramp.ramping = false
+			}
+		}
+		h.ramp.deferrals = 0
+	default:
+		return
+	}
+	if l, ok := h.hostLabels.label(h.host); ok {
+		h.metrics.SetGauge(metricSendRate, h.effectiveRate(), map[string]string{
+			labelHost: l,
+		})
+	}
+}
+
+// Wait until the next message may be sent according to the effective rate.
+// False is returned if the host queue was shut down while waiting.
+func (h *Host) waitToSend() bool {
+	if rate := h.effectiveRate(); rate > 0 {
+		interval := time.Duration(float64(time.Second) / rate)
+		if d := interval - time.Since(h.ramp.lastSend); d > 0 {
+			h.log.Debugf("waiting %s before sending", d)
+			if !h.sleep(d) {
+				return false
+			}
+		}
+	}
+	h.ramp.lastSend = time.Now()
+	return true
+}
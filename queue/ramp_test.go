@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"testing"
+)
+
+func TestRateRampFraction(t *testing.T) {
+	for _, v := range []struct {
+		ramp      RateRamp
+		successes int
+		fraction  float64
+	}{
+		{RateRamp{}, 0, 0.1},
+		{RateRamp{}, 4, 0.5},
+		{RateRamp{}, 20, 1},
+		{RateRamp{Initial: 0.25, Curve: RampExponential}, 1, 0.5},
+		{RateRamp{Initial: 0.25, Curve: RampExponential}, 3, 1},
+	} {
+		if f := v.ramp.fraction(v.successes); f < v.fraction-1e-9 || f > v.fraction+1e-9 {
+			t.Fatalf("%f != %f", f, v.fraction)
+		}
+	}
+}
+
+func TestRateRampRemoved(t *testing.T) {
+	c := &Config{
+		Hosts: map[string]*HostConfig{
+			"example.com": {MessageRate: 10, RateRamp: &RateRamp{}},
+		},
+	}
+	h := &Host{
+		shared: newShared(c),
+		config: c,
+		host:   "example.com",
+		log:    logrus.WithField("context", "example.com"),
+	}
+	for i := 0; i < 3; i++ {
+		h.updateRamp(resultDeferred)
+	}
+	h.updateRamp(resultDelivered)
+	if r := h.effectiveRate(); r != 1 {
+		t.Fatalf("%f != 1", r)
+	}
+	h.config = &Config{
+		Hosts: map[string]*HostConfig{
+			"example.com": {MessageRate: 10},
+		},
+	}
+	h.updateRamp(resultDelivered)
+	if h.ramp.ramping {
+		t.Fatal("ramp was not reset")
+	}
+	if r := h.effectiveRate(); r != 10 {
+		t.Fatalf("%f != 10", r)
+	}
+}
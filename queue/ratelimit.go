@@ -0,0 +1,232 @@
+package queue
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scopes of the cooldown that begins when a mail server indicates that it is
+// rate limiting the source IP: either all delivery to the host is deferred or
+// all delivery using the source IP is.
+const (
+	RateLimitHost     = "host"
+	RateLimitSourceIP = "source-ip"
+)
+
+// Patterns (case-insensitive regular expressions) matching replies that
+// indicate the source IP rather than the message is being rate limited,
+// checked after any in the configuration.
+var defaultRateLimitPatterns = []string{
+	`4\.7\.28`,
+	`4\.7\.650`,
+	`\[TSS?0[1-4]\]`,
+	`rate[ -]limit(ed|ing)?\b.*\b(ip|address)\b`,
+	`\b(ip|address)\b.*\brate[ -]limit`,
+	`too many (connections|messages) from`,
+}
+
+// Cooldown during which delivery is deferred after a mail server for the
+// host rate limited the source IP.
+type Cooldown struct {
+	Scope    string    `json:"scope"`
+	Host     string    `json:"host"`
+	SourceIP string    `json:"source-ip"`
+	Reply    string    `json:"reply"`
+	Until    time.Time `json:"until"`
+}
+
+// Error indicating that delivery was deferred until the cooldown ends.
+type cooldownError struct {
+	cooldown *Cooldown
+}
+
+func (c *cooldownError) Error() string {
+	if c.cooldown.Scope == RateLimitSourceIP {
+		return fmt.Sprintf("source IP is rate limited until %s", c.cooldown.Until.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("host is rate limited until %s", c.cooldown.Until.Format(time.RFC3339))
+}
+
+func (c *Config) rateLimitCooldown() time.Duration {
+	return time.Duration(c.RateLimitCooldown) * time.Second
+}
+
+func (c *Config) rateLimitScope() string {
+	if c.RateLimitScope == "" {
+		return RateLimitHost
+	}
+	return c.RateLimitScope
+}
+
+// Determine if the error is a transient reply indicating that the source IP
+// is being rate limited, providing the reply if so.
+func (c *Config) rateLimitReply(err error) (string, bool) {
+	if p, ok := err.(*partialError); ok {
+		err = p.err
+	}
+	e, ok := err.(*textproto.Error)
+	if !ok || e.Code < 400 || e.Code > 499 {
+		return "", false
+	}
+	reply := fmt.Sprintf("%d %s", e.Code, e.Msg)
+	for _, p := range append(append([]string{}, c.RateLimitPatterns...), defaultRateLimitPatterns...) {
+		if r := bounceRegexp(p); r != nil && r.MatchString(e.Msg) {
+			return reply, true
+		}
+	}
+	return "", false
+}
+
+// Active cooldowns for hosts and source IPs. All methods are safe to call from
+// multiple goroutines.
+type cooldowns struct {
+	m         sync.Mutex
+	metrics   Metrics
+	cooldowns map[string]*Cooldown
+}
+
+// Create an empty set of cooldowns.
+func newCooldowns(m Metrics) *cooldowns {
+	return &cooldowns{
+		metrics:   m,
+		cooldowns: make(map[string]*Cooldown),
+	}
+}
+
+// Key used for the cooldown of the host or source IP in the scope.
+func cooldownKey(scope, name string) string {
+	return scope + ":" + name
+}
+
+// Update the gauge for the number of cooldowns in each scope. The mutex must
+// be held.
+func (c *cooldowns) updateGauges() {
+	counts := map[string]int{
+		RateLimitHost:     0,
+		RateLimitSourceIP: 0,
+	}
+	for _, v := range c.cooldowns {
+		counts[v.Scope]++
+	}
+	for scope, n := range counts {
+		c.metrics.SetGauge(metricCooldowns, float64(n), map[string]string{
+			labelScope: scope,
+		})
+	}
+}
+
+// Begin the cooldown, extending any that is already active.
+func (c *cooldowns) start(v *Cooldown) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	name := v.Host
+	if v.Scope == RateLimitSourceIP {
+		name = v.SourceIP
+	}
+	c.cooldowns[cooldownKey(v.Scope, name)] = v
+	c.updateGauges()
+}
+
+// Provide the active cooldown for the host or source IP in the scope, if any.
+// A cooldown that has ended is removed.
+func (c *cooldowns) get(scope, name string) *Cooldown {
+	c.m.Lock()
+	defer c.m.Unlock()
+	key := cooldownKey(scope, name)
+	v, ok := c.cooldowns[key]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(v.Until) {
+		delete(c.cooldowns, key)
+		c.updateGauges()
+		return nil
+	}
+	return v
+}
+
+// Remove cooldowns that have ended.
+func (c *cooldowns) expire() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := time.Now()
+	for k, v := range c.cooldowns {
+		if !now.Before(v.Until) {
+			delete(c.cooldowns, k)
+		}
+	}
+	c.updateGauges()
+}
+
+// Provide the active cooldowns, ending soonest first.
+func (c *cooldowns) all() []*Cooldown {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var (
+		now = time.Now()
+		all = []*Cooldown{}
+	)
+	for _, v := range c.cooldowns {
+		if now.Before(v.Until) {
+			s := *v
+			all = append(all, &s)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Until.Before(all[j].Until)
+	})
+	return all
+}
+
+// Begin a cooldown if the error indicates that the mail server is rate
+// limiting the source IP and cooldowns are enabled.
+func (h *Host) checkRateLimit(err error, sourceIP string) {
+	d := h.config.rateLimitCooldown()
+	if d == 0 {
+		return
+	}
+	reply, ok := h.config.rateLimitReply(err)
+	if !ok {
+		return
+	}
+	v := &Cooldown{
+		Scope:    h.config.rateLimitScope(),
+		Host:     h.host,
+		SourceIP: sourceIP,
+		Reply:    reply,
+		Until:    time.Now().Add(d),
+	}
+	h.log.Warnf("rate limited by mail server, deferring delivery for %s", d)
+	h.metrics.IncCounter(metricRateLimits, map[string]string{
+		labelHost:  h.hostLabel(),
+		labelScope: v.Scope,
+	})
+	h.cooldowns.start(v)
+}
+
+// Determine if delivery to the host is deferred because of a cooldown.
+func (h *Host) hostCooldown() error {
+	if v := h.cooldowns.get(RateLimitHost, h.host); v != nil {
+		return &cooldownError{v}
+	}
+	return nil
+}
+
+// Determine if delivery using the source IP is deferred because of a
+// cooldown.
+func (h *Host) sourceIPCooldown(ip string) *Cooldown {
+	return h.cooldowns.get(RateLimitSourceIP, ip)
+}
+
+// Determine if the error deferred the message without a mail server being
+// contacted, either because of a cooldown or because every source IP is
+// blocklisted. Such deferrals are not counted as delivery attempts.
+func isLocalDeferral(err error) bool {
+	if _, ok := err.(*cooldownError); ok {
+		return true
+	}
+	return err == errBlocklisted
+}
@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"errors"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimitReply(t *testing.T) {
+	c := &Config{
+		RateLimitPatterns: []string{`slow down`},
+	}
+	for _, v := range []struct {
+		err     error
+		limited bool
+	}{
+		{&textproto.Error{Code: 421, Msg: "4.7.28 unusual rate of mail originating from your IP address"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.7.650 the mail server has been temporarily rate limited due to IP reputation"}, true},
+		{&textproto.Error{Code: 421, Msg: "4.7.0 [TSS04] messages temporarily deferred"}, true},
+		{&textproto.Error{Code: 450, Msg: "slow down"}, true},
+		{&partialError{1, &textproto.Error{Code: 421, Msg: "too many connections from 192.0.2.1"}}, true},
+		{&textproto.Error{Code: 450, Msg: "mailbox busy"}, false},
+		{&textproto.Error{Code: 550, Msg: "5.7.28 unusual rate of mail originating from your IP address"}, false},
+		{errors.New("rate limited"), false},
+	} {
+		if _, limited := c.rateLimitReply(v.err); limited != v.limited {
+			t.Fatalf("%s: %t != %t", v.err, limited, v.limited)
+		}
+	}
+}
+
+func TestCooldowns(t *testing.T) {
+	var (
+		c   = newCooldowns(nopMetrics{})
+		now = time.Now()
+	)
+	c.start(&Cooldown{Scope: RateLimitHost, Host: "example.com", Until: now.Add(time.Hour)})
+	c.start(&Cooldown{Scope: RateLimitSourceIP, SourceIP: "192.0.2.1", Until: now.Add(time.Minute)})
+	c.start(&Cooldown{Scope: RateLimitSourceIP, SourceIP: "192.0.2.2", Until: now.Add(-time.Minute)})
+	if c.get(RateLimitHost, "example.com") == nil {
+		t.Fatal("host cooldown not active")
+	}
+	if c.get(RateLimitSourceIP, "example.com") != nil {
+		t.Fatal("host cooldown applied to source IP")
+	}
+	if c.get(RateLimitSourceIP, "192.0.2.2") != nil {
+		t.Fatal("cooldown active after it ended")
+	}
+	all := c.all()
+	if len(all) != 2 || all[0].SourceIP != "192.0.2.1" {
+		t.Fatalf("unexpected cooldowns: %v", all)
+	}
+}
+
+func TestSelectSourceIPCooldown(t *testing.T) {
+	var (
+		c = &Config{
+			Tiers: map[string][]string{
+				"bulk": {"192.0.2.1", "192.0.2.2"},
+			},
+		}
+		h = &Host{
+			shared: newShared(c),
+			config: c,
+			log:    logrus.WithField("context", "test"),
+		}
+		until = time.Now().Add(time.Hour)
+	)
+	h.cooldowns.start(&Cooldown{Scope: RateLimitSourceIP, SourceIP: "192.0.2.1", Until: until})
+	for i := 0; i < 2; i++ {
+		if ip, err := h.selectSourceIP("bulk"); err != nil || ip != "192.0.2.2" {
+			t.Fatalf("%s, %v", ip, err)
+		}
+	}
+	h.cooldowns.start(&Cooldown{Scope: RateLimitSourceIP, SourceIP: "192.0.2.2", Until: until.Add(-time.Minute)})
+	_, err := h.selectSourceIP("bulk")
+	e, ok := err.(*cooldownError)
+	if !ok || e.cooldown.SourceIP != "192.0.2.2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCooldownNotAttempt(t *testing.T) {
+	srv, err := newMockServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		metrics = &resultMetrics{make(chan string, 2)}
+		c       = &Config{
+			Directory: d,
+			Metrics:   metrics,
+			Hosts: map[string]*HostConfig{
+				"example.com": {Servers: []string{srv.l.Addr().String()}},
+			},
+		}
+		s = NewStorage(d)
+		m = &Message{
+			Host: "example.com",
+			From: "me@example.org",
+			To:   []string{"you@example.com"},
+		}
+	)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	sh := newShared(c)
+	sh.cooldowns.start(&Cooldown{
+		Scope: RateLimitHost,
+		Host:  "example.com",
+		Until: time.Now().Add(100 * time.Millisecond),
+	})
+	h := newHost(m.Host, laneDefault, s, c, sh)
+	defer h.Stop()
+	result := h.DeliverWithResult(m)
+	select {
+	case r := <-result:
+		if r.Outcome != OutcomeDelivered {
+			t.Fatalf("%s != %s", r.Outcome, OutcomeDelivered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	if r := <-metrics.results; r != resultDelivered {
+		t.Fatalf("%s != %s", r, resultDelivered)
+	}
+	if m.Attempts != 0 {
+		t.Fatalf("%d != 0", m.Attempts)
+	}
+}
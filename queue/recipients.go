@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"fmt"
+)
+
+// Error indicating that the message was delivered to some recipients but
+// delivery to others was deferred.
+type partialError struct {
+	deferred int
+	err      error
+}
+
+func (p *partialError) Error() string {
+	return fmt.Sprintf("delivery to %d recipient(s) deferred: %s", p.deferred, p.err)
+}
+
+// Error indicating that a recipient was not accepted because of the policy
+// for the server's reply.
+type recipientError struct {
+	to   string
+	code int
+}
+
+func (r *recipientError) Error() string {
+	return fmt.Sprintf("%s not accepted: server replied %d", r.to, r.code)
+}
+
+// Determine the policy for a successful reply to RCPT.
+func (h *Host) recipientPolicy(code int) string {
+	var (
+		hostConfig = h.config.hostConfig(h.host)
+		policy     string
+	)
+	switch code {
+	case 251:
+		policy = hostConfig.ForwardedRecipientPolicy
+	case 252:
+		policy = hostConfig.UnverifiedRecipientPolicy
+	}
+	if policy == "" {
+		policy = RecipientAccept
+	}
+	return policy
+}
+
+// Begin a new transaction for the accepted recipients. This is necessary when
+// the server accepted recipients that were excluded by policy, since they
+// would otherwise receive the message.
+func (h *Host) restartTransaction(c *connection, m *Message, accepted []string) error {
+	if err := c.Reset(); err != nil {
+		return err
+	}
+	if err := c.Mail(h.envelopeSender(m)); err != nil {
+		return err
+	}
+	for _, t := range accepted {
+		code, err := c.rcpt(t)
+		if err != nil {
+			return err
+		}
+		if h.recipientPolicy(code) != RecipientAccept {
+			return &recipientError{t, code}
+		}
+	}
+	return nil
+}
+
+// Remove recipients that accepted or permanently rejected the message so that
+// only those still awaiting delivery remain. The change is saved so that the
+// recipients are not attempted again after a restart.
+func (h *Host) settleRecipients(m *Message, delivered, bounced []string) {
+	if len(delivered) == 0 && len(bounced) == 0 {
+		return
+	}
+	settled := make(map[string]bool)
+	for _, t := range append(append([]string{}, delivered...), bounced...) {
+		settled[t] = true
+	}
+	to := make([]string, 0, len(m.To))
+	for _, t := range m.To {
+		if !settled[t] {
+			to = append(to, t)
+		}
+	}
+	m.To = to
+	m.Delivered = append(m.Delivered, delivered...)
+	m.Bounced = append(m.Bounced, bounced...)
+	if err := h.storage.UpdateMessage(m); err != nil {
+		h.log.Error(err.Error())
+	}
+}
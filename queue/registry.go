@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Information about an open connection to a mail server.
+type ConnInfo struct {
+	Host      string    `json:"host"`
+	Server    string    `json:"server"`
+	Tier      string    `json:"tier"`
+	Opened    time.Time `json:"opened"`
+	Active    bool      `json:"active"`
+	Delivered int       `json:"delivered"`
+	TLS       *TLSInfo  `json:"tls"`
+
+	// Maximum number of messages delivered before the connection is closed
+	// (unlimited if zero)
+	MaxMessages int `json:"max-messages"`
+}
+
+// Registry of open connections. All methods are safe to call from multiple
+// goroutines.
+type connRegistry struct {
+	m     sync.Mutex
+	next  int
+	conns map[int]*ConnInfo
+}
+
+// Create a new registry.
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[int]*ConnInfo),
+	}
+}
+
+// Add a connection to the registry and return its ID.
+func (r *connRegistry) add(info *ConnInfo) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.next++
+	r.conns[r.next] = info
+	return r.next
+}
+
+// Modify the information for the connection.
+func (r *connRegistry) update(id int, fn func(*ConnInfo)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if info, ok := r.conns[id]; ok {
+		fn(info)
+	}
+}
+
+// Remove the connection from the registry.
+func (r *connRegistry) remove(id int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.conns, id)
+}
+
+// Provide a copy of the information for each connection, ordered by host and
+// the time the connection was opened.
+func (r *connRegistry) all() []*ConnInfo {
+	r.m.Lock()
+	defer r.m.Unlock()
+	conns := make([]*ConnInfo, 0, len(r.conns))
+	for _, info := range r.conns {
+		i := *info
+		conns = append(conns, &i)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].Host != conns[j].Host {
+			return conns[i].Host < conns[j].Host
+		}
+		return conns[i].Opened.Before(conns[j].Opened)
+	})
+	return conns
+}
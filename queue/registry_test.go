@@ -0,0 +1,22 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestConnRegistry(t *testing.T) {
+	r := newConnRegistry()
+	a := r.add(&ConnInfo{Host: "b.example.com"})
+	r.add(&ConnInfo{Host: "a.example.com"})
+	r.update(a, func(info *ConnInfo) {
+		info.Delivered++
+	})
+	conns := r.all()
+	if len(conns) != 2 || conns[0].Host != "a.example.com" || conns[1].Delivered != 1 {
+		t.Fatalf("unexpected connections: %v", conns)
+	}
+	r.remove(a)
+	if n := len(r.all()); n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+}
@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"reflect"
+	"time"
+)
+
+// Determine which sender domains have a DKIM configuration that differs
+// between the configurations.
+func changedDKIMDomains(c, o *Config) map[string]bool {
+	domains := make(map[string]bool)
+	for d, v := range c.DKIMConfigs {
+		if w, ok := o.DKIMConfigs[d]; !ok || !reflect.DeepEqual(v, w) {
+			domains[d] = true
+		}
+	}
+	for d := range o.DKIMConfigs {
+		if _, ok := c.DKIMConfigs[d]; !ok {
+			domains[d] = true
+		}
+	}
+	return domains
+}
+
+// Requests are forgotten after this long, by which time every message
+// deferred before them has been retried.
+const retryRequestLifetime = 24 * time.Hour
+
+// Request to retry the messages deferred before a configuration change. If
+// domains is nil, every such message is retried, otherwise only those from
+// senders in the domains are.
+type retryRequest struct {
+	at      time.Time
+	domains map[string]bool
+}
+
+// Determine if the request applies to the message.
+func (r *retryRequest) matches(m *Message) bool {
+	if !m.deferred.Before(r.at) {
+		return false
+	}
+	if r.domains == nil {
+		return true
+	}
+	domain, err := senderDomain(m.From)
+	return err == nil && r.domains[domain]
+}
+
+// Request that messages deferred before now are retried immediately. If
+// domains is nil, every such message is retried, otherwise only those from
+// senders in the domains are. Each request keeps its own scope so that a
+// later, narrower request does not retry messages that an earlier one
+// already covered. Scheduled messages are released as well.
+func (h *Host) retryDeferred(domains map[string]bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	now := time.Now()
+	retries := []*retryRequest{}
+	for _, r := range h.retries {
+		if now.Sub(r.at) < retryRequestLifetime {
+			retries = append(retries, r)
+		}
+	}
+	h.retries = append(retries, &retryRequest{now, domains})
+	h.releaseRetries()
+	select {
+	case h.retry <- true:
+	default:
+	}
+}
+
+// Determine if the message should be retried immediately because it was
+// deferred before a configuration change that affects it.
+func (h *Host) shouldRetry(m *Message) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.retryMatches(m)
+}
+
+// Determine if the message is affected by any retry request made after it was
+// deferred. The mutex must be held.
+func (h *Host) retryMatches(m *Message) bool {
+	for _, r := range h.retries {
+		if r.matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait for the specified duration before the next attempt to deliver the
+// message, returning early if a configuration change means the message should
+// be retried. False is returned if the host queue was shut down.
+func (h *Host) sleepUntilRetry(m *Message, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		if h.shouldRetry(m) {
+			h.log.Info("retrying message after configuration change")
+			return true
+		}
+		select {
+		case <-t.C:
+			return true
+		case <-h.retry:
+		case <-h.stop:
+			return false
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDeferred(t *testing.T) {
+	var (
+		h = &Host{
+			retry:     make(chan bool, 1),
+			scheduled: make(map[*Message]*time.Timer),
+		}
+		before = &Message{
+			From:     "me@example.com",
+			deferred: time.Now().Add(-time.Minute),
+		}
+		other = &Message{
+			From:     "me@example.org",
+			deferred: time.Now().Add(-time.Minute),
+		}
+	)
+	if h.shouldRetry(before) {
+		t.Fatal("retry before reload")
+	}
+	h.retryDeferred(map[string]bool{"example.com": true})
+	if !h.shouldRetry(before) {
+		t.Fatal("affected message not retried")
+	}
+	if h.shouldRetry(other) {
+		t.Fatal("unaffected message retried")
+	}
+	after := &Message{
+		From:     "me@example.com",
+		deferred: time.Now().Add(time.Minute),
+	}
+	if h.shouldRetry(after) {
+		t.Fatal("message deferred after reload retried")
+	}
+	h.retryDeferred(nil)
+	if !h.shouldRetry(other) {
+		t.Fatal("message not retried")
+	}
+	other.deferred = time.Now()
+	h.retryDeferred(map[string]bool{"example.com": true})
+	if h.shouldRetry(other) {
+		t.Fatal("earlier reload retried message deferred after it")
+	}
+}
+
+func TestChangedDKIMDomains(t *testing.T) {
+	var (
+		c = &Config{
+			DKIMConfigs: map[string]DKIMConfig{
+				"example.com": {Selector: "a"},
+				"example.org": {Selector: "a"},
+			},
+		}
+		o = &Config{
+			DKIMConfigs: map[string]DKIMConfig{
+				"example.com": {Selector: "a"},
+				"example.org": {Selector: "b"},
+				"example.net": {Selector: "a"},
+			},
+		}
+	)
+	d := changedDKIMDomains(c, o)
+	if len(d) != 2 || !d["example.org"] || !d["example.net"] {
+		t.Fatalf("unexpected domains: %v", d)
+	}
+}
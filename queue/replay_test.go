@@ -0,0 +1,323 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Scripted conversation with a mail server and the outcomes it is expected to
+// produce. Replies are keyed by command ("greeting" and "body" are used for
+// the banner and the reply to the message body) and each list is consumed in
+// order across connections, with the last reply repeated once the others are
+// exhausted. The special reply "close" drops the connection. Delays lists the
+// attempt numbers for which a retry was scheduled. Received lists the
+// recipients the server accepted the message for in the order they were
+// accepted and Bounced lists the recipients that rejected it. Outcome is the
+// terminal outcome provided to the caller, if one is expected. Forwarded and
+// Unverified list the recipients recorded in the delivery history as accepted
+// with a 251 or 252 reply.
+type scenario struct {
+	Name     string              `json:"name"`
+	Host     HostConfig          `json:"host"`
+	Message  Message             `json:"message"`
+	Replies  map[string][]string `json:"replies"`
+	Results  []string            `json:"results"`
+	Delays   []int               `json:"delays"`
+	Received []string            `json:"received"`
+	Bounced  []string            `json:"bounced"`
+	Outcome  string              `json:"outcome"`
+
+	Forwarded  []string `json:"forwarded"`
+	Unverified []string `json:"unverified"`
+}
+
+// Replies used for commands not present in a scenario.
+var defaultReplies = map[string]string{
+	"greeting": "220 mock",
+	"EHLO":     "250 mock",
+	"HELO":     "250 mock",
+	"MAIL":     "250 OK",
+	"RCPT":     "250 OK",
+	"DATA":     "354 go ahead",
+	"body":     "250 OK",
+	"RSET":     "250 OK",
+	"NOOP":     "250 OK",
+	"QUIT":     "221 bye",
+}
+
+// Mail server that replies to commands according to a script.
+type mockServer struct {
+	m        sync.Mutex
+	l        net.Listener
+	replies  map[string][]string
+	received []string
+}
+
+// Start a mock server with the specified replies.
+func newMockServer(replies map[string][]string) (*mockServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &mockServer{
+		l:        l,
+		replies:  make(map[string][]string),
+		received: []string{},
+	}
+	for k, v := range replies {
+		s.replies[k] = append([]string{}, v...)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// Determine the next reply for the command.
+func (s *mockServer) reply(cmd string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r, ok := s.replies[cmd]
+	if !ok || len(r) == 0 {
+		if d, ok := defaultReplies[cmd]; ok {
+			return d
+		}
+		return "500 unrecognized command"
+	}
+	if len(r) > 1 {
+		s.replies[cmd] = r[1:]
+	}
+	return r[0]
+}
+
+// Carry out a session with a client.
+func (s *mockServer) serve(conn net.Conn) {
+	defer conn.Close()
+	t := textproto.NewConn(conn)
+	send := func(cmd string) (string, bool) {
+		r := s.reply(cmd)
+		if r == "close" {
+			return r, false
+		}
+		return r, t.PrintfLine("%s", r) == nil
+	}
+	if _, ok := send("greeting"); !ok {
+		return
+	}
+	var rcpts []string
+	for {
+		line, err := t.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		r, ok := send(cmd)
+		if !ok || cmd == "QUIT" {
+			return
+		}
+		switch cmd {
+		case "MAIL", "RSET":
+			rcpts = nil
+		case "RCPT":
+			if strings.HasPrefix(r, "25") {
+				rcpts = append(rcpts, strings.Trim(line[strings.Index(line, ":")+1:], "<>"))
+			}
+		case "DATA":
+			if !strings.HasPrefix(r, "354") {
+				continue
+			}
+			if _, err := t.ReadDotLines(); err != nil {
+				return
+			}
+			r, ok := send("body")
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(r, "250") {
+				s.m.Lock()
+				s.received = append(s.received, rcpts...)
+				s.m.Unlock()
+			}
+			rcpts = nil
+		}
+	}
+}
+
+// Stop accepting connections.
+func (s *mockServer) Close() {
+	s.l.Close()
+}
+
+// Metrics backend that provides the outcome of each delivery attempt.
+type resultMetrics struct {
+	results chan string
+}
+
+func (r *resultMetrics) IncCounter(name string, labels map[string]string) {
+	if name == metricMessages {
+		r.results <- labels[labelResult]
+	}
+}
+
+func (r *resultMetrics) ObserveHistogram(string, float64, map[string]string) {}
+func (r *resultMetrics) SetGauge(string, float64, map[string]string)         {}
+
+// Deliver a message to a mock server running the scenario and provide the
+// outcomes of the delivery attempts, the recipients the server received the
+// message for and the recipients that bounced.
+func runScenario(s *scenario) ([]string, []string, []string, error) {
+	srv, err := newMockServer(s.Replies)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer srv.Close()
+	results, bounced, err := deliverScenario(s, srv)
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	return results, srv.received, bounced, err
+}
+
+// Deliver the message in the scenario to the mock server.
+func deliverScenario(s *scenario, srv *mockServer) ([]string, []string, error) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(d)
+	var (
+		metrics = &resultMetrics{make(chan string, len(s.Results)+1)}
+		c       = &Config{
+			Directory: d,
+			Metrics:   metrics,
+			Hosts: map[string]*HostConfig{
+				"example.com": &s.Host,
+			},
+		}
+		storage = NewStorage(d)
+		m       = s.Message
+	)
+	c.Hosts["example.com"].Servers = []string{srv.l.Addr().String()}
+	w, body, err := storage.NewBody()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.Write([]byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	m.Host = "example.com"
+	m.From = "me@example.org"
+	if len(m.To) == 0 {
+		m.To = []string{"you@example.com"}
+	}
+	if err := storage.SaveMessage(&m, body); err != nil {
+		return nil, nil, err
+	}
+	h := newHost(m.Host, laneDefault, storage, c, newShared(c))
+	var (
+		result  = h.DeliverWithResult(&m)
+		results = []string{}
+	)
+	for len(results) < len(s.Results) {
+		select {
+		case r := <-metrics.results:
+			results = append(results, r)
+		case <-time.After(5 * time.Second):
+			h.Stop()
+			return results, nil, errors.New("timed out waiting for delivery")
+		}
+	}
+	h.Stop()
+	if s.Outcome != "" {
+		r, ok := <-result
+		if !ok {
+			return results, nil, errors.New("no result was provided")
+		}
+		if r.Outcome != s.Outcome {
+			return results, nil, fmt.Errorf("outcome %s != %s", r.Outcome, s.Outcome)
+		}
+	}
+	if s.Forwarded != nil || s.Unverified != nil {
+		var forwarded, unverified []string
+		for _, r := range h.history.all() {
+			forwarded = append(forwarded, r.Forwarded...)
+			unverified = append(unverified, r.Unverified...)
+		}
+		if !reflect.DeepEqual(forwarded, s.Forwarded) {
+			return results, nil, fmt.Errorf("forwarded %v != %v", forwarded, s.Forwarded)
+		}
+		if !reflect.DeepEqual(unverified, s.Unverified) {
+			return results, nil, fmt.Errorf("unverified %v != %v", unverified, s.Unverified)
+		}
+	}
+	return results, m.Bounced, nil
+}
+
+func TestScenarios(t *testing.T) {
+	r, err := os.Open("testdata/scenarios.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var scenarios []*scenario
+	if err := json.NewDecoder(r).Decode(&scenarios); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		m      sync.Mutex
+		delays []int
+	)
+	defer func(d func(int) time.Duration) {
+		retryDelay = d
+	}(retryDelay)
+	retryDelay = func(attempts int) time.Duration {
+		m.Lock()
+		defer m.Unlock()
+		delays = append(delays, attempts)
+		return time.Millisecond
+	}
+	for _, s := range scenarios {
+		m.Lock()
+		delays = []int{}
+		m.Unlock()
+		results, received, bounced, err := runScenario(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s.Name, err)
+		}
+		if !reflect.DeepEqual(results, s.Results) {
+			t.Fatalf("%s: %v != %v", s.Name, results, s.Results)
+		}
+		if s.Received != nil && !reflect.DeepEqual(received, s.Received) {
+			t.Fatalf("%s: received %v != %v", s.Name, received, s.Received)
+		}
+		if s.Bounced != nil && !reflect.DeepEqual(bounced, s.Bounced) {
+			t.Fatalf("%s: bounced %v != %v", s.Name, bounced, s.Bounced)
+		}
+		m.Lock()
+		if s.Delays == nil {
+			s.Delays = []int{}
+		}
+		if !reflect.DeepEqual(delays, s.Delays) {
+			t.Fatalf("%s: %v != %v", s.Name, delays, s.Delays)
+		}
+		m.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Find the sender of the most recent resent block in the message headers
+// (RFC 5322, section 3.6.6). Blocks are prepended to the message so the first
+// one found is the most recent. Resent-Sender takes precedence over
+// Resent-From within the block. An empty string is returned if the message
+// was not resent.
+func resentSender(r io.Reader) string {
+	var (
+		t            = textproto.NewReader(bufio.NewReader(r))
+		inBlock      bool
+		sender, from string
+	)
+	for {
+		line, err := t.ReadContinuedLine()
+		if err != nil || line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		var (
+			name  = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+			value = strings.TrimSpace(line[i+1:])
+		)
+		if !strings.HasPrefix(name, "Resent-") {
+			if inBlock {
+				break
+			}
+			continue
+		}
+		inBlock = true
+		switch name {
+		case "Resent-Sender":
+			sender = value
+		case "Resent-From":
+			from = value
+		}
+	}
+	if sender == "" {
+		sender = from
+	}
+	if sender == "" {
+		return ""
+	}
+	addrs, err := mail.ParseAddressList(sender)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].Address
+}
+
+// Determine the envelope sender for the message. If enabled, the sender of
+// the most recent resent block is used when present so that bounces for
+// forwarded mail are returned to the party that forwarded it.
+func (h *Host) envelopeSender(m *Message) string {
+	if !h.config.UseResentSender {
+		return m.From
+	}
+	r, err := h.storage.GetMessageBody(m)
+	if err != nil {
+		return m.From
+	}
+	defer r.Close()
+	if s := resentSender(r); s != "" {
+		return s
+	}
+	return m.From
+}
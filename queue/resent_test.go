@@ -0,0 +1,22 @@
+package queue
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResentSender(t *testing.T) {
+	data := []struct {
+		headers, sender string
+	}{
+		{"From: a@example.com\r\n\r\n", ""},
+		{"Resent-From: b@example.com\r\nFrom: a@example.com\r\n\r\n", "b@example.com"},
+		{"Resent-From: B <b@example.com>\r\nResent-Sender: c@example.com\r\nFrom: a@example.com\r\n\r\n", "c@example.com"},
+		{"Resent-From: d@example.com\r\nReceived: x\r\nResent-Sender: c@example.com\r\n\r\n", "d@example.com"},
+	}
+	for _, d := range data {
+		if s := resentSender(strings.NewReader(d.headers)); s != d.sender {
+			t.Fatalf("%s != %s", s, d.sender)
+		}
+	}
+}
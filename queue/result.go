@@ -0,0 +1,74 @@
+package queue
+
+// Terminal outcomes of a message.
+const (
+	OutcomeDelivered   = "delivered"
+	OutcomeBounced     = "bounced"
+	OutcomeExpired     = "expired"
+	OutcomeQuarantined = "quarantined"
+	OutcomeRemoved     = "removed"
+)
+
+// Outcome of a message once it has reached a terminal state. Error is the
+// last error encountered while delivering the message, if any, and
+// BounceReasons classifies the rejection of each bounced recipient.
+type DeliveryResult struct {
+	Outcome       string
+	Delivered     []string
+	Bounced       []string
+	BounceReasons map[string]string
+	Error         error
+}
+
+// Outcomes for results recorded before a message is removed from the queue.
+var cleanupOutcomes = map[string]string{
+	resultDelivered: OutcomeDelivered,
+	resultFailed:    OutcomeBounced,
+}
+
+// Register the channel for the message's result so that it can be closed if
+// the host queue is stopped before the message reaches a terminal state.
+func (h *Host) addPending(m *Message) {
+	if m.result == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.pending == nil {
+		h.pending = make(map[chan *DeliveryResult]bool)
+	}
+	h.pending[m.result] = true
+}
+
+// Provide the result to the caller waiting for the message, if any. The
+// channel is buffered so this never blocks and it is closed afterwards.
+func (h *Host) notify(m *Message, outcome string, err error) {
+	if m.result == nil {
+		return
+	}
+	if outcome == "" {
+		outcome = OutcomeRemoved
+	}
+	m.result <- &DeliveryResult{
+		Outcome:       outcome,
+		Delivered:     m.Delivered,
+		Bounced:       m.Bounced,
+		BounceReasons: m.BounceReasons,
+		Error:         err,
+	}
+	close(m.result)
+	h.m.Lock()
+	delete(h.pending, m.result)
+	h.m.Unlock()
+	m.result = nil
+}
+
+// Close the channels of messages that have not reached a terminal state.
+func (h *Host) closePending() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for c := range h.pending {
+		close(c)
+	}
+	h.pending = nil
+}
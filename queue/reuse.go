@@ -0,0 +1,18 @@
+package queue
+
+// Checks performed before an open connection is reused for another message.
+// The noop check issues NOOP and discards the connection unless the server
+// replies with 250, in case an earlier exchange left the session confused.
+const (
+	ReuseCheckOff  = "off"
+	ReuseCheckNoop = "noop"
+)
+
+// Ensure that the connection is still usable before delivering another
+// message over it, according to the host's policy.
+func (h *Host) checkReuse(c *connection) error {
+	if h.config.hostConfig(h.host).ReuseCheck != ReuseCheckNoop {
+		return nil
+	}
+	return c.Noop()
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckReuse(t *testing.T) {
+	srv, err := newMockServer(map[string][]string{
+		"NOOP": {"250 OK", "500 confused"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newConnection(conn, "localhost", 5*time.Second, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := &Host{
+		config: &Config{
+			Hosts: map[string]*HostConfig{
+				"example.com": {ReuseCheck: ReuseCheckNoop},
+			},
+		},
+		host: "example.com",
+	}
+	if err := h.checkReuse(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.checkReuse(c); err == nil {
+		t.Fatal("error expected")
+	}
+	h.config.Hosts["example.com"].ReuseCheck = ReuseCheckOff
+	if err := h.checkReuse(c); err != nil {
+		t.Fatal(err)
+	}
+}
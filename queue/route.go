@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"github.com/hectane/hectane/util"
+
+	"errors"
+)
+
+// Actions taken for hosts when neither their config nor DNS provides any
+// mail servers. Messages may be relayed through the default route's
+// servers, bounced (as they are without a default route) or discarded and
+// considered delivered.
+const (
+	RouteRelay     = "relay"
+	RouteBounce    = "bounce"
+	RouteBlackhole = "blackhole"
+)
+
+// Route used as a last resort for hosts after the servers in their config
+// and their MX records.
+type DefaultRoute struct {
+	Action  string   `json:"action"`
+	Servers []string `json:"servers"`
+}
+
+// Determine the action taken for hosts without mail servers. A relay without
+// any servers bounces messages like any unrecognized action.
+func (c *Config) defaultRouteAction() string {
+	if c.DefaultRoute == nil {
+		return RouteBounce
+	}
+	switch c.DefaultRoute.Action {
+	case RouteRelay:
+		if len(c.DefaultRoute.Servers) > 0 {
+			return RouteRelay
+		}
+	case RouteBlackhole:
+		return RouteBlackhole
+	}
+	return RouteBounce
+}
+
+// Determine if the server (specified by name, without a port) is one that the
+// default route relays through.
+func (c *Config) relayServer(server string) bool {
+	if c.defaultRouteAction() != RouteRelay {
+		return false
+	}
+	for _, s := range c.DefaultRoute.Servers {
+		if name, _, err := serverAddr(s); err == nil && name == server {
+			return true
+		}
+	}
+	return false
+}
+
+var errDiscardedRoute = errors.New("host has no mail servers, discarding message")
+
+// Determine the servers used for the host after DNS found none, according to
+// the default route. No servers are provided if messages should bounce and
+// errDiscardedRoute is returned if they should be discarded. Domains that
+// publish a null MX record explicitly accept no mail, so messages to them
+// always bounce.
+func (h *Host) defaultRouteServers() ([]string, error) {
+	action := h.config.defaultRouteAction()
+	if action == RouteBounce {
+		return []string{}, nil
+	}
+	host, err := toASCII(h.host)
+	if err != nil {
+		return nil, err
+	}
+	null, err := util.IsNullMX(host)
+	if err != nil {
+		return nil, err
+	}
+	if null {
+		return []string{}, nil
+	}
+	if action == RouteBlackhole {
+		return nil, errDiscardedRoute
+	}
+	return h.config.DefaultRoute.Servers, nil
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestDefaultRouteAction(t *testing.T) {
+	for _, v := range []struct {
+		route  *DefaultRoute
+		action string
+	}{
+		{nil, RouteBounce},
+		{&DefaultRoute{Action: RouteRelay, Servers: []string{"relay.example.com"}}, RouteRelay},
+		{&DefaultRoute{Action: RouteRelay}, RouteBounce},
+		{&DefaultRoute{Action: RouteBlackhole}, RouteBlackhole},
+		{&DefaultRoute{Action: "unknown"}, RouteBounce},
+	} {
+		c := &Config{DefaultRoute: v.route}
+		if a := c.defaultRouteAction(); a != v.action {
+			t.Fatalf("%s != %s", a, v.action)
+		}
+	}
+}
+
+func TestRelayServer(t *testing.T) {
+	c := &Config{
+		DefaultRoute: &DefaultRoute{
+			Action:  RouteRelay,
+			Servers: []string{"relay.example.com", "relay.internal:2525"},
+		},
+	}
+	for _, server := range []string{"relay.example.com", "relay.internal"} {
+		if !c.relayServer(server) {
+			t.Fatalf("%s: relay server not recognized", server)
+		}
+	}
+	if c.relayServer("mx.example.com") {
+		t.Fatal("other server recognized")
+	}
+	c.DefaultRoute.Action = RouteBlackhole
+	if c.relayServer("relay.example.com") {
+		t.Fatal("server recognized without relaying")
+	}
+}
@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"time"
+)
+
+// Hold the message until its next attempt is due and then add it to the
+// queue. Scheduled messages do not delay others waiting for the host.
+func (h *Host) schedule(m *Message, d time.Duration) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.scheduled[m] = time.AfterFunc(d, func() {
+		h.release(m)
+	})
+}
+
+// Add the scheduled message to the queue unless it was already released.
+func (h *Host) release(m *Message) {
+	h.m.Lock()
+	_, ok := h.scheduled[m]
+	delete(h.scheduled, m)
+	h.m.Unlock()
+	if ok {
+		h.newMessage.push(m)
+	}
+}
+
+// Add scheduled messages that should be retried after a configuration change
+// to the queue immediately. The mutex must be held.
+func (h *Host) releaseRetries() {
+	for m, t := range h.scheduled {
+		if h.retryMatches(m) {
+			t.Stop()
+			delete(h.scheduled, m)
+			h.newMessage.push(m)
+		}
+	}
+}
+
+// Stop the timers of all scheduled messages.
+func (h *Host) cancelScheduled() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for m, t := range h.scheduled {
+		t.Stop()
+		delete(h.scheduled, m)
+	}
+}
+
+// Retrieve the number of scheduled messages.
+func (h *Host) scheduledLen() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return len(h.scheduled)
+}
@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	h := &Host{
+		config:     &Config{},
+		newMessage: newMessageQueue(),
+		scheduled:  make(map[*Message]*time.Timer),
+		retry:      make(chan bool, 1),
+	}
+	var (
+		later = &Message{NextAttempt: time.Now().Add(time.Hour)}
+		soon  = &Message{NextAttempt: time.Now().Add(50 * time.Millisecond)}
+		now   = &Message{}
+	)
+	for _, m := range []*Message{later, soon, now} {
+		h.Deliver(m)
+	}
+	if m := h.newMessage.pop(OrderFIFO); m != now {
+		t.Fatal("due message not queued")
+	}
+	if h.Idle() != 0 {
+		t.Fatal("host idle with scheduled messages")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if m := h.newMessage.pop(OrderFIFO); m != soon {
+		t.Fatal("scheduled message not released")
+	}
+	h.retryDeferred(nil)
+	if m := h.newMessage.pop(OrderFIFO); m != later {
+		t.Fatal("scheduled message not retried")
+	}
+	if n := h.scheduledLen(); n != 0 {
+		t.Fatalf("%d != 0", n)
+	}
+}
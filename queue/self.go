@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"github.com/hectane/hectane/util"
+
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Function used to resolve mail servers when checking whether they refer to
+// this server, replaced during tests.
+var lookupServerAddrs = net.DefaultResolver.LookupHost
+
+// Length of time that the addresses of a mail server are cached.
+const serverAddrsTTL = 10 * time.Minute
+
+type serverAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+// Cache of the addresses each mail server resolves to. All methods are safe
+// to call from multiple goroutines.
+type serverAddrCache struct {
+	m     sync.Mutex
+	addrs map[string]*serverAddrs
+}
+
+// Create a new cache.
+func newServerAddrCache() *serverAddrCache {
+	return &serverAddrCache{
+		addrs: make(map[string]*serverAddrs),
+	}
+}
+
+// Resolve the server, using the cached addresses if they have not expired.
+// The lookup is abandoned if the context is cancelled and failed lookups are
+// not cached.
+func (s *serverAddrCache) lookup(ctx context.Context, server string) []string {
+	s.m.Lock()
+	a, ok := s.addrs[server]
+	s.m.Unlock()
+	if ok && time.Now().Before(a.expires) {
+		return a.addrs
+	}
+	addrs, err := lookupServerAddrs(ctx, server)
+	if err != nil {
+		return nil
+	}
+	s.m.Lock()
+	s.addrs[server] = &serverAddrs{
+		addrs:   addrs,
+		expires: time.Now().Add(serverAddrsTTL),
+	}
+	s.m.Unlock()
+	return addrs
+}
+
+// Resolve the server, abandoning the lookup if the host queue is shut down.
+// False is returned if the host queue was shut down while waiting.
+func (h *Host) lookupServer(server string) ([]string, bool) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		addrs       []string
+		done        = make(chan bool)
+	)
+	defer cancel()
+	go func() {
+		addrs = h.serverAddrs.lookup(ctx, server)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return addrs, true
+	case <-h.stop:
+		return nil, false
+	}
+}
+
+// Determine if the mail server refers to this server, which would cause mail
+// to loop. The server's name and addresses are compared to the identities
+// configured by the operator, which include the hostname of the sending
+// identity and the source IP. The default hostname is not compared since it
+// is derived from the sender. False is returned for ok if the host queue was
+// shut down while resolving the server.
+func (h *Host) isSelf(server, identityHostname, sourceIP string) (self, ok bool) {
+	var (
+		hostConfig = h.config.hostConfig(h.host)
+		identities = append([]string{hostConfig.Hostname, identityHostname, sourceIP}, h.config.Identities...)
+		addrs      []string
+		resolved   bool
+	)
+	for _, i := range identities {
+		if i == "" {
+			continue
+		}
+		if util.NormalizeDomain(i) == util.NormalizeDomain(server) {
+			return true, true
+		}
+		if ip := net.ParseIP(i); ip != nil {
+			if !resolved {
+				if addrs, ok = h.lookupServer(server); !ok {
+					return false, false
+				}
+				resolved = true
+			}
+			for _, a := range addrs {
+				if ip.Equal(net.ParseIP(a)) {
+					return true, true
+				}
+			}
+		}
+	}
+	return false, true
+}
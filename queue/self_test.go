@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestServerAddrCache(t *testing.T) {
+	defer func(l func(context.Context, string) ([]string, error)) {
+		lookupServerAddrs = l
+	}(lookupServerAddrs)
+	lookups := 0
+	lookupServerAddrs = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		if host == "mx.example.com" {
+			return []string{"192.0.2.1"}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	c := newServerAddrCache()
+	for _, d := range []struct {
+		server string
+		addrs  int
+	}{
+		{"mx.example.com", 1},
+		{"missing.example.com", 0},
+		{"mx.example.com", 1},
+		{"missing.example.com", 0},
+	} {
+		if v := c.lookup(context.Background(), d.server); len(v) != d.addrs {
+			t.Fatalf("%s: %d != %d", d.server, len(v), d.addrs)
+		}
+	}
+	if lookups != 3 {
+		t.Fatalf("%d != 3", lookups)
+	}
+}
+
+func TestIsSelf(t *testing.T) {
+	defer func(l func(context.Context, string) ([]string, error)) {
+		lookupServerAddrs = l
+	}(lookupServerAddrs)
+	lookupServerAddrs = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "corp.example.com":
+			return []string{"203.0.113.1"}, nil
+		case "mx.example.com":
+			return []string{"192.0.2.1"}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	c := &Config{
+		Identities: []string{"192.0.2.1"},
+		Hosts: map[string]*HostConfig{
+			"example.org": {Hostname: "out.example.org"},
+		},
+	}
+	for _, d := range []struct {
+		host     string
+		server   string
+		identity string
+		sourceIP string
+		self     bool
+	}{
+		{"corp.example.com", "corp.example.com", "", "", false},
+		{"corp.example.com", "mx.example.com", "", "", true},
+		{"corp.example.com", "corp.example.com", "corp.example.com", "", true},
+		{"corp.example.com", "corp.example.com", "", "203.0.113.1", true},
+		{"example.org", "out.example.org", "", "", true},
+		{"example.org", "mail.example.org", "", "", false},
+	} {
+		h := &Host{
+			shared: newShared(c),
+			config: c,
+			host:   d.host,
+			log:    logrus.WithField("context", d.host),
+			stop:   make(chan bool),
+		}
+		self, ok := h.isSelf(d.server, d.identity, d.sourceIP)
+		if !ok {
+			t.Fatalf("%s: lookup abandoned", d.server)
+		}
+		if self != d.self {
+			t.Fatalf("%s: %t != %t", d.server, self, d.self)
+		}
+	}
+}
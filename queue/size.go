@@ -0,0 +1,23 @@
+package queue
+
+import (
+	"errors"
+)
+
+var errMessageTooLarge = errors.New("message exceeds the maximum size for the host")
+
+// Determine if the message is larger than the host accepts.
+func (h *Host) isOversize(m *Message) bool {
+	max := h.config.hostConfig(h.host).MaxMessageSize
+	if max <= 0 {
+		return false
+	}
+	size, err := h.storage.MessageSize(m)
+	return err == nil && size > max
+}
+
+// Determine the transport used for messages larger than the host accepts or
+// nil if there is none.
+func (h *Host) oversizeTransport() Transport {
+	return h.config.Transports[h.config.hostConfig(h.host).OversizeTransport]
+}
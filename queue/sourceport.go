@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+)
+
+// Dial the address using a local port from the range [first, last]. Ports are
+// tried in order beginning at a random point in the range and the next one is
+// used if the port is already in use. The OS chooses the port if no range is
+// configured.
+func dialFromPorts(d *net.Dialer, addr string, first, last int) (net.Conn, error) {
+	if first <= 0 || last < first {
+		return d.Dial("tcp", addr)
+	}
+	var (
+		n     = last - first + 1
+		start = rand.Intn(n)
+		ip    net.IP
+		err   error
+	)
+	if d.LocalAddr != nil {
+		ip = d.LocalAddr.(*net.TCPAddr).IP
+	}
+	for i := 0; i < n; i++ {
+		dialer := *d
+		dialer.LocalAddr = &net.TCPAddr{
+			IP:   ip,
+			Port: first + (start+i)%n,
+		}
+		var conn net.Conn
+		conn, err = dialer.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) &&
+			!errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDialFromPorts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := f.Addr().(*net.TCPAddr).Port
+	f.Close()
+	conn, err := dialFromPorts(&net.Dialer{}, l.Addr().String(), port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if p := conn.LocalAddr().(*net.TCPAddr).Port; p != port {
+		t.Fatalf("%d != %d", p, port)
+	}
+}
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
 
 	"encoding/json"
 	"io"
@@ -10,11 +11,16 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	bodyFilename     = "body"
-	messageExtension = ".message"
+	bodyFilename        = "body"
+	messageExtension    = ".message"
+	quarantineExtension = ".quarantine"
+	coldExtension       = ".cold"
+	tombstoneExtension  = ".tombstone"
+	tempExtension       = ".tmp"
 )
 
 // Message metadata.
@@ -24,6 +30,69 @@ type Message struct {
 	Host string
 	From string
 	To   []string
+	Tags map[string]string
+
+	// Overrides the policy for errors after the body was sent
+	DataErrorPolicy string
+
+	// Number of delivery attempts that started but never completed
+	Incomplete int
+
+	// Time the message was created and number of deferred delivery attempts
+	Created  time.Time
+	Attempts int
+
+	// Overrides the maximum number of attempts and maximum lifetime (in
+	// seconds) of the message
+	MaxAttempts int
+	MaxLifetime int
+
+	// Prevents details of the message from being logged
+	Confidential bool
+
+	// Message-ID generated for the message if it did not have one
+	MessageID string
+
+	// Indicates a test message sent to monitor delivery
+	Monitor bool
+
+	// Details of how and by whom the message was submitted
+	Submission *Submission
+
+	// Name of the sending identity used for the message, overriding the
+	// source IP, EHLO hostname and DKIM key that would otherwise be used
+	SendingIdentity string
+
+	// Relative priority of the message, with higher values delivered first
+	// by hosts using the priority ordering
+	Priority int
+
+	// Post a confirmation to the success webhook for each recipient that
+	// accepts the message
+	NotifySuccess bool
+
+	// Time before which delivery should not be attempted again
+	NextAttempt time.Time
+
+	// Recipients removed from To after accepting or permanently rejecting
+	// the message
+	Delivered []string
+	Bounced   []string
+
+	// Classification of the reason each bounced recipient was rejected
+	BounceReasons map[string]string
+
+	// Indicates that the message reached a terminal state but could not be
+	// removed from disk
+	Tombstone bool
+
+	// Channel receiving the result of delivery and the result most recently
+	// recorded for the message
+	result  chan *DeliveryResult
+	outcome string
+
+	// Time the message was most recently deferred by this process
+	deferred time.Time
 }
 
 // Manager for message metadata and body on disk. All methods are safe to call
@@ -31,6 +100,11 @@ type Message struct {
 type Storage struct {
 	m         sync.Mutex
 	directory string
+	log       *logrus.Entry
+
+	// Time of the next attempt for messages in cold storage indexed by
+	// filename
+	cold map[string]time.Time
 }
 
 // Determine the path to the directory containing the specified body.
@@ -48,21 +122,54 @@ func (s *Storage) messageFilename(m *Message) string {
 	return path.Join(s.directory, m.body, m.id) + messageExtension
 }
 
-// Load all messages with the specified body.
-func (s *Storage) loadMessages(body string) []*Message {
+// Load all messages with the specified body. Messages marked as tombstones
+// are skipped and, if requested, removed along with temporary files left by
+// interrupted writes.
+func (s *Storage) loadMessages(body string, removeTombstones bool) []*Message {
+	if removeTombstones {
+		s.removeTempFiles(body)
+	}
+	messages := []*Message{}
+	for _, m := range s.loadFiles(body, messageExtension) {
+		if m.Tombstone {
+			if removeTombstones {
+				s.m.Lock()
+				s.removeTombstone(m)
+				s.m.Unlock()
+			}
+			continue
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// Remove temporary files with the specified body.
+func (s *Storage) removeTempFiles(body string) {
+	files, err := ioutil.ReadDir(s.bodyDirectory(body))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), tempExtension) {
+			os.Remove(path.Join(s.bodyDirectory(body), f.Name()))
+		}
+	}
+}
+
+// Load all messages with the specified body stored in files with the
+// extension. Files that cannot be decoded are logged and skipped.
+func (s *Storage) loadFiles(body, extension string) []*Message {
 	messages := make([]*Message, 0, 1)
 	if files, err := ioutil.ReadDir(s.bodyDirectory(body)); err == nil {
 		for _, f := range files {
-			if strings.HasSuffix(f.Name(), messageExtension) {
-				m := &Message{
-					id:   strings.TrimSuffix(f.Name(), messageExtension),
-					body: body,
-				}
-				if r, err := os.Open(s.messageFilename(m)); err == nil {
-					if err := json.NewDecoder(r).Decode(m); err == nil {
-						messages = append(messages, m)
-					}
-					r.Close()
+			if strings.HasSuffix(f.Name(), extension) {
+				filename := path.Join(s.bodyDirectory(body), f.Name())
+				m, err := loadFile(filename)
+				if err == nil {
+					messages = append(messages, m)
+				} else if !os.IsNotExist(err) {
+					s.log.Errorf("unable to load %s: %s", filename, err)
 				}
 			}
 		}
@@ -70,10 +177,30 @@ func (s *Storage) loadMessages(body string) []*Message {
 	return messages
 }
 
+// Load the message stored in the file. Its ID and body are determined from
+// the filename.
+func loadFile(filename string) (*Message, error) {
+	r, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m := &Message{
+		id:   strings.TrimSuffix(path.Base(filename), path.Ext(filename)),
+		body: path.Base(path.Dir(filename)),
+	}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Create a Storage instance for the specified directory.
 func NewStorage(directory string) *Storage {
 	return &Storage{
 		directory: directory,
+		log:       logrus.WithField("context", "Storage"),
+		cold:      make(map[string]time.Time),
 	}
 }
 
@@ -94,22 +221,73 @@ func (s *Storage) NewBody() (io.WriteCloser, string, error) {
 // Load messages from the storage directory. Any messages that could not be
 // loaded are ignored.
 func (s *Storage) LoadMessages() ([]*Message, error) {
+	bodies, err := s.bodies()
+	if err != nil {
+		return nil, err
+	}
+	messages := []*Message{}
+	for _, b := range bodies {
+		messages = append(messages, s.loadMessages(b, false)...)
+	}
+	return messages, nil
+}
+
+// Determine which message bodies exist in the storage directory. Directories
+// whose body is missing are included so that their messages can be removed.
+func (s *Storage) bodies() ([]string, error) {
 	directories, err := ioutil.ReadDir(s.directory)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, err
 		}
-		return []*Message{}, nil
+		return []string{}, nil
 	}
-	var messages []*Message
+	var bodies []string
 	for _, d := range directories {
 		if d.IsDir() {
-			if _, err := os.Stat(s.bodyFilename(d.Name())); err == nil {
-				messages = append(messages, s.loadMessages(d.Name())...)
-			}
+			bodies = append(bodies, d.Name())
 		}
 	}
-	return messages, nil
+	return bodies, nil
+}
+
+// Load messages from the storage directory using the specified number of
+// goroutines. Messages are sent on the channel as they are loaded and the
+// channel is closed once all of them have been loaded. This is done at
+// startup, so messages marked as tombstones are removed.
+func (s *Storage) loadMessagesConcurrently(n int) (<-chan *Message, error) {
+	bodies, err := s.bodies()
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		n = 1
+	}
+	var (
+		bodyChan    = make(chan string)
+		messageChan = make(chan *Message)
+		wg          sync.WaitGroup
+	)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for b := range bodyChan {
+				for _, m := range s.loadMessages(b, true) {
+					messageChan <- m
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, b := range bodies {
+			bodyChan <- b
+		}
+		close(bodyChan)
+		wg.Wait()
+		close(messageChan)
+	}()
+	return messageChan, nil
 }
 
 // Save the specified message to disk.
@@ -118,15 +296,63 @@ func (s *Storage) SaveMessage(m *Message, body string) error {
 	defer s.m.Unlock()
 	m.id = uuid.New()
 	m.body = body
-	w, err := os.OpenFile(s.messageFilename(m), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if m.Created.IsZero() {
+		m.Created = time.Now()
+	}
+	return writeFile(s.messageFilename(m), m)
+}
+
+// Write changes to the specified message to disk.
+func (s *Storage) UpdateMessage(m *Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.writeMessage(m)
+}
+
+// Write the message to its existing file. The mutex must be held.
+func (s *Storage) writeMessage(m *Message) error {
+	filename := s.messageFilename(m)
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+	return writeFile(filename, m)
+}
+
+// Write the message to the file. The message is written to a temporary file
+// in the same directory that replaces the file once it is synced so that the
+// file is never left partially written. The mutex must be held.
+func writeFile(filename string, m *Message) error {
+	var (
+		temp   = strings.TrimSuffix(filename, path.Ext(filename)) + tempExtension
+		w, err = os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
 	if err := json.NewEncoder(w).Encode(m); err != nil {
+		w.Close()
+		os.Remove(temp)
 		return err
 	}
-	return nil
+	if err := w.Sync(); err != nil {
+		w.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+// Determine the size of the message body in bytes.
+func (s *Storage) MessageSize(m *Message) (int64, error) {
+	i, err := os.Stat(s.bodyFilename(m.body))
+	if err != nil {
+		return 0, err
+	}
+	return i.Size(), nil
 }
 
 // Retreive a reader for the message body.
@@ -136,6 +362,21 @@ func (s *Storage) GetMessageBody(m *Message) (io.ReadCloser, error) {
 	return os.Open(s.bodyFilename(m.body))
 }
 
+// Determine if the body of the specified message is missing from disk.
+func (s *Storage) bodyMissing(m *Message) bool {
+	_, err := os.Stat(s.bodyFilename(m.body))
+	return os.IsNotExist(err)
+}
+
+// Quarantine the specified message. The message and its body are kept on
+// disk for review but will not be loaded again.
+func (s *Storage) QuarantineMessage(m *Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	filename := s.messageFilename(m)
+	return os.Rename(filename, strings.TrimSuffix(filename, messageExtension)+quarantineExtension)
+}
+
 // Delete the specified message. The message body is also deleted if no more
 // messages exist.
 func (s *Storage) DeleteMessage(m *Message) error {
@@ -144,16 +385,22 @@ func (s *Storage) DeleteMessage(m *Message) error {
 	if err := os.Remove(s.messageFilename(m)); err != nil {
 		return err
 	}
+	return s.removeBody(m)
+}
+
+// Delete the body of the specified message if no more messages exist. The
+// mutex must be held.
+func (s *Storage) removeBody(m *Message) error {
 	d, err := os.Open(s.bodyDirectory(m.body))
 	if err != nil {
 		return err
 	}
 	defer d.Close()
 	e, err := d.Readdir(2)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return err
 	}
-	if len(e) == 1 {
+	if len(e) == 0 || len(e) == 1 && e[0].Name() == bodyFilename {
 		return os.RemoveAll(s.bodyDirectory(m.body))
 	}
 	return nil
@@ -1,10 +1,15 @@
 package queue
 
 import (
+	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStorage(t *testing.T) {
@@ -64,3 +69,389 @@ func TestStorage(t *testing.T) {
 		t.Fatalf("%d != 0", len(e))
 	}
 }
+
+func TestUpdateMessage(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	m := &Message{}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	m.Incomplete = 1
+	if err := s.UpdateMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	temp := strings.TrimSuffix(s.messageFilename(m), messageExtension) + tempExtension
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Fatal("temporary file not replaced")
+	}
+	if err := ioutil.WriteFile(temp, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := s.loadMessagesConcurrently(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for l := range messages {
+		if l.Incomplete != 1 {
+			t.Fatalf("%d != 1", l.Incomplete)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Fatal("temporary file not removed")
+	}
+	if err := s.DeleteMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateMessage(m); !os.IsNotExist(err) {
+		t.Fatalf("%v != not exist", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	var (
+		data     = []byte("test")
+		from     = "me@example.com"
+		src, dst *Storage
+	)
+	for _, s := range []**Storage{&src, &dst} {
+		d, err := ioutil.TempDir(os.TempDir(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(d)
+		*s = NewStorage(d)
+	}
+	w, body, err := src.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveMessage(&Message{From: from}, body); err != nil {
+		t.Fatal(err)
+	}
+	buff := &bytes.Buffer{}
+	if err := src.Export(buff); err != nil {
+		t.Fatal(err)
+	}
+	archive := buff.Bytes()
+	messages, err := dst.Import(bytes.NewReader(archive), ImportSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].From != from {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+	r, err := dst.GetMessageBody(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b, data) {
+		t.Fatalf("%v != %v", b, data)
+	}
+	for _, p := range []struct {
+		policy string
+		count  int
+	}{
+		{ImportSkip, 0},
+		{ImportMerge, 1},
+	} {
+		messages, err := dst.Import(bytes.NewReader(archive), p.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != p.count {
+			t.Fatalf("%d != %d", len(messages), p.count)
+		}
+	}
+	loaded, err := dst.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("%d != 2", len(loaded))
+	}
+}
+
+// Reader that records whether the storage mutex is held while it is read.
+type lockCheckReader struct {
+	io.Reader
+	s      *Storage
+	locked bool
+}
+
+func (l *lockCheckReader) Read(p []byte) (int, error) {
+	if l.s.m.TryLock() {
+		l.s.m.Unlock()
+	} else {
+		l.locked = true
+	}
+	return l.Reader.Read(p)
+}
+
+func TestImportFailure(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		s    = NewStorage(d)
+		buff = &bytes.Buffer{}
+		w    = tar.NewWriter(buff)
+	)
+	for _, e := range []struct {
+		name string
+		data string
+	}{
+		{"a/" + bodyFilename, "test"},
+		{"a/1" + messageExtension, `{"From": "me@example.com"}`},
+		{"b/" + bodyFilename, "test"},
+		{"b/c/d", ""},
+	} {
+		if err := w.WriteHeader(&tar.Header{
+			Name: e.name,
+			Mode: 0600,
+			Size: int64(len(e.data)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := &lockCheckReader{Reader: buff, s: s}
+	if _, err := s.Import(r, ImportSkip); err != errInvalidArchive {
+		t.Fatalf("%v != %v", err, errInvalidArchive)
+	}
+	if r.locked {
+		t.Fatal("archive was read while holding the mutex")
+	}
+	files, err := ioutil.ReadDir(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("%d file(s) left after failed import", len(files))
+	}
+}
+
+func TestLoadMessagesConcurrently(t *testing.T) {
+	numMessages := 10
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	for i := 0; i < numMessages; i++ {
+		w, body, err := s.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveMessage(&Message{}, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := s.loadMessagesConcurrently(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for range messages {
+		count++
+	}
+	if count != numMessages {
+		t.Fatalf("%d != %d", count, numMessages)
+	}
+}
+
+func TestColdStorage(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now  = time.Now()
+		soon = &Message{To: []string{"me@example.com"}, NextAttempt: now.Add(time.Minute)}
+		late = &Message{NextAttempt: now.Add(time.Hour)}
+	)
+	for _, m := range []*Message{soon, late} {
+		if err := s.SaveMessage(m, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SpillMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages, err := s.LoadMessages(); err != nil {
+		t.Fatal(err)
+	} else if len(messages) != 0 {
+		t.Fatalf("%d != 0", len(messages))
+	}
+	promoted, err := s.PromoteMessages(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(promoted) != 1 || promoted[0].id != soon.id {
+		t.Fatalf("unexpected messages: %v", promoted)
+	}
+	if promoted[0] == soon || !reflect.DeepEqual(promoted[0].To, soon.To) {
+		t.Fatalf("%v != %v", promoted[0].To, soon.To)
+	}
+	if messages, err := s.LoadMessages(); err != nil {
+		t.Fatal(err)
+	} else if len(messages) != 1 {
+		t.Fatalf("%d != 1", len(messages))
+	}
+	s = NewStorage(d)
+	if err := s.indexColdMessages(); err != nil {
+		t.Fatal(err)
+	}
+	promoted, err = s.PromoteMessages(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(promoted) != 1 || promoted[0].id != late.id {
+		t.Fatalf("unexpected messages: %v", promoted)
+	}
+}
+
+func TestOrphanedMessages(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{
+		Host: "example.com",
+		From: "me@example.com",
+		To:   []string{"you@example.com"},
+	}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.bodyFilename(body)); err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue(&Config{Directory: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(s.bodyDirectory(body)); os.IsNotExist(err) {
+			break
+		}
+		if i == 50 {
+			if s.messageExists(m) {
+				t.Fatal("orphaned message not removed")
+			}
+			t.Fatal("body directory not removed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Writer that updates a message in storage on the first write, failing the
+// test if storage is locked.
+type updatingWriter struct {
+	t       *testing.T
+	s       *Storage
+	m       *Message
+	updated bool
+}
+
+func (u *updatingWriter) Write(p []byte) (int, error) {
+	if !u.updated {
+		u.updated = true
+		done := make(chan error)
+		go func() {
+			done <- u.s.UpdateMessage(u.m)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				u.t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			u.t.Fatal("storage locked during export")
+		}
+	}
+	return len(p), nil
+}
+
+func TestExportUnlocked(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	m := &Message{}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(s.bodyDirectory("orphan"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	u := &updatingWriter{t: t, s: s, m: m}
+	if err := s.Export(u); err != nil {
+		t.Fatal(err)
+	}
+	if !u.updated {
+		t.Fatal("nothing exported")
+	}
+}
@@ -0,0 +1,20 @@
+package queue
+
+import (
+	"time"
+)
+
+// Protocols through which messages are submitted.
+const (
+	SubmissionHTTP = "http"
+	SubmissionSMTP = "smtp"
+)
+
+// Provenance of a message, recorded when it is accepted for delivery. User is
+// empty if the submitter did not authenticate.
+type Submission struct {
+	User     string    `json:"user"`
+	ClientIP string    `json:"client-ip"`
+	Protocol string    `json:"protocol"`
+	Time     time.Time `json:"time"`
+}
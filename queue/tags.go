@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Value used in place of tag values that exceed the configured limit.
+const otherTagValue = "other"
+
+// Delivery counts for messages with a specific set of tag values.
+type TagStatus struct {
+	Tags      map[string]string `json:"tags"`
+	Delivered int               `json:"delivered"`
+	Deferred  int               `json:"deferred"`
+	Failed    int               `json:"failed"`
+}
+
+// Counter for message outcomes grouped by tag value. Only the tags listed in
+// the configuration are considered and the number of distinct values for each
+// tag is limited to avoid unbounded growth. All methods are safe to call from
+// multiple goroutines.
+type tagStats struct {
+	m      sync.Mutex
+	config *Config
+	values map[string]map[string]bool
+	counts map[string]*TagStatus
+}
+
+// Create a new counter using the specified configuration.
+func newTagStats(c *Config) *tagStats {
+	return &tagStats{
+		config: c,
+		values: make(map[string]map[string]bool),
+		counts: make(map[string]*TagStatus),
+	}
+}
+
+// Switch to the specified configuration.
+func (t *tagStats) setConfig(c *Config) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.config = c
+}
+
+// Determine the tag values to use for the message. Values are replaced once
+// the limit for a tag is reached.
+func (t *tagStats) labels(m *Message) map[string]string {
+	labels := make(map[string]string)
+	for _, k := range t.config.TagLabels {
+		v, ok := m.Tags[k]
+		if !ok {
+			continue
+		}
+		if t.values[k] == nil {
+			t.values[k] = make(map[string]bool)
+		}
+		if !t.values[k][v] {
+			if len(t.values[k]) >= t.config.maxTagValues() {
+				v = otherTagValue
+			}
+			t.values[k][v] = true
+		}
+		labels[k] = v
+	}
+	return labels
+}
+
+// Create a unique key for the specified set of tag values.
+func tagKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Record the outcome of an attempt to deliver the specified message. The tag
+// values used for the message are returned.
+func (t *tagStats) add(m *Message, result string) map[string]string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if len(t.config.TagLabels) == 0 {
+		return nil
+	}
+	var (
+		labels = t.labels(m)
+		key    = tagKey(labels)
+	)
+	s, ok := t.counts[key]
+	if !ok {
+		s = &TagStatus{Tags: labels}
+		t.counts[key] = s
+	}
+	switch result {
+	case resultDelivered:
+		s.Delivered++
+	case resultDeferred:
+		s.Deferred++
+	default:
+		s.Failed++
+	}
+	return labels
+}
+
+// Retrieve the counts for all tag values matching the filter.
+func (t *tagStats) status(filter map[string]string) []*TagStatus {
+	t.m.Lock()
+	defer t.m.Unlock()
+	statuses := make([]*TagStatus, 0, len(t.counts))
+loop:
+	for _, s := range t.counts {
+		for k, v := range filter {
+			if s.Tags[k] != v {
+				continue loop
+			}
+		}
+		tags := make(map[string]string)
+		for k, v := range s.Tags {
+			tags[k] = v
+		}
+		statuses = append(statuses, &TagStatus{
+			Tags:      tags,
+			Delivered: s.Delivered,
+			Deferred:  s.Deferred,
+			Failed:    s.Failed,
+		})
+	}
+	return statuses
+}
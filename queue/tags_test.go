@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTagStats(t *testing.T) {
+	s := newTagStats(&Config{
+		TagLabels:    []string{"tenant"},
+		MaxTagValues: 2,
+	})
+	for _, v := range []string{"a", "b", "c", "d"} {
+		s.add(&Message{Tags: map[string]string{"tenant": v, "id": v}}, resultDelivered)
+	}
+	s.add(&Message{Tags: map[string]string{"tenant": "a"}}, resultFailed)
+	if l := len(s.status(nil)); l != 3 {
+		t.Fatalf("%d != 3", l)
+	}
+	var (
+		a     = s.status(map[string]string{"tenant": "a"})
+		other = s.status(map[string]string{"tenant": otherTagValue})
+	)
+	if len(a) != 1 || a[0].Delivered != 1 || a[0].Failed != 1 {
+		t.Fatalf("unexpected counts for \"a\": %v", a)
+	}
+	if len(other) != 1 || other[0].Delivered != 2 {
+		t.Fatalf("unexpected counts for \"%s\": %v", otherTagValue, other)
+	}
+}
+
+func TestTagStatsDefaultLimit(t *testing.T) {
+	s := newTagStats(&Config{TagLabels: []string{"tenant"}})
+	for i := 0; i < 150; i++ {
+		s.add(&Message{Tags: map[string]string{"tenant": strconv.Itoa(i)}}, resultDelivered)
+	}
+	if l := len(s.status(nil)); l != 101 {
+		t.Fatalf("%d != 101", l)
+	}
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"github.com/hectane/hectane/util"
+
+	"sync"
+)
+
+// Round-robin selection of source IPs from the pool for each tier. All
+// methods are safe to call from multiple goroutines.
+type sourcePools struct {
+	m    sync.Mutex
+	next map[string]int
+}
+
+// Create a new set of pools.
+func newSourcePools() *sourcePools {
+	return &sourcePools{
+		next: make(map[string]int),
+	}
+}
+
+// Select the next source IP from the pool for the tier. An empty string is
+// returned if the pool is empty.
+func (s *sourcePools) selectIP(tier string, pool []string) string {
+	if len(pool) == 0 {
+		return ""
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	i := s.next[tier] % len(pool)
+	s.next[tier] = i + 1
+	return pool[i]
+}
+
+// Determine the reputation tier for the message. The tier assigned to the
+// sender's domain takes precedence over the tier assigned to the host.
+func (h *Host) tier(m *Message) string {
+	if hostname, err := h.parseHostname(m.From); err == nil {
+		if t, ok := h.config.SenderTiers[util.NormalizeDomain(hostname)]; ok {
+			return t
+		}
+	}
+	return h.config.hostConfig(h.host).Tier
+}
+
+// Select the local address for a new connection used for messages in the
+// specified tier. An address from the tier's pool is used if one exists,
+// followed by the address for the lane and finally the address for the host.
+// Addresses listed on a blocklist are skipped if configured to avoid them and
+// errBlocklisted is returned if all of them are. Addresses that are cooling
+// down after being rate limited are also skipped and a cooldownError for the
+// one that ends soonest is returned if no others remain. If the host requires
+// FCrDNS, addresses without it are skipped and errFCrDNS is returned if none
+// remain. (The check cannot be performed when no address is configured since
+// the system chooses one.)
+func (h *Host) selectSourceIP(tier string) (string, error) {
+	var (
+		pool    = h.config.Tiers[tier]
+		require = h.config.hostConfig(h.host).RequireFCrDNS
+		ip      string
+		cooling *Cooldown
+	)
+	listed := 0
+	for range pool {
+		ip = h.sourcePools.selectIP(tier, pool)
+		if h.blocklisted(ip) {
+			h.log.Warnf("%s is listed on a blocklist", ip)
+			listed++
+			continue
+		}
+		if v := h.sourceIPCooldown(ip); v != nil {
+			if cooling == nil || v.Until.Before(cooling.Until) {
+				cooling = v
+			}
+			listed++
+			continue
+		}
+		if !require || h.fcrdns.check(ip) {
+			return ip, nil
+		}
+		h.log.Warnf("%s does not have valid FCrDNS", ip)
+	}
+	if len(pool) > 0 && listed == len(pool) {
+		if cooling != nil {
+			return "", &cooldownError{cooling}
+		}
+		return "", errBlocklisted
+	}
+	if len(pool) > 0 {
+		return "", errFCrDNS
+	}
+	if h.lane == laneLarge && h.config.LargeMessageSourceIP != "" {
+		ip = h.config.LargeMessageSourceIP
+	} else {
+		ip = h.config.hostConfig(h.host).SourceIP
+	}
+	if h.blocklisted(ip) {
+		return "", errBlocklisted
+	}
+	if v := h.sourceIPCooldown(ip); v != nil {
+		return "", &cooldownError{v}
+	}
+	if require && ip != "" && !h.fcrdns.check(ip) {
+		return "", errFCrDNS
+	}
+	return ip, nil
+}
@@ -0,0 +1,414 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration for sending TLS-RPT (RFC 8460) aggregate reports.
+type TLSReportingConfig struct {
+	// Name and contact address of the organization submitting reports
+	OrganizationName string `json:"organization-name"`
+	ContactInfo      string `json:"contact-info"`
+
+	// Sender of reports delivered by email
+	From string `json:"from"`
+
+	// Number of seconds covered by each report (defaults to one day)
+	Interval int `json:"interval"`
+}
+
+// Result types for failed TLS sessions (RFC 8460, section 4.3).
+const (
+	tlsStartTLSNotSupported = "starttls-not-supported"
+	tlsHostMismatch         = "certificate-host-mismatch"
+	tlsCertExpired          = "certificate-expired"
+	tlsCertNotTrusted       = "certificate-not-trusted"
+	tlsValidationFailure    = "validation-failure"
+)
+
+// Function used for looking up reporting policies, replaced during tests.
+var lookupTXT = net.LookupTXT
+
+// Create the client used to submit reports to an HTTPS endpoint. Since the
+// endpoint is published in DNS by the recipient domain, connections to
+// internal addresses are subject to the private address policy.
+func newTLSReportClient(c *Config, server string) *http.Client {
+	d := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: c.privateControl(server),
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         d.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+// Determine the result type for an error that occurred while negotiating TLS.
+func tlsResultType(err error) string {
+	var (
+		hostErr      x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		authorityErr x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.As(err, &hostErr):
+		return tlsHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return tlsCertExpired
+	case errors.As(err, &authorityErr):
+		return tlsCertNotTrusted
+	default:
+		return tlsValidationFailure
+	}
+}
+
+type tlsFailure struct {
+	resultType string
+	server     string
+}
+
+// TLS session results for a policy domain.
+type tlsResults struct {
+	successful int
+	failures   map[tlsFailure]int
+}
+
+// Collects the results of TLS sessions with each domain during the current
+// reporting period. All methods are safe to call from multiple goroutines.
+type tlsReportCollector struct {
+	m       sync.Mutex
+	start   time.Time
+	results map[string]*tlsResults
+}
+
+// Create a new collector.
+func newTLSReportCollector() *tlsReportCollector {
+	return &tlsReportCollector{
+		start:   time.Now(),
+		results: make(map[string]*tlsResults),
+	}
+}
+
+// Retrieve the results for the domain, creating them if necessary. The mutex
+// must be held.
+func (t *tlsReportCollector) domain(domain string) *tlsResults {
+	r, ok := t.results[domain]
+	if !ok {
+		r = &tlsResults{failures: make(map[tlsFailure]int)}
+		t.results[domain] = r
+	}
+	return r
+}
+
+// Record a successful TLS session with the domain.
+func (t *tlsReportCollector) success(domain string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.domain(domain).successful++
+}
+
+// Record a failed TLS session with the mail server for the domain.
+func (t *tlsReportCollector) failure(domain, server, resultType string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.domain(domain).failures[tlsFailure{resultType, server}]++
+}
+
+// Record a successful TLS session with the host if reporting is enabled.
+func (h *Host) tlsSuccess() {
+	if h.config.TLSReporting != nil {
+		h.tlsReports.success(h.host)
+	}
+}
+
+// Record a failed TLS session with the mail server for the host if reporting
+// is enabled.
+func (h *Host) tlsFailure(server, resultType string) {
+	if h.config.TLSReporting != nil {
+		h.tlsReports.failure(h.host, server, resultType)
+	}
+}
+
+// Provide the results for the current period if it has lasted at least the
+// specified interval and begin a new period.
+func (t *tlsReportCollector) flush(interval time.Duration) (map[string]*tlsResults, time.Time, time.Time, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := time.Now()
+	if now.Sub(t.start) < interval {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	results, start := t.results, t.start
+	t.results = make(map[string]*tlsResults)
+	t.start = now
+	return results, start, now, true
+}
+
+// Aggregate report (RFC 8460, section 4.4).
+type tlsReport struct {
+	OrganizationName string `json:"organization-name"`
+	DateRange        struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	ContactInfo string            `json:"contact-info"`
+	ReportID    string            `json:"report-id"`
+	Policies    []tlsReportPolicy `json:"policies"`
+}
+
+type tlsReportPolicy struct {
+	Policy struct {
+		Type   string `json:"policy-type"`
+		Domain string `json:"policy-domain"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int `json:"total-successful-session-count"`
+		Failed     int `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []tlsReportFailure `json:"failure-details,omitempty"`
+}
+
+type tlsReportFailure struct {
+	ResultType string `json:"result-type"`
+	Server     string `json:"receiving-mx-hostname"`
+	Count      int    `json:"failed-session-count"`
+}
+
+// Create the report for the domain. No policies (MTA-STS or DANE) are
+// applied during delivery, so results are reported as "no-policy-found".
+func newTLSReport(c *TLSReportingConfig, domain string, r *tlsResults, start, end time.Time) *tlsReport {
+	report := &tlsReport{
+		OrganizationName: c.OrganizationName,
+		ContactInfo:      c.ContactInfo,
+		ReportID:         uuid.New(),
+	}
+	report.DateRange.Start = start.UTC()
+	report.DateRange.End = end.UTC()
+	p := tlsReportPolicy{}
+	p.Policy.Type = "no-policy-found"
+	p.Policy.Domain = domain
+	p.Summary.Successful = r.successful
+	for f, n := range r.failures {
+		p.Summary.Failed += n
+		p.FailureDetails = append(p.FailureDetails, tlsReportFailure{
+			ResultType: f.resultType,
+			Server:     f.server,
+			Count:      n,
+		})
+	}
+	sort.Slice(p.FailureDetails, func(i, j int) bool {
+		a, b := p.FailureDetails[i], p.FailureDetails[j]
+		if a.Server != b.Server {
+			return a.Server < b.Server
+		}
+		return a.ResultType < b.ResultType
+	})
+	report.Policies = []tlsReportPolicy{p}
+	return report
+}
+
+// Find the addresses that reports for the domain should be sent to. An empty
+// list is returned if the domain does not request reports.
+func reportAddresses(domain string) []string {
+	records, err := lookupTXT("_smtp._tls." + domain)
+	if err != nil {
+		return []string{}
+	}
+	for _, r := range records {
+		var (
+			fields = strings.Split(r, ";")
+			rua    []string
+		)
+		if strings.TrimSpace(fields[0]) != "v=TLSRPTv1" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "rua=") {
+				for _, a := range strings.Split(strings.TrimPrefix(f, "rua="), ",") {
+					if a = strings.TrimSpace(a); a != "" {
+						rua = append(rua, a)
+					}
+				}
+			}
+		}
+		return rua
+	}
+	return []string{}
+}
+
+// Compress the report in JSON format.
+func (r *tlsReport) gzip() ([]byte, error) {
+	var (
+		buff = &bytes.Buffer{}
+		w    = gzip.NewWriter(buff)
+	)
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// Submit the report to an HTTPS endpoint.
+func postTLSReport(c *Config, u string, data []byte) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	client := newTLSReportClient(c, parsed.Hostname())
+	resp, err := client.Post(u, "application/tlsrpt+gzip", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("report submission failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Create the email used to deliver a report (RFC 8460, section 5.3).
+func tlsReportEmail(c *TLSReportingConfig, domain, to string, r *tlsReport, data []byte) ([]byte, error) {
+	var (
+		buff = &bytes.Buffer{}
+		w    = multipart.NewWriter(buff)
+	)
+	fmt.Fprintf(buff, "From: %s\r\n", c.From)
+	fmt.Fprintf(buff, "To: %s\r\n", to)
+	fmt.Fprintf(buff, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n",
+		domain, c.OrganizationName, r.ReportID)
+	fmt.Fprintf(buff, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buff, "TLS-Report-Domain: %s\r\n", domain)
+	fmt.Fprintf(buff, "TLS-Report-Submitter: %s\r\n", c.OrganizationName)
+	fmt.Fprintf(buff, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buff, "Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=\"%s\"\r\n\r\n", w.Boundary())
+	p, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(p, "This is an aggregate TLS report from %s.\r\n", c.OrganizationName)
+	filename := fmt.Sprintf("%s!%s!%d!%d.json.gz", c.OrganizationName, domain,
+		r.DateRange.Start.Unix(), r.DateRange.End.Unix())
+	p, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              []string{"application/tlsrpt+gzip"},
+		"Content-Transfer-Encoding": []string{"base64"},
+		"Content-Disposition":       []string{fmt.Sprintf("attachment; filename=\"%s\"", filename)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		fmt.Fprintf(p, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(p, "%s\r\n", encoded)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// Queue a report for delivery by email.
+func (q *Queue) mailTLSReport(c *TLSReportingConfig, domain, to string, r *tlsReport, data []byte) error {
+	body, err := tlsReportEmail(c, domain, to, r, data)
+	if err != nil {
+		return err
+	}
+	w, id, err := q.Storage.NewBody()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	m := &Message{
+		Host: to[strings.LastIndex(to, "@")+1:],
+		From: c.From,
+		To:   []string{to},
+	}
+	if err := q.Storage.SaveMessage(m, id); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return q.DeliverContext(ctx, m)
+}
+
+// Send the reports for the period if it has ended. Reports are generated and
+// sent in a separate goroutine.
+func (q *Queue) sendTLSReports() {
+	config := q.config
+	c := config.TLSReporting
+	if c == nil {
+		return
+	}
+	interval := time.Duration(c.Interval) * time.Second
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	results, start, end, ok := q.tlsReports.flush(interval)
+	if !ok || len(results) == 0 {
+		return
+	}
+	go func() {
+		for domain, r := range results {
+			var (
+				report = newTLSReport(c, domain, r, start, end)
+				data   []byte
+				err    error
+			)
+			for _, a := range reportAddresses(domain) {
+				if data == nil {
+					if data, err = report.gzip(); err != nil {
+						q.log.Error(err.Error())
+						break
+					}
+				}
+				switch {
+				case strings.HasPrefix(a, "https:"):
+					err = postTLSReport(config, a, data)
+				case strings.HasPrefix(a, "mailto:"):
+					err = q.mailTLSReport(c, domain, strings.TrimPrefix(a, "mailto:"), report, data)
+				default:
+					err = fmt.Errorf("unsupported report address %s", a)
+				}
+				if err != nil {
+					q.log.Error(err.Error())
+				} else {
+					q.log.Infof("sent TLS report for %s to %s", domain, a)
+				}
+			}
+		}
+	}()
+}
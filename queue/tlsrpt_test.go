@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTLSResultType(t *testing.T) {
+	for _, v := range []struct {
+		err        error
+		resultType string
+	}{
+		{x509.HostnameError{Host: "mx.example.com"}, tlsHostMismatch},
+		{fmt.Errorf("x509: %w", x509.CertificateInvalidError{Reason: x509.Expired}), tlsCertExpired},
+		{x509.UnknownAuthorityError{}, tlsCertNotTrusted},
+		{errors.New("handshake failure"), tlsValidationFailure},
+	} {
+		if r := tlsResultType(v.err); r != v.resultType {
+			t.Fatalf("%s != %s", r, v.resultType)
+		}
+	}
+}
+
+func TestReportAddresses(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupTXT = f }(lookupTXT)
+	lookupTXT = func(name string) ([]string, error) {
+		if name != "_smtp._tls.example.com" {
+			return nil, errors.New("not found")
+		}
+		return []string{
+			"unrelated",
+			"v=TLSRPTv1; rua=mailto:tls@example.com,https://example.com/tlsrpt",
+		}, nil
+	}
+	a := reportAddresses("example.com")
+	if !reflect.DeepEqual(a, []string{"mailto:tls@example.com", "https://example.com/tlsrpt"}) {
+		t.Fatalf("unexpected addresses: %v", a)
+	}
+	if a := reportAddresses("example.org"); len(a) != 0 {
+		t.Fatalf("unexpected addresses: %v", a)
+	}
+}
+
+func TestTLSReport(t *testing.T) {
+	c := newTLSReportCollector()
+	c.success("example.com")
+	c.success("example.com")
+	c.failure("example.com", "mx.example.com", tlsCertExpired)
+	if _, _, _, ok := c.flush(time.Hour); ok {
+		t.Fatal("period ended early")
+	}
+	results, start, end, ok := c.flush(0)
+	if !ok {
+		t.Fatal("period did not end")
+	}
+	config := &TLSReportingConfig{OrganizationName: "Example"}
+	r := newTLSReport(config, "example.com", results["example.com"], start, end)
+	data, err := r.gzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report tlsReport
+	if err := json.NewDecoder(g).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	p := report.Policies[0]
+	if p.Summary.Successful != 2 || p.Summary.Failed != 1 {
+		t.Fatalf("unexpected summary: %+v", p.Summary)
+	}
+	if !reflect.DeepEqual(p.FailureDetails, []tlsReportFailure{
+		{ResultType: tlsCertExpired, Server: "mx.example.com", Count: 1},
+	}) {
+		t.Fatalf("unexpected failures: %v", p.FailureDetails)
+	}
+	if _, err := tlsReportEmail(config, "example.com", "tls@example.com", r, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReportingDisabled(t *testing.T) {
+	var (
+		c = &Config{}
+		h = &Host{
+			shared: newShared(c),
+			config: c,
+			host:   "example.com",
+		}
+	)
+	h.tlsSuccess()
+	h.tlsFailure("mx.example.com", tlsStartTLSNotSupported)
+	if results, _, _, _ := h.tlsReports.flush(0); len(results) != 0 {
+		t.Fatalf("results collected while disabled: %v", results)
+	}
+	c.TLSReporting = &TLSReportingConfig{}
+	h.tlsSuccess()
+	if results, _, _, _ := h.tlsReports.flush(0); results["example.com"].successful != 1 {
+		t.Fatal("result not collected")
+	}
+}
+
+func TestPostTLSReportPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	for _, v := range []struct {
+		config  *Config
+		refused bool
+	}{
+		{&Config{}, true},
+		{&Config{PrivatePolicy: PrivateAllow}, false},
+		{&Config{PrivateAllowlist: []string{"127.0.0.0/8"}}, false},
+	} {
+		err := postTLSReport(v.config, srv.URL, []byte{})
+		if refused := errors.Is(err, errPrivateAddress); refused != v.refused {
+			t.Fatalf("%t != %t (%v)", refused, v.refused, err)
+		}
+		if !v.refused && err != nil {
+			t.Fatal(err)
+		}
+	}
+}
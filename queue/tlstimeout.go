@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"errors"
+	"net"
+)
+
+// Policies for TLS handshakes that time out after connecting. The message may
+// be deferred or, when STARTTLS is opportunistic, delivered after reconnecting
+// without TLS on the assumption that a middlebox is interfering with TLS.
+const (
+	TLSTimeoutRetry     = "retry"
+	TLSTimeoutCleartext = "cleartext"
+)
+
+// Error indicating that the TLS handshake timed out and that delivery should
+// be deferred.
+type tlsTimeoutError struct {
+	error
+}
+
+// Determine if the error was caused by a timeout.
+func isTimeout(err error) bool {
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
+
+// Handle a TLS handshake with the server that timed out according to the
+// host's policy.
+func (h *Host) tlsTimeout(server, hostname, sourceIP string, err error) (*connection, error) {
+	var (
+		hostConfig = h.config.hostConfig(h.host)
+		name, _, _ = serverAddr(server)
+	)
+	h.metrics.IncCounter(metricTLSTimeouts, map[string]string{
+		labelHost: h.hostLabel(),
+	})
+	if hostConfig.TLSPolicy != TLSRequired && hostConfig.TLSTimeoutPolicy == TLSTimeoutCleartext {
+		h.log.Warnf("%s: TLS handshake timed out, reconnecting without TLS", name)
+		h.recordDowngrade(name, DowngradeHandshakeFail)
+		c, err := h.tryMailServer(server, hostname, sourceIP, true)
+		if c != nil {
+			c.tlsTimedOut = true
+		}
+		return c, err
+	}
+	return nil, &tlsTimeoutError{err}
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Start a server that offers STARTTLS and then never completes the
+// handshake.
+func newStallingServer() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				t := textproto.NewConn(conn)
+				t.PrintfLine("220 stall")
+				for {
+					line, err := t.ReadLine()
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+					case "EHLO":
+						t.PrintfLine("250-stall\r\n250 STARTTLS")
+					case "STARTTLS":
+						t.PrintfLine("220 go ahead")
+						io.Copy(ioutil.Discard, conn)
+						return
+					default:
+						t.PrintfLine("500 unrecognized command")
+					}
+				}
+			}()
+		}
+	}()
+	return l, nil
+}
+
+func TestTLSTimeoutNextServer(t *testing.T) {
+	l, err := newStallingServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv, err := newMockServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	defer func(f func(string, map[string]int, string) ([]string, error)) {
+		findMailServers = f
+	}(findMailServers)
+	servers := []string{l.Addr().String(), srv.l.Addr().String()}
+	findMailServers = func(string, map[string]int, string) ([]string, error) {
+		return servers, nil
+	}
+	c := &Config{
+		PrivateAllowlist: []string{"127.0.0.0/8"},
+		Hosts: map[string]*HostConfig{
+			"example.com": {CommandTimeout: 1},
+		},
+	}
+	h := &Host{
+		shared: newShared(c),
+		config: c,
+		host:   "example.com",
+		log:    logrus.WithField("context", "example.com"),
+		stop:   make(chan bool),
+	}
+	conn, err := h.connectToMailServer("localhost", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	servers = servers[:1]
+	if _, err := h.connectToMailServer("localhost", "", ""); err == nil {
+		t.Fatal("error expected")
+	} else if _, ok := err.(*tlsTimeoutError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
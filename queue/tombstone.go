@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Determine the filename of the specified message once it is a tombstone.
+func (s *Storage) tombstoneFilename(m *Message) string {
+	return path.Join(s.directory, m.body, m.id) + tombstoneExtension
+}
+
+// Mark the specified message as a tombstone after it could not be deleted so
+// that it is not loaded (and delivered) again. The message file is renamed if
+// possible and the message is otherwise marked in place. If the message file
+// was already removed (and only the body remains), a new tombstone is
+// written. Removal of renamed and new tombstones is retried by
+// CollectTombstones and messages marked in place are removed at startup.
+func (s *Storage) TombstoneMessage(m *Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := os.Rename(s.messageFilename(m), s.tombstoneFilename(m))
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return s.writeTombstone(m)
+	}
+	m.Tombstone = true
+	return s.writeMessage(m)
+}
+
+// Write a tombstone for the message. The mutex must be held.
+func (s *Storage) writeTombstone(m *Message) error {
+	return writeFile(s.tombstoneFilename(m), m)
+}
+
+// Remove the message and then its body if no more messages exist. The mutex
+// must be held.
+func (s *Storage) removeTombstone(m *Message) error {
+	for _, f := range []string{s.tombstoneFilename(m), s.messageFilename(m)} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := s.removeBody(m); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Retry removal of tombstones, providing the number removed. The body
+// directories are checked whether or not the message body remains since
+// removal may have failed partway through. The mutex is only held while each
+// directory is processed.
+func (s *Storage) CollectTombstones() (int, error) {
+	directories, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var (
+		removed int
+		lastErr error
+	)
+	for _, d := range directories {
+		if !d.IsDir() {
+			continue
+		}
+		n, err := s.collectTombstones(d.Name())
+		if err != nil {
+			lastErr = err
+		}
+		removed += n
+	}
+	return removed, lastErr
+}
+
+// Remove the tombstones with the specified body, providing the number
+// removed.
+func (s *Storage) collectTombstones(body string) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var (
+		removed int
+		lastErr error
+	)
+	for _, m := range s.loadFiles(body, tombstoneExtension) {
+		if err := s.removeTombstone(m); err != nil {
+			lastErr = err
+			continue
+		}
+		removed++
+	}
+	return removed, lastErr
+}
+
+// Remove messages that could not be deleted once their delivery completed.
+func (q *Queue) collectTombstones() {
+	n, err := q.Storage.CollectTombstones()
+	if err != nil {
+		q.log.Error(err.Error())
+	}
+	if n > 0 {
+		q.log.Infof("removed %d message(s) that could not be deleted", n)
+	}
+}
@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTombstones(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		renamed = &Message{}
+		marked  = &Message{}
+		removed = &Message{}
+	)
+	for _, m := range []*Message{renamed, marked, removed} {
+		if err := s.SaveMessage(m, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.TombstoneMessage(renamed); err != nil {
+		t.Fatal(err)
+	}
+	marked.Tombstone = true
+	if err := s.UpdateMessage(marked); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.messageFilename(removed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TombstoneMessage(removed); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := s.LoadMessages(); err != nil {
+		t.Fatal(err)
+	} else if len(messages) != 0 {
+		t.Fatalf("%d != 0", len(messages))
+	}
+	if !s.messageExists(marked) {
+		t.Fatal("marked message removed while loading")
+	}
+	messages, err := s.loadMessagesConcurrently(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range messages {
+		t.Fatal("tombstone loaded")
+	}
+	if s.messageExists(marked) {
+		t.Fatal("marked message not removed at startup")
+	}
+	n, err := s.CollectTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("%d != 2", n)
+	}
+	if _, err := os.Stat(s.bodyDirectory(body)); !os.IsNotExist(err) {
+		t.Fatal("message body not removed")
+	}
+}
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Outcome of an attempt to deliver a message through a transport.
+type Result int
+
+const (
+	// The message was accepted for delivery
+	Delivered Result = iota
+
+	// Delivery failed temporarily and should be retried
+	Deferred
+
+	// Delivery failed permanently
+	Failed
+)
+
+// Means of delivering messages. SMTP delivery to the host's mail servers is
+// the default. The message body is provided as it would be sent over SMTP. An
+// error describing the problem should accompany Deferred and Failed results.
+type Transport interface {
+	Deliver(ctx context.Context, m *Message, body io.Reader) (Result, error)
+}
+
+// Marker for delivery to the host's mail servers over SMTP. The host queue
+// drives SMTP delivery itself rather than calling Deliver so that connections
+// can be reused and each reply handled according to its policies.
+type smtpTransport struct{}
+
+// SMTP delivery is never performed through the Transport interface.
+func (smtpTransport) Deliver(context.Context, *Message, io.Reader) (Result, error) {
+	return Failed, errSMTPTransport
+}
+
+// Determine the transport used for delivering to the host. A transport
+// provided by the application takes precedence over the built-in HTTP
+// providers, which take precedence over SMTP.
+func (h *Host) transport() Transport {
+	hostConfig := h.config.hostConfig(h.host)
+	if t, ok := h.config.Transports[hostConfig.Transport]; ok {
+		return t
+	}
+	if hostConfig.Capture {
+		return h.captured
+	}
+	if hostConfig.Mailgun != nil {
+		return NewMailgunTransport(hostConfig.Mailgun)
+	}
+	return smtpTransport{}
+}
+
+var (
+	// Error indicating that the host queue was shut down during delivery.
+	errStopped = errors.New("host queue was shut down")
+
+	// Error indicating that SMTP delivery was attempted through Deliver.
+	errSMTPTransport = errors.New("SMTP delivery is driven by the host queue")
+)
+
+// Attempt to deliver the message through the transport. The attempt is
+// abandoned if the host queue is shut down, in which case errStopped is
+// returned.
+func (h *Host) deliverWithTransport(t Transport, m *Message) (Result, error) {
+	start := time.Now()
+	r, err := h.openBody(m)
+	if err != nil {
+		if e, ok := err.(*dkimRequiredError); ok && e.policy == DKIMRequireDefer {
+			return Deferred, err
+		}
+		return Failed, err
+	}
+	defer r.Close()
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		body        = &countingReader{Reader: r}
+		result      Result
+		done        = make(chan bool)
+	)
+	defer cancel()
+	go func() {
+		result, err = t.Deliver(ctx, m, body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-h.stop:
+		cancel()
+		<-done
+		return Deferred, errStopped
+	}
+	if result == Delivered {
+		h.recordDelivery(start, body.n)
+	}
+	return result, err
+}
+
+// Reader that counts the number of bytes read.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
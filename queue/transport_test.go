@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestTransportSelection(t *testing.T) {
+	custom := NewMailgunTransport(&MailgunConfig{})
+	for _, v := range []struct {
+		hostConfig *HostConfig
+		check      func(Transport) bool
+	}{
+		{
+			&HostConfig{},
+			func(t Transport) bool { _, ok := t.(smtpTransport); return ok },
+		},
+		{
+			&HostConfig{Capture: true},
+			func(t Transport) bool { _, ok := t.(*CaptureStorage); return ok },
+		},
+		{
+			&HostConfig{Mailgun: &MailgunConfig{Domain: "example.com"}},
+			func(t Transport) bool { _, ok := t.(*MailgunTransport); return ok && t != custom },
+		},
+		{
+			&HostConfig{Transport: "custom", Capture: true},
+			func(t Transport) bool { return t == custom },
+		},
+	} {
+		c := &Config{
+			Hosts:      map[string]*HostConfig{"example.com": v.hostConfig},
+			Transports: map[string]Transport{"custom": custom},
+		}
+		h := &Host{
+			shared: newShared(c),
+			config: c,
+			host:   "example.com",
+		}
+		if tr := h.transport(); !v.check(tr) {
+			t.Fatalf("unexpected transport %T", tr)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"sync"
+)
+
+// Outcomes of a delivery attempt that can be logged at different levels.
+const (
+	LogSuccess   = "success"
+	LogTransient = "transient"
+	LogPermanent = "permanent"
+)
+
+// Levels used for each outcome unless configured otherwise.
+var defaultLogLevels = map[string]logrus.Level{
+	LogSuccess:   logrus.InfoLevel,
+	LogTransient: logrus.ErrorLevel,
+	LogPermanent: logrus.ErrorLevel,
+}
+
+// Determine the level at which the outcome is logged.
+func (c *Config) logLevel(outcome string) logrus.Level {
+	if l, err := logrus.ParseLevel(c.LogLevels[outcome]); err == nil {
+		return l
+	}
+	return defaultLogLevels[outcome]
+}
+
+// Levels that override the global log level for individual hosts, allowing
+// verbosity to be increased for a destination at runtime. All methods are
+// safe to call from multiple goroutines.
+type verbosityOverrides struct {
+	m      sync.Mutex
+	levels map[string]logrus.Level
+}
+
+// Create a new set of overrides.
+func newVerbosityOverrides() *verbosityOverrides {
+	return &verbosityOverrides{
+		levels: make(map[string]logrus.Level),
+	}
+}
+
+// Set the level for the host or remove its override if the level is empty.
+func (v *verbosityOverrides) set(host, level string) error {
+	v.m.Lock()
+	defer v.m.Unlock()
+	if level == "" {
+		delete(v.levels, host)
+		return nil
+	}
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	v.levels[host] = l
+	return nil
+}
+
+// Retrieve the level for the host if it has an override.
+func (v *verbosityOverrides) get(host string) (logrus.Level, bool) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	l, ok := v.levels[host]
+	return l, ok
+}
+
+// Retrieve the overrides for all hosts.
+func (v *verbosityOverrides) all() map[string]string {
+	v.m.Lock()
+	defer v.m.Unlock()
+	levels := make(map[string]string)
+	for h, l := range v.levels {
+		levels[h] = l.String()
+	}
+	return levels
+}
+
+// Switch the host's logger to reflect its current override. A separate logger
+// sharing the global output and formatter and a copy of its hooks is used for
+// hosts with an override since the level belongs to the logger. This must be called from
+// the host's goroutine.
+func (h *Host) updateLogger() {
+	var (
+		std   = logrus.StandardLogger()
+		l, ok = h.verbosity.get(h.host)
+	)
+	switch {
+	case ok && (h.log.Logger == std || h.log.Logger.GetLevel() != l):
+		logger := logrus.New()
+		logger.Out = std.Out
+		logger.Formatter = std.Formatter
+		logger.Hooks = make(logrus.LevelHooks)
+		for level, hooks := range std.Hooks {
+			logger.Hooks[level] = append([]logrus.Hook{}, hooks...)
+		}
+		logger.SetLevel(l)
+		h.log = logger.WithField("context", queueName(h.host, h.lane))
+	case !ok && h.log.Logger != std:
+		h.log = std.WithField("context", queueName(h.host, h.lane))
+	}
+}
+
+// Log a message describing the outcome of a delivery attempt at the level
+// configured for the outcome.
+func (h *Host) logOutcome(outcome, format string, args ...interface{}) {
+	h.log.Logf(h.config.logLevel(outcome), format, args...)
+}
@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerbosityOverrides(t *testing.T) {
+	v := newVerbosityOverrides()
+	if err := v.set("example.com", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.set("example.org", "invalid"); err == nil {
+		t.Fatal("error expected")
+	}
+	if l, ok := v.get("example.com"); !ok || l != logrus.DebugLevel {
+		t.Fatalf("%s != %s", l, logrus.DebugLevel)
+	}
+	if err := v.set("example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.get("example.com"); ok {
+		t.Fatal("override not removed")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	c := &Config{
+		LogLevels: map[string]string{LogSuccess: "debug"},
+	}
+	for _, v := range []struct {
+		outcome string
+		level   logrus.Level
+	}{
+		{LogSuccess, logrus.DebugLevel},
+		{LogTransient, logrus.ErrorLevel},
+		{LogPermanent, logrus.ErrorLevel},
+	} {
+		if l := c.logLevel(v.outcome); l != v.level {
+			t.Fatalf("%s: %s != %s", v.outcome, l, v.level)
+		}
+	}
+}
+
+// Hook that records the entries logged.
+type entryHook struct {
+	m       sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (e *entryHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (e *entryHook) Fire(entry *logrus.Entry) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.entries = append(e.entries, entry)
+	return nil
+}
+
+// Find the level of the first entry containing the text.
+func (e *entryHook) level(text string) (logrus.Level, bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for _, entry := range e.entries {
+		if strings.Contains(entry.Message, text) {
+			return entry.Level, true
+		}
+	}
+	return 0, false
+}
+
+func TestDeliveryLogLevels(t *testing.T) {
+	var (
+		std   = logrus.StandardLogger()
+		hooks = std.Hooks
+		hook  = &entryHook{}
+	)
+	std.Hooks = make(logrus.LevelHooks)
+	std.AddHook(hook)
+	defer func() {
+		std.Hooks = hooks
+	}()
+	srv, err := newMockServer(map[string][]string{
+		"body": {"451 try again", "550 rejected"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	defer func(d func(int) time.Duration) {
+		retryDelay = d
+	}(retryDelay)
+	retryDelay = func(int) time.Duration {
+		return time.Millisecond
+	}
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		metrics = &resultMetrics{make(chan string, 2)}
+		c       = &Config{
+			Directory: d,
+			Metrics:   metrics,
+			LogLevels: map[string]string{
+				LogTransient: "warning",
+				LogPermanent: "error",
+			},
+			Hosts: map[string]*HostConfig{
+				"example.com": {Servers: []string{srv.l.Addr().String()}},
+			},
+		}
+		s  = NewStorage(d)
+		sh = newShared(c)
+		m  = &Message{
+			Host: "example.com",
+			From: "me@example.org",
+			To:   []string{"you@example.com"},
+		}
+	)
+	if err := sh.verbosity.set("example.com", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	h := newHost(m.Host, laneDefault, s, c, sh)
+	defer h.Stop()
+	h.Deliver(m)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-metrics.results:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+	}
+	for _, v := range []struct {
+		text  string
+		level logrus.Level
+	}{
+		{"try again", logrus.WarnLevel},
+		{"rejected", logrus.ErrorLevel},
+	} {
+		if l, ok := hook.level(v.text); !ok || l != v.level {
+			t.Fatalf("%s: %s != %s", v.text, l, v.level)
+		}
+	}
+	if len(std.Hooks[logrus.InfoLevel]) != 1 {
+		t.Fatal("hooks of the standard logger were modified")
+	}
+}
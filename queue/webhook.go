@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Confirmation that a mail server accepted a message for a recipient, posted
+// to the success webhook as JSON. The recipient is omitted and Confidential
+// is set if the message is confidential.
+type RecipientDelivery struct {
+	ID           string    `json:"id"`
+	Recipient    string    `json:"recipient"`
+	Host         string    `json:"host"`
+	Server       string    `json:"server"`
+	Time         time.Time `json:"time"`
+	TLS          *TLSInfo  `json:"tls"`
+	Confidential bool      `json:"confidential"`
+}
+
+// Maximum number of confirmations being posted at once.
+const maxWebhookRequests = 20
+
+// Maximum number of confirmations waiting to be posted. Confirmations beyond
+// this are dropped rather than delaying delivery.
+const maxWebhookPending = 1000
+
+// Number of attempts made to post each confirmation.
+const maxWebhookAttempts = 5
+
+// Reasons for dropping a confirmation.
+const (
+	webhookQueueFull = "queue-full"
+	webhookFailed    = "failed"
+)
+
+// Delay before the first retry of a failed confirmation, doubled after each
+// attempt. Replaced during tests.
+var webhookRetryDelay = 5 * time.Second
+
+// Client used for posting confirmations.
+var webhookClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// Confirmation waiting to be posted.
+type webhookRequest struct {
+	url      string
+	delivery *RecipientDelivery
+}
+
+// Posts confirmations to the success webhook in the background, retrying
+// those that fail. All methods are safe to call from multiple goroutines.
+type webhookDispatcher struct {
+	m       sync.Mutex
+	log     *logrus.Entry
+	metrics Metrics
+	pending []*webhookRequest
+	workers int
+}
+
+// Create a new webhook dispatcher.
+func newWebhookDispatcher(m Metrics) *webhookDispatcher {
+	return &webhookDispatcher{
+		log:     logrus.WithField("context", "Webhook"),
+		metrics: m,
+	}
+}
+
+// Record that a confirmation was dropped.
+func (w *webhookDispatcher) drop(reason string) {
+	w.metrics.IncCounter(metricWebhookDropped, map[string]string{
+		labelReason: reason,
+	})
+}
+
+// Queue the confirmation for posting to the URL unless too many are already
+// waiting, starting another worker if fewer than the maximum are running.
+func (w *webhookDispatcher) send(u string, d *RecipientDelivery) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if len(w.pending) >= maxWebhookPending {
+		w.log.Warnf("dropping confirmation for %s", d.ID)
+		w.drop(webhookQueueFull)
+		return
+	}
+	w.pending = append(w.pending, &webhookRequest{u, d})
+	if w.workers < maxWebhookRequests {
+		w.workers++
+		go w.work()
+	}
+}
+
+// Retrieve the next confirmation to post or nil if there are none, in which
+// case the worker exits.
+func (w *webhookDispatcher) next() *webhookRequest {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if len(w.pending) == 0 {
+		w.workers--
+		return nil
+	}
+	r := w.pending[0]
+	w.pending[0] = nil
+	w.pending = w.pending[1:]
+	return r
+}
+
+// Post confirmations until none are waiting.
+func (w *webhookDispatcher) work() {
+	for r := w.next(); r != nil; r = w.next() {
+		w.post(r)
+	}
+}
+
+// Post the confirmation, retrying with exponential backoff if it fails.
+func (w *webhookDispatcher) post(r *webhookRequest) {
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(r.url, r.delivery)
+		if err == nil {
+			return
+		}
+		if attempt == maxWebhookAttempts {
+			w.log.Errorf("dropping confirmation for %s: %s", r.delivery.ID, err)
+			w.drop(webhookFailed)
+			return
+		}
+		w.log.Warnf("%s, retrying in %s", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Submit the confirmation to the URL.
+func postWebhook(u string, d *RecipientDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(u, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook request failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Determine if confirmations should be sent for the message, which is the
+// case if a webhook is configured and either the message or its sending
+// identity requests them.
+func (c *Config) notifySuccess(m *Message) bool {
+	if c.SuccessWebhook == "" {
+		return false
+	}
+	if m.NotifySuccess {
+		return true
+	}
+	i := c.sendingIdentity(m)
+	return i != nil && i.NotifySuccess
+}
+
+// Send a confirmation for each recipient the server accepted the message for
+// if the message requests them.
+func (h *Host) confirmDelivery(c *connection, m *Message, accepted []string) {
+	if !h.config.notifySuccess(m) {
+		return
+	}
+	now := time.Now()
+	for _, t := range accepted {
+		h.webhooks.send(h.config.SuccessWebhook, redactDelivery(m, &RecipientDelivery{
+			ID:        m.id,
+			Recipient: t,
+			Host:      h.host,
+			Server:    c.server,
+			Time:      now,
+			TLS:       c.tls,
+		}))
+	}
+}
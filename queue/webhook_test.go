@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifySuccess(t *testing.T) {
+	c := &Config{
+		SendingIdentities: map[string]*SendingIdentity{
+			"confirmed": {NotifySuccess: true},
+			"plain":     {},
+		},
+	}
+	for _, v := range []struct {
+		webhook string
+		message *Message
+		notify  bool
+	}{
+		{"", &Message{NotifySuccess: true}, false},
+		{"http://localhost", &Message{}, false},
+		{"http://localhost", &Message{NotifySuccess: true}, true},
+		{"http://localhost", &Message{SendingIdentity: "confirmed"}, true},
+		{"http://localhost", &Message{SendingIdentity: "plain"}, false},
+	} {
+		c.SuccessWebhook = v.webhook
+		if n := c.notifySuccess(v.message); n != v.notify {
+			t.Fatalf("%v != %v", n, v.notify)
+		}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	deliveries := make(chan *RecipientDelivery, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &RecipientDelivery{}
+		if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deliveries <- d
+	}))
+	defer srv.Close()
+	newWebhookDispatcher(nopMetrics{}).send(srv.URL, &RecipientDelivery{
+		ID:        "id",
+		Recipient: "you@example.com",
+		Server:    "mx.example.com",
+		TLS:       &TLSInfo{Version: "TLS 1.3"},
+	})
+	select {
+	case d := <-deliveries:
+		if d.Recipient != "you@example.com" || d.Server != "mx.example.com" ||
+			d.TLS == nil || d.TLS.Version != "TLS 1.3" {
+			t.Fatalf("unexpected confirmation: %v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for confirmation")
+	}
+}
+
+func TestConfirmConfidential(t *testing.T) {
+	deliveries := make(chan *RecipientDelivery, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &RecipientDelivery{}
+		if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deliveries <- d
+	}))
+	defer srv.Close()
+	c := &Config{SuccessWebhook: srv.URL}
+	h := &Host{
+		shared: newShared(c),
+		config: c,
+		host:   "example.com",
+	}
+	h.confirmDelivery(&connection{server: "mx.example.com"}, &Message{
+		id:            "id",
+		NotifySuccess: true,
+		Confidential:  true,
+	}, []string{"you@example.com"})
+	select {
+	case d := <-deliveries:
+		if d.Recipient != "" || !d.Confidential || d.ID != "id" {
+			t.Fatalf("unexpected confirmation: %v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for confirmation")
+	}
+}
+
+// Metrics backend that provides the reason each confirmation was dropped.
+type droppedMetrics struct {
+	nopMetrics
+	reasons chan string
+}
+
+func (d *droppedMetrics) IncCounter(name string, labels map[string]string) {
+	if name == metricWebhookDropped {
+		d.reasons <- labels[labelReason]
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	defer func(d time.Duration) {
+		webhookRetryDelay = d
+	}(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+	var (
+		m        sync.Mutex
+		failures = map[string]int{"retried": 2, "dropped": maxWebhookAttempts}
+		ids      = make(chan string, 1)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &RecipientDelivery{}
+		if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		if failures[d.ID] > 0 {
+			failures[d.ID]--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ids <- d.ID
+	}))
+	defer srv.Close()
+	var (
+		metrics = &droppedMetrics{reasons: make(chan string, 1)}
+		w       = newWebhookDispatcher(metrics)
+	)
+	w.send(srv.URL, &RecipientDelivery{ID: "retried"})
+	w.send(srv.URL, &RecipientDelivery{ID: "dropped"})
+	for _, v := range []struct {
+		c     chan string
+		value string
+	}{
+		{ids, "retried"},
+		{metrics.reasons, webhookFailed},
+	} {
+		select {
+		case value := <-v.c:
+			if value != v.value {
+				t.Fatalf("%s != %s", value, v.value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for confirmation")
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"time"
+)
+
+// Daily period during which delivery may be attempted. Times are in the
+// format "15:04" and the window may span midnight. A window that starts and
+// ends at the same time is always open.
+type SendingWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Name of the time zone for the window (defaults to UTC)
+	TimeZone string `json:"time-zone"`
+}
+
+// Convert a time of day to minutes past midnight.
+func minutes(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Parse the time zone and the start and end of the window.
+func (w *SendingWindow) parse() (*time.Location, int, int, error) {
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	start, err := minutes(w.Start)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	end, err := minutes(w.End)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return loc, start, end, nil
+}
+
+// Determine the earliest time at or after t that falls within the window.
+func (w *SendingWindow) next(t time.Time) (time.Time, error) {
+	loc, start, end, err := w.parse()
+	if err != nil {
+		return t, err
+	}
+	var (
+		l    = t.In(loc)
+		m    = l.Hour()*60 + l.Minute()
+		open bool
+	)
+	switch {
+	case start == end:
+		open = true
+	case start < end:
+		open = m >= start && m < end
+	default:
+		open = m >= start || m < end
+	}
+	if open {
+		return t, nil
+	}
+	s := time.Date(l.Year(), l.Month(), l.Day(), start/60, start%60, 0, 0, loc)
+	if s.Before(l) {
+		s = s.AddDate(0, 0, 1)
+	}
+	return s, nil
+}
+
+// Determine when the next delivery attempt may be made if it is delayed by
+// the specified duration. The window for the host takes precedence over the
+// global one.
+func (h *Host) nextAttempt(d time.Duration) time.Time {
+	var (
+		t = time.Now().Add(d)
+		w = h.config.hostConfig(h.host).SendingWindow
+	)
+	if w == nil {
+		w = h.config.SendingWindow
+	}
+	if w == nil {
+		return t
+	}
+	n, err := w.next(t)
+	if err != nil {
+		h.log.Error(err.Error())
+	}
+	return n
+}
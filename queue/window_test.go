@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendingWindow(t *testing.T) {
+	for _, d := range []struct {
+		window *SendingWindow
+		t, n   string
+	}{
+		{&SendingWindow{Start: "09:00", End: "17:00"}, "2016-01-04T10:00:00Z", "2016-01-04T10:00:00Z"},
+		{&SendingWindow{Start: "09:00", End: "17:00"}, "2016-01-04T08:00:00Z", "2016-01-04T09:00:00Z"},
+		{&SendingWindow{Start: "09:00", End: "17:00"}, "2016-01-04T18:00:00Z", "2016-01-05T09:00:00Z"},
+		{&SendingWindow{Start: "22:00", End: "06:00"}, "2016-01-04T03:00:00Z", "2016-01-04T03:00:00Z"},
+		{&SendingWindow{Start: "22:00", End: "06:00"}, "2016-01-04T12:00:00Z", "2016-01-04T22:00:00Z"},
+		{&SendingWindow{Start: "09:00", End: "17:00", TimeZone: "Etc/GMT+5"}, "2016-01-04T12:00:00Z", "2016-01-04T14:00:00Z"},
+		{&SendingWindow{Start: "09:00", End: "09:00"}, "2016-01-04T08:00:00Z", "2016-01-04T08:00:00Z"},
+		{&SendingWindow{Start: "09:00", End: "09:00"}, "2016-01-04T09:30:00Z", "2016-01-04T09:30:00Z"},
+	} {
+		tm, _ := time.Parse(time.RFC3339, d.t)
+		n, _ := time.Parse(time.RFC3339, d.n)
+		v, err := d.window.next(tm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.Equal(n) {
+			t.Fatalf("%s != %s", v, n)
+		}
+	}
+}
+
+func TestSendingWindowInvalid(t *testing.T) {
+	for _, w := range []*SendingWindow{
+		{Start: "9am", End: "17:00"},
+		{Start: "09:00", End: "25:00"},
+		{Start: "09:00", End: "17:00", TimeZone: "Nowhere/Special"},
+	} {
+		c := &Config{
+			Hosts: map[string]*HostConfig{
+				"example.com": {SendingWindow: w},
+			},
+		}
+		if err := c.load(); err == nil {
+			t.Fatalf("%v: error expected", w)
+		}
+		c = &Config{SendingWindow: w}
+		if err := c.load(); err == nil {
+			t.Fatalf("%v: error expected", w)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package smtp
+
+import (
+	"github.com/hectane/hectane/util"
+
+	"fmt"
+	"strings"
+)
+
+// Message received for one or more local domains.
+type InboundMessage struct {
+	From string
+	To   []string
+	Body string
+}
+
+// Evaluator of authentication for messages received for local domains. The
+// result is the value of the Authentication-Results header added to the
+// message. Implementations may also record failures for reporting.
+type InboundAuthEvaluator interface {
+	Evaluate(m *InboundMessage) (string, error)
+}
+
+// Results of each check performed on a message.
+type AuthResults struct {
+	DKIM  []*DKIMResult
+	DMARC *DMARCResult
+}
+
+// Determine if any check did not pass. Missing policies are not failures.
+func (a *AuthResults) failed() bool {
+	for _, r := range a.DKIM {
+		if r.Result != DKIMPass {
+			return true
+		}
+	}
+	return a.DMARC.Result != DMARCPass && a.DMARC.Result != DMARCNone
+}
+
+// Evaluator that checks the DKIM signatures in each message and whether any
+// that pass are aligned with the author domain's DMARC policy. SPF is not
+// evaluated since the SMTP library does not provide the client's address, so
+// DMARC passes only with an aligned DKIM signature. Results containing a
+// check that did not pass are provided to OnFailure, if set, such as for
+// aggregating failures into reports.
+type DMARCEvaluator struct {
+	AuthServID string
+	OnFailure  func(*InboundMessage, *AuthResults)
+}
+
+// Check the message and describe the results.
+func (e *DMARCEvaluator) Evaluate(m *InboundMessage) (string, error) {
+	var (
+		fields, _ = splitMessage(m.Body)
+		results   = &AuthResults{DKIM: VerifyDKIM(m.Body)}
+		parts     = []string{e.AuthServID}
+	)
+	if len(results.DKIM) == 0 {
+		parts = append(parts, "dkim=none")
+	}
+	for _, r := range results.DKIM {
+		p := "dkim=" + r.Result
+		if r.Reason != "" {
+			p += " (" + r.Reason + ")"
+		}
+		if r.Domain != "" {
+			p += " header.d=" + r.Domain
+		}
+		if r.Selector != "" {
+			p += " header.s=" + r.Selector
+		}
+		parts = append(parts, p)
+	}
+	results.DMARC = checkDMARC(fields, results.DKIM)
+	p := "dmarc=" + results.DMARC.Result
+	switch {
+	case results.DMARC.Reason != "":
+		p += " (" + results.DMARC.Reason + ")"
+	case results.DMARC.Policy != "":
+		p += " (p=" + results.DMARC.Policy + ")"
+	}
+	if results.DMARC.Domain != "" {
+		p += " header.from=" + results.DMARC.Domain
+	}
+	parts = append(parts, p)
+	if results.failed() && e.OnFailure != nil {
+		e.OnFailure(m, results)
+	}
+	return strings.Join(parts, ";\r\n\t"), nil
+}
+
+// Determine the authserv-id of an Authentication-Results header value.
+func authServID(value string) string {
+	if i := strings.Index(value, ";"); i != -1 {
+		value = value[:i]
+	}
+	if f := strings.Fields(value); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
+
+// Remove Authentication-Results headers that claim to have been added by the
+// specified authserv-id, since they cannot have been (RFC 8601 section 5).
+func removeAuthResults(body, id string) string {
+	fields, rest := splitMessage(body)
+	var b strings.Builder
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "Authentication-Results") {
+			value := strings.TrimSpace(f.raw[strings.Index(f.raw, ":")+1:])
+			if strings.EqualFold(authServID(value), id) {
+				continue
+			}
+		}
+		b.WriteString(f.raw)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(rest)
+	return b.String()
+}
+
+// Determine if any of the recipients belongs to a local domain.
+func (c *Config) isLocal(to []string) bool {
+	for _, t := range to {
+		domain := util.NormalizeDomain(t[strings.LastIndex(t, "@")+1:])
+		for _, d := range c.LocalDomains {
+			if util.NormalizeDomain(d) == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Provide the evaluator used for messages received for local domains. DMARC
+// is evaluated if no evaluator was provided but an authserv-id was
+// configured, with failures provided to the configured function.
+func (c *Config) authEvaluator() InboundAuthEvaluator {
+	if c.AuthEvaluator == nil && c.AuthServID != "" {
+		return &DMARCEvaluator{
+			AuthServID: c.AuthServID,
+			OnFailure:  c.AuthFailure,
+		}
+	}
+	return c.AuthEvaluator
+}
+
+// Error indicating that the evaluator panicked.
+type panicError struct {
+	value interface{}
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("panic during evaluation: %v", p.value)
+}
+
+// Run the evaluator, converting a panic into an error so that a malformed
+// message cannot bring down the server.
+func evaluate(e InboundAuthEvaluator, m *InboundMessage) (result string, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &panicError{v}
+		}
+	}()
+	return e.Evaluate(m)
+}
+
+// Evaluate authentication for messages received for local domains and add
+// the result to the message. Existing results claiming the same authserv-id
+// are removed first. The message is left unchanged if there is no evaluator
+// or the evaluation fails.
+func (s *Server) evaluateAuth(m *InboundMessage) string {
+	e := s.config.authEvaluator()
+	if e == nil || !s.config.isLocal(m.To) {
+		return m.Body
+	}
+	result, err := evaluate(e, m)
+	if err != nil {
+		s.log.Warnf("unable to evaluate authentication: %s", err)
+		return m.Body
+	}
+	body := m.Body
+	if id := authServID(result); id != "" {
+		body = removeAuthResults(body, id)
+	}
+	return "Authentication-Results: " + result + "\r\n" + body
+}
@@ -0,0 +1,269 @@
+package smtp
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Sign the message with the key, adding a DKIM-Signature header for the
+// selector "test" at example.com.
+func sign(t *testing.T, msg, algorithm string, key crypto.Signer) string {
+	fields, body := splitMessage(msg)
+	bh := sha256.Sum256([]byte(canonicalBody(body, "relaxed")))
+	sig := "DKIM-Signature: v=1; a=" + algorithm + "; c=relaxed/relaxed; d=example.com; s=test;\r\n" +
+		"\th=from:subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b=\r\n"
+	var data []byte
+	for _, f := range fields {
+		data = append(data, canonicalHeader(f.raw, "relaxed")...)
+	}
+	data = append(data, strings.TrimSuffix(canonicalHeader(sig, "relaxed"), "\r\n")...)
+	digest := sha256.Sum256(data)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	s, err := key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(sig, "\r\n") + base64.StdEncoding.EncodeToString(s) + "\r\n" + msg
+}
+
+func TestCanonicalization(t *testing.T) {
+	var (
+		fields, body = splitMessage("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")
+		headers      string
+	)
+	for _, f := range fields {
+		headers += canonicalHeader(f.raw, "relaxed")
+	}
+	if headers != "a:X\r\nb:Y Z\r\n" {
+		t.Fatalf("%q", headers)
+	}
+	if b := canonicalBody(body, "relaxed"); b != " C\r\nD E\r\n" {
+		t.Fatalf("%q", b)
+	}
+	if b := canonicalBody(body, "simple"); b != " C \r\nD \t E\r\n" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	defer func() {
+		lookupTXT = net.LookupTXT
+	}()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "From: me@example.com\r\nSubject: test\r\n\r\ntest\r\n"
+	for _, v := range []struct {
+		algorithm string
+		key       crypto.Signer
+		record    string
+	}{
+		{"rsa-sha256", rsaKey, "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		{"ed25519-sha256", edKey, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	} {
+		lookupTXT = func(name string) ([]string, error) {
+			if name != "test._domainkey.example.com" {
+				return nil, &net.DNSError{IsNotFound: true}
+			}
+			return []string{v.record}, nil
+		}
+		signed := sign(t, msg, v.algorithm, v.key)
+		for _, d := range []struct {
+			msg    string
+			result string
+		}{
+			{signed, DKIMPass},
+			{strings.Replace(signed, "Subject: test", "Subject:  test ", 1), DKIMPass},
+			{strings.Replace(signed, "Subject: test", "Subject: forged", 1), DKIMFail},
+			{signed + "forged\r\n", DKIMFail},
+			{strings.Replace(signed, "s=test", "s=other", 1), DKIMPermError},
+		} {
+			r := VerifyDKIM(d.msg)
+			if len(r) != 1 || r[0].Result != d.result {
+				t.Fatalf("%s: unexpected results: %v", v.algorithm, r[0])
+			}
+		}
+	}
+}
+
+func TestVerifyDKIMRejected(t *testing.T) {
+	defer func() {
+		lookupTXT = net.LookupTXT
+	}()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortPub, err := x509.MarshalPKIXPublicKey(&rsa.PublicKey{
+		N: new(big.Int).Lsh(big.NewInt(1), 511),
+		E: 65537,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		msg    = "From: me@example.com\r\nSubject: test\r\n\r\ntest\r\n"
+		signed = sign(t, msg, "rsa-sha256", rsaKey)
+		record = "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(rsaPub)
+	)
+	for _, d := range []struct {
+		name   string
+		msg    string
+		record string
+	}{
+		{
+			"field without colon",
+			strings.NewReplacer(
+				"h=from:subject", "h=from:bogus",
+				"Subject: test\r\n", "Subject: test\r\nbogus\r\n",
+			).Replace(signed),
+			record,
+		},
+		{
+			"short key",
+			signed,
+			"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(shortPub),
+		},
+		{
+			"SHA-1",
+			strings.Replace(signed, "a=rsa-sha256", "a=rsa-sha1", 1),
+			record,
+		},
+	} {
+		lookupTXT = func(string) ([]string, error) {
+			return []string{d.record}, nil
+		}
+		r := VerifyDKIM(d.msg)
+		if len(r) != 1 || r[0].Result != DKIMPermError {
+			t.Fatalf("%s: unexpected results: %v", d.name, r)
+		}
+	}
+}
+
+type panicEvaluator struct{}
+
+func (panicEvaluator) Evaluate(*InboundMessage) (string, error) {
+	panic(errors.New("test"))
+}
+
+func TestEvaluateAuthPanic(t *testing.T) {
+	s := &Server{
+		config: &Config{
+			LocalDomains:  []string{"example.org"},
+			AuthEvaluator: panicEvaluator{},
+		},
+		log: logrus.WithField("context", "SMTP"),
+	}
+	m := &InboundMessage{
+		From: "me@example.com",
+		To:   []string{"you@example.org"},
+		Body: "From: me@example.com\r\n\r\ntest\r\n",
+	}
+	if body := s.evaluateAuth(m); body != m.Body {
+		t.Fatal("message changed")
+	}
+}
+
+func TestEvaluateAuth(t *testing.T) {
+	defer stubDNS(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	})()
+	s := &Server{
+		config: &Config{
+			LocalDomains: []string{"example.org"},
+			AuthServID:   "mx.example.org",
+		},
+		log: logrus.WithField("context", "SMTP"),
+	}
+	m := &InboundMessage{
+		From: "me@example.com",
+		To:   []string{"you@example.org"},
+		Body: "Authentication-Results: mx.example.org; dkim=pass\r\n" +
+			"Authentication-Results: other.example.net; dkim=pass\r\n" +
+			"From: me@example.com\r\n\r\ntest\r\n",
+	}
+	body := s.evaluateAuth(m)
+	if !strings.HasPrefix(body, "Authentication-Results: mx.example.org;\r\n\tdkim=none;\r\n\t"+
+		"dmarc=fail (p=reject) header.from=example.com\r\n") {
+		t.Fatalf("%q", body)
+	}
+	if strings.Count(body, "mx.example.org") != 1 {
+		t.Fatal("forged result not removed")
+	}
+	if !strings.Contains(body, "other.example.net") {
+		t.Fatal("result from another server removed")
+	}
+	m.To = []string{"you@example.net"}
+	if body := s.evaluateAuth(m); body != m.Body {
+		t.Fatal("message for another domain changed")
+	}
+}
+
+func TestDMARCEvaluator(t *testing.T) {
+	defer stubDNS(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	})()
+	var (
+		failures int
+		c        = &Config{
+			AuthServID: "mx.example.org",
+			AuthFailure: func(*InboundMessage, *AuthResults) {
+				failures++
+			},
+		}
+		e = c.authEvaluator()
+	)
+	for _, d := range []struct {
+		from     string
+		result   string
+		failures int
+	}{
+		{"me@example.net", "mx.example.org;\r\n\tdkim=none;\r\n\t" +
+			"dmarc=none header.from=example.net", 0},
+		{"me@example.com", "mx.example.org;\r\n\tdkim=none;\r\n\t" +
+			"dmarc=fail (p=reject) header.from=example.com", 1},
+	} {
+		result, err := e.Evaluate(&InboundMessage{
+			From: d.from,
+			To:   []string{"you@example.org"},
+			Body: "From: " + d.from + "\r\n\r\ntest\r\n",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != d.result {
+			t.Fatalf("%q", result)
+		}
+		if failures != d.failures {
+			t.Fatalf("%d != %d", failures, d.failures)
+		}
+	}
+}
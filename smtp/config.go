@@ -11,6 +11,18 @@ import (
 type Config struct {
 	Addr        string `json:"addr"`
 	ReadTimeout int    `json:"read_timeout"`
+
+	// Domains for which mail is received and the evaluator used to add
+	// authentication results to messages for them
+	LocalDomains  []string             `json:"local_domains"`
+	AuthEvaluator InboundAuthEvaluator `json:"-"`
+
+	// Identifier of this server in Authentication-Results headers, which
+	// enables DMARC evaluation if no evaluator is provided, and the function
+	// that receives the results for messages failing a check, such as for
+	// aggregating failures into reports
+	AuthServID  string                              `json:"auth_serv_id"`
+	AuthFailure func(*InboundMessage, *AuthResults) `json:"-"`
 }
 
 // smtpsrvConfig converts the config into one suitable for smtpsrv.
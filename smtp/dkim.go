@@ -0,0 +1,417 @@
+package smtp
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results of verifying a DKIM signature, as used in Authentication-Results
+// headers (RFC 8601).
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMPermError = "permerror"
+	DKIMTempError = "temperror"
+)
+
+// Function used to look up DKIM keys, replaced during tests.
+var lookupTXT = net.LookupTXT
+
+// Minimum size of RSA keys (RFC 8301 section 3.2).
+const minRSAKeyBits = 1024
+
+// Result of verifying one DKIM signature in a message.
+type DKIMResult struct {
+	Domain   string
+	Selector string
+	Result   string
+	Reason   string
+}
+
+// Header field of a message. Raw contains the field exactly as it appears,
+// including folding and the final CRLF.
+type headerField struct {
+	name string
+	raw  string
+}
+
+// Split the message into its header fields and body. Messages using bare LF
+// line endings are converted to CRLF first.
+func splitMessage(msg string) ([]*headerField, string) {
+	if !strings.Contains(msg, "\r\n") {
+		msg = strings.Replace(msg, "\n", "\r\n", -1)
+	}
+	var (
+		fields []*headerField
+		body   string
+	)
+	for len(msg) > 0 {
+		if strings.HasPrefix(msg, "\r\n") {
+			body = msg[2:]
+			break
+		}
+		i := strings.Index(msg, "\r\n")
+		if i == -1 {
+			i = len(msg)
+		} else {
+			i += 2
+		}
+		line := msg[:i]
+		msg = msg[i:]
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if j := strings.Index(line, ":"); j != -1 {
+			name = line[:j]
+		}
+		fields = append(fields, &headerField{
+			name: strings.TrimSpace(name),
+			raw:  line,
+		})
+	}
+	return fields, body
+}
+
+// Replace each sequence of whitespace with a single space.
+func collapseWSP(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+}
+
+// Replace each sequence of whitespace within the line with a single space and
+// remove whitespace at the end of the line.
+func reduceWSP(line string) string {
+	var (
+		b   strings.Builder
+		wsp bool
+	)
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Canonicalize the header field using the simple or relaxed algorithm. The
+// field must contain a colon.
+func canonicalHeader(raw, canon string) string {
+	if canon != "relaxed" {
+		return raw
+	}
+	var (
+		i     = strings.Index(raw, ":")
+		name  = strings.ToLower(strings.TrimSpace(raw[:i]))
+		value = strings.Replace(raw[i+1:], "\r\n", "", -1)
+	)
+	return name + ":" + strings.TrimSpace(collapseWSP(value)) + "\r\n"
+}
+
+// Canonicalize the body using the simple or relaxed algorithm.
+func canonicalBody(body, canon string) string {
+	lines := strings.Split(body, "\r\n")
+	if canon == "relaxed" {
+		for i, l := range lines {
+			lines[i] = reduceWSP(l)
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canon == "relaxed" {
+			return ""
+		}
+		return "\r\n"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Parse a tag list (RFC 6376 section 3.2). Whitespace is removed from values.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ";") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		i := strings.Index(t, "=")
+		if i == -1 {
+			return nil, errors.New("malformed tag")
+		}
+		var (
+			name  = strings.TrimSpace(t[:i])
+			value = strings.Join(strings.Fields(t[i+1:]), "")
+		)
+		if _, ok := tags[name]; ok {
+			return nil, errors.New("duplicate tag " + name)
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// Remove the value of the b= tag from the signature header field.
+func stripSignature(raw string) string {
+	parts := strings.Split(raw, ";")
+	for i, p := range parts {
+		j := strings.Index(p, "=")
+		if j == -1 {
+			continue
+		}
+		name := p[:j]
+		if i == 0 {
+			name = name[strings.Index(name, ":")+1:]
+		}
+		if strings.TrimSpace(name) == "b" {
+			end := ""
+			if i == len(parts)-1 && strings.HasSuffix(p, "\r\n") {
+				end = "\r\n"
+			}
+			parts[i] = p[:j+1] + end
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// Public key from a DKIM key record.
+type dkimKey struct {
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+	hashes  []string
+}
+
+// Look up and parse the key for the selector and domain. A temporary error
+// is indicated by the boolean result.
+func lookupDKIMKey(selector, domain string) (*dkimKey, bool, error) {
+	records, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return nil, false, errors.New("no key for signature")
+		}
+		return nil, true, err
+	}
+	if len(records) == 0 {
+		return nil, false, errors.New("no key for signature")
+	}
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, false, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, false, errors.New("unsupported key version")
+	}
+	if tags["p"] == "" {
+		return nil, false, errors.New("key revoked")
+	}
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, false, err
+	}
+	k := &dkimKey{}
+	if h, ok := tags["h"]; ok {
+		k.hashes = strings.Split(h, ":")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(p)
+		if err != nil {
+			if k.rsa, err = x509.ParsePKCS1PublicKey(p); err != nil {
+				return nil, false, err
+			}
+		} else {
+			var ok bool
+			if k.rsa, ok = pub.(*rsa.PublicKey); !ok {
+				return nil, false, errors.New("key is not an RSA key")
+			}
+		}
+		if k.rsa.N.BitLen() < minRSAKeyBits {
+			return nil, false, errors.New("RSA key is too short")
+		}
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, false, errors.New("invalid Ed25519 key")
+		}
+		k.ed25519 = ed25519.PublicKey(p)
+	default:
+		return nil, false, errors.New("unsupported key type")
+	}
+	return k, false, nil
+}
+
+// Verify the signature in the header field against the message.
+func verifySignature(sig *headerField, fields []*headerField, body string) *DKIMResult {
+	r := &DKIMResult{}
+	fail := func(result, reason string) *DKIMResult {
+		r.Result = result
+		r.Reason = reason
+		return r
+	}
+	i := strings.Index(sig.raw, ":")
+	if i == -1 {
+		return fail(DKIMPermError, "malformed header field")
+	}
+	tags, err := parseTags(sig.raw[i+1:])
+	if err != nil {
+		return fail(DKIMPermError, err.Error())
+	}
+	r.Domain = tags["d"]
+	r.Selector = tags["s"]
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return fail(DKIMPermError, "missing "+t+"= tag")
+		}
+	}
+	if tags["v"] != "1" {
+		return fail(DKIMPermError, "unsupported version")
+	}
+	var (
+		algorithm = strings.SplitN(tags["a"], "-", 2)
+		newHash   func() hash.Hash
+		cryptoAlg crypto.Hash
+	)
+	if len(algorithm) != 2 {
+		return fail(DKIMPermError, "unsupported algorithm")
+	}
+	switch algorithm[1] {
+	case "sha256":
+		newHash, cryptoAlg = sha256.New, crypto.SHA256
+	default:
+		// SHA-1 is no longer permitted (RFC 8301 section 3.1)
+		return fail(DKIMPermError, "unsupported algorithm")
+	}
+	signed := strings.Split(tags["h"], ":")
+	from := false
+	for _, h := range signed {
+		if strings.EqualFold(strings.TrimSpace(h), "from") {
+			from = true
+		}
+	}
+	if !from {
+		return fail(DKIMPermError, "From field not signed")
+	}
+	if x, ok := tags["x"]; ok {
+		t, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(DKIMPermError, "invalid expiration")
+		}
+		if time.Now().Unix() > t {
+			return fail(DKIMFail, "signature expired")
+		}
+	}
+	var (
+		canon       = strings.SplitN(tags["c"], "/", 2)
+		headerCanon = "simple"
+		bodyCanon   = "simple"
+	)
+	if canon[0] != "" {
+		headerCanon = canon[0]
+	}
+	if len(canon) == 2 {
+		bodyCanon = canon[1]
+	}
+	b := canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(b) {
+			return fail(DKIMPermError, "invalid body length")
+		}
+		b = b[:n]
+	}
+	h := newHash()
+	h.Write([]byte(b))
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != tags["bh"] {
+		return fail(DKIMFail, "body hash did not verify")
+	}
+	key, temporary, err := lookupDKIMKey(r.Selector, r.Domain)
+	if err != nil {
+		if temporary {
+			return fail(DKIMTempError, err.Error())
+		}
+		return fail(DKIMPermError, err.Error())
+	}
+	if key.hashes != nil {
+		allowed := false
+		for _, a := range key.hashes {
+			if a == algorithm[1] {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fail(DKIMPermError, "hash algorithm not allowed by key")
+		}
+	}
+	var (
+		used = make(map[*headerField]bool)
+		data []byte
+	)
+	for _, name := range signed {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if f := fields[i]; !used[f] && strings.EqualFold(f.name, name) {
+				if !strings.Contains(f.raw, ":") {
+					return fail(DKIMPermError, "malformed header field")
+				}
+				used[f] = true
+				data = append(data, canonicalHeader(f.raw, headerCanon)...)
+				break
+			}
+		}
+	}
+	data = append(data, strings.TrimSuffix(canonicalHeader(stripSignature(sig.raw), headerCanon), "\r\n")...)
+	s, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fail(DKIMPermError, "invalid signature encoding")
+	}
+	h = newHash()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch {
+	case algorithm[0] == "rsa" && key.rsa != nil:
+		err = rsa.VerifyPKCS1v15(key.rsa, cryptoAlg, digest, s)
+	case algorithm[0] == "ed25519" && key.ed25519 != nil && cryptoAlg == crypto.SHA256:
+		if !ed25519.Verify(key.ed25519, digest, s) {
+			err = errors.New("invalid signature")
+		}
+	default:
+		return fail(DKIMPermError, "algorithm does not match key")
+	}
+	if err != nil {
+		return fail(DKIMFail, "signature did not verify")
+	}
+	r.Result = DKIMPass
+	return r
+}
+
+// Verify each DKIM signature in the message (RFC 6376 and RFC 8463). Signed
+// header fields are selected from the bottom of the header up.
+func VerifyDKIM(msg string) []*DKIMResult {
+	var (
+		fields, body = splitMessage(msg)
+		results      = []*DKIMResult{}
+	)
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "DKIM-Signature") {
+			results = append(results, verifySignature(f, fields, body))
+		}
+	}
+	return results
+}
@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"github.com/hectane/hectane/util"
+
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// Results of evaluating a DMARC policy, as used in Authentication-Results
+// headers (RFC 8601).
+const (
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none"
+	DMARCPermError = "permerror"
+	DMARCTempError = "temperror"
+)
+
+// Result of evaluating the DMARC policy for the author domain of a message.
+type DMARCResult struct {
+	Domain string
+	Policy string
+	Result string
+	Reason string
+}
+
+// Determine the organizational domain, which is approximated as the last two
+// labels of the domain since the public suffix list is not available.
+func orgDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// Determine if the identifier is aligned with the author domain in the
+// relaxed or strict mode (RFC 7489 section 3.1).
+func aligned(id, domain, mode string) bool {
+	id, domain = util.NormalizeDomain(id), util.NormalizeDomain(domain)
+	if mode == "s" {
+		return id == domain
+	}
+	return orgDomain(id) == orgDomain(domain)
+}
+
+// Find the domain in the From header field, which must contain exactly one
+// address.
+func authorDomain(fields []*headerField) (string, bool) {
+	var value string
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "From") {
+			if value != "" {
+				return "", false
+			}
+			i := strings.Index(f.raw, ":")
+			if i == -1 {
+				return "", false
+			}
+			value = f.raw[i+1:]
+		}
+	}
+	addrs, err := mail.ParseAddressList(strings.Replace(value, "\r\n", "", -1))
+	if err != nil || len(addrs) != 1 {
+		return "", false
+	}
+	a := addrs[0].Address
+	return util.NormalizeDomain(a[strings.LastIndex(a, "@")+1:]), true
+}
+
+// Look up the DMARC policy for the domain, falling back to the organizational
+// domain. A temporary error is indicated by the boolean result.
+func lookupDMARC(domain string) (map[string]string, bool, error) {
+	var records []string
+	for i, d := range []string{domain, orgDomain(domain)} {
+		if i > 0 && d == domain {
+			break
+		}
+		r, err := lookupTXT("_dmarc." + d)
+		if err != nil {
+			if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+				continue
+			}
+			return nil, true, err
+		}
+		for _, v := range r {
+			if strings.HasPrefix(v, "v=DMARC1") {
+				records = append(records, v)
+			}
+		}
+		if len(records) > 0 {
+			tags, err := parseTags(records[0])
+			if err != nil {
+				return nil, false, err
+			}
+			if d != domain && tags["sp"] != "" {
+				tags["p"] = tags["sp"]
+			}
+			return tags, false, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Evaluate the DMARC policy of the author domain (RFC 7489). The message
+// passes if a DKIM result that passed is aligned with the domain. SPF is not
+// evaluated, so the aspf tag is ignored.
+func checkDMARC(fields []*headerField, dkim []*DKIMResult) *DMARCResult {
+	r := &DMARCResult{}
+	domain, ok := authorDomain(fields)
+	if !ok {
+		r.Result = DMARCPermError
+		r.Reason = "From field must contain one address"
+		return r
+	}
+	r.Domain = domain
+	tags, temporary, err := lookupDMARC(domain)
+	if err != nil {
+		r.Result = DMARCPermError
+		if temporary {
+			r.Result = DMARCTempError
+		}
+		r.Reason = err.Error()
+		return r
+	}
+	if tags == nil {
+		r.Result = DMARCNone
+		return r
+	}
+	switch tags["p"] {
+	case "none", "quarantine", "reject":
+		r.Policy = tags["p"]
+	default:
+		r.Result = DMARCPermError
+		r.Reason = "invalid policy"
+		return r
+	}
+	r.Result = DMARCFail
+	for _, d := range dkim {
+		if d.Result == DKIMPass && aligned(d.Domain, domain, tags["adkim"]) {
+			r.Result = DMARCPass
+		}
+	}
+	return r
+}
@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+)
+
+// Replace TXT lookups with ones that use the records.
+func stubDNS(txt map[string][]string) func() {
+	lookupTXT = func(name string) ([]string, error) {
+		if r, ok := txt[name]; ok {
+			return r, nil
+		}
+		return nil, &net.DNSError{IsNotFound: true}
+	}
+	return func() {
+		lookupTXT = net.LookupTXT
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	defer stubDNS(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine; adkim=s"},
+		"_dmarc.example.org": {"v=DMARC1; p=none"},
+		"_dmarc.example.net": {"v=DMARC1; p=bogus"},
+	})()
+	for _, d := range []struct {
+		from   string
+		dkim   []*DKIMResult
+		result string
+		policy string
+	}{
+		{"me@example.com", []*DKIMResult{{Domain: "example.com", Result: DKIMPass}}, DMARCPass, "reject"},
+		{"me@example.com", []*DKIMResult{{Domain: "mail.example.com", Result: DKIMPass}}, DMARCFail, "reject"},
+		{"me@example.com", []*DKIMResult{{Domain: "example.com", Result: DKIMFail}}, DMARCFail, "reject"},
+		{"me@mail.example.com", nil, DMARCFail, "quarantine"},
+		{"me@example.org", []*DKIMResult{{Domain: "mail.example.org", Result: DKIMPass}}, DMARCPass, "none"},
+		{"me@example.net", nil, DMARCPermError, ""},
+		{"me@example.info", nil, DMARCNone, ""},
+		{"me@example.com, you@example.com", nil, DMARCPermError, ""},
+	} {
+		fields, _ := splitMessage("From: " + d.from + "\r\n\r\ntest\r\n")
+		r := checkDMARC(fields, d.dkim)
+		if r.Result != d.result || r.Policy != d.policy {
+			t.Fatalf("%s: %s (p=%s) != %s (p=%s)", d.from, r.Result, r.Policy, d.result, d.policy)
+		}
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"github.com/hectane/go-smtpsrv"
 	"github.com/hectane/hectane/email"
 	"github.com/hectane/hectane/queue"
+
+	"time"
 )
 
 // Server awaits incoming connections and delivers them to the mail queue.
 type Server struct {
 	server *smtpsrv.Server
+	config *Config
 	queue  *queue.Queue
 	log    *logrus.Entry
 }
@@ -21,7 +24,15 @@ func (s *Server) run() {
 		raw := email.Raw{
 			From: m.From,
 			To:   m.To,
-			Body: m.Body,
+			Body: s.evaluateAuth(&InboundMessage{
+				From: m.From,
+				To:   m.To,
+				Body: m.Body,
+			}),
+			Submission: &queue.Submission{
+				Protocol: queue.SubmissionSMTP,
+				Time:     time.Now(),
+			},
 		}
 		if err := raw.DeliverToQueue(s.queue); err != nil {
 			s.log.Error(err.Error())
@@ -37,6 +48,7 @@ func New(c *Config, q *queue.Queue) (*Server, error) {
 	}
 	s := &Server{
 		server: server,
+		config: c,
 		queue:  q,
 		log:    logrus.WithField("context", "SMTP"),
 	}
@@ -0,0 +1,14 @@
+package util
+
+import (
+	"golang.org/x/net/idna"
+)
+
+// Convert a domain name to the form used in DNS (A-labels). The name is
+// mapped according to UTS #46 (including case folding, width mapping and
+// normalization) before labels are encoded with Punycode, so that every form
+// of a name that resolves to the same domain is converted to the same A-labels.
+// An error is returned if the name is not a valid domain name.
+func ToASCII(domain string) (string, error) {
+	return idna.Lookup.ToASCII(domain)
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	for _, d := range []struct {
+		domain string
+		ascii  string
+	}{
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"München.de", "xn--mnchen-3ya.de"},
+		{"例え.jp", "xn--r8jz45g.jp"},
+		{"ＥＸＡＭＰＬＥ.com", "example.com"},
+		{"bu\u0308cher.example", "xn--bcher-kva.example"},
+	} {
+		a, err := ToASCII(d.domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != d.ascii {
+			t.Fatalf("%s != %s", a, d.ascii)
+		}
+	}
+	for _, d := range []string{"exa mple.com", "xn--a.example"} {
+		if _, err := ToASCII(d); err == nil {
+			t.Fatalf("%s: error expected", d)
+		}
+	}
+}
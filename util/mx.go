@@ -0,0 +1,175 @@
+package util
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Policies for MX records that point to an alias (CNAME), which RFC 5321
+// forbids. The alias may be used as-is (leaving the resolver to follow it when
+// connecting and verifying the certificate against the MX name), replaced by
+// the canonical name at the end of the chain or ignored.
+const (
+	CNAMEFollow    = "follow"
+	CNAMECanonical = "canonical"
+	CNAMEReject    = "reject"
+)
+
+// Lookup and random number functions, replaced during tests.
+var (
+	lookupMX    = net.LookupMX
+	lookupHost  = net.LookupHost
+	lookupCNAME = net.LookupCNAME
+	randIntn    = rand.Intn
+)
+
+// Determine if the error indicates that the requested records do not exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
+
+// Find the mail servers for the specified host. MX records are checked first.
+// If one or more were found, they are returned sorted by priority. If none
+// were found but the host has an address, the host itself is returned. An
+// empty list indicates that the host does not accept mail, either because it
+// does not exist or because it publishes a null MX record (RFC 7505). An error
+// is returned only if the lookup failed and should be retried.
+func FindMailServers(host string) ([]string, error) {
+	return FindWeightedMailServers(host, nil, CNAMEFollow)
+}
+
+// Find the mail servers for the specified host as with FindMailServers.
+// Servers with equal priority are ordered randomly in proportion to their
+// weights, so that the first is more likely to be one with a higher weight.
+// Servers without a weight have a weight of 1. MX records that point to an
+// alias are handled according to the CNAME policy.
+func FindWeightedMailServers(host string, weights map[string]int, cnamePolicy string) ([]string, error) {
+	r, err := lookupMX(host)
+	if err == nil && len(r) != 0 {
+		servers := make([]string, 0, len(r))
+		for i := 0; i < len(r); {
+			j := i + 1
+			for j < len(r) && r[j].Pref == r[i].Pref {
+				j++
+			}
+			group := []string{}
+			for _, r := range r[i:j] {
+				s := strings.TrimSuffix(r.Host, ".")
+				if s == "" {
+					continue
+				}
+				s, err := resolveCNAME(s, cnamePolicy)
+				if err != nil {
+					return nil, err
+				}
+				if s != "" {
+					group = append(group, s)
+				}
+			}
+			if len(weights) != 0 {
+				group = weightedOrder(group, weights)
+			}
+			servers = append(servers, group...)
+			i = j
+		}
+		return servers, nil
+	}
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if _, err := lookupHost(host); err != nil {
+		if isNotFound(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	return []string{host}, nil
+}
+
+// Determine if the host publishes a null MX record (RFC 7505), indicating
+// that it explicitly accepts no mail. An error is returned only if the lookup
+// failed and should be retried.
+func IsNullMX(host string) (bool, error) {
+	r, err := lookupMX(host)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(r) == 1 && strings.TrimSuffix(r[0].Host, ".") == "", nil
+}
+
+// Apply the CNAME policy to the MX target. An empty string is returned if the
+// target should be ignored.
+func resolveCNAME(server, policy string) (string, error) {
+	if policy != CNAMECanonical && policy != CNAMEReject {
+		return server, nil
+	}
+	cname, err := lookupCNAME(server)
+	if err != nil {
+		if isNotFound(err) {
+			return server, nil
+		}
+		return "", err
+	}
+	cname = strings.TrimSuffix(cname, ".")
+	if strings.EqualFold(cname, server) {
+		return server, nil
+	}
+	if policy == CNAMEReject {
+		return "", nil
+	}
+	return cname, nil
+}
+
+// Order the servers by repeatedly selecting one of the remaining servers with
+// probability proportional to its weight.
+func weightedOrder(servers []string, weights map[string]int) []string {
+	var (
+		remaining = append([]string{}, servers...)
+		ordered   = make([]string, 0, len(servers))
+	)
+	weight := func(s string) int {
+		if w, ok := weights[NormalizeDomain(s)]; ok && w > 0 {
+			return w
+		}
+		return 1
+	}
+	for len(remaining) > 0 {
+		total := 0
+		for _, s := range remaining {
+			total += weight(s)
+		}
+		n := randIntn(total)
+		for i, s := range remaining {
+			if n -= weight(s); n < 0 {
+				ordered = append(ordered, s)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// Reorder the servers according to the priorities, where lower values are
+// preferred as with MX records. Servers with a priority come first and those
+// without one follow in their original order.
+func PrioritizeMailServers(servers []string, priorities map[string]int) []string {
+	ordered := append([]string{}, servers...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		pi, iok := priorities[NormalizeDomain(ordered[i])]
+		pj, jok := priorities[NormalizeDomain(ordered[j])]
+		switch {
+		case iok && jok:
+			return pi < pj
+		default:
+			return iok && !jok
+		}
+	})
+	return ordered
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestFindMailServers(t *testing.T) {
+	defer func() {
+		lookupMX = net.LookupMX
+		lookupHost = net.LookupHost
+	}()
+	var (
+		notFound  = &net.DNSError{IsNotFound: true}
+		temporary = &net.DNSError{IsTemporary: true}
+		data      = []struct {
+			mx      []*net.MX
+			mxErr   error
+			hostErr error
+			servers []string
+			err     bool
+		}{
+			{[]*net.MX{{Host: "mx1.example.com."}, {Host: "mx2.example.com."}}, nil, nil, []string{"mx1.example.com", "mx2.example.com"}, false},
+			{[]*net.MX{{Host: "."}}, nil, nil, []string{}, false},
+			{nil, notFound, nil, []string{"example.com"}, false},
+			{nil, notFound, notFound, []string{}, false},
+			{nil, temporary, nil, nil, true},
+			{nil, notFound, temporary, nil, true},
+		}
+	)
+	for _, d := range data {
+		lookupMX = func(string) ([]*net.MX, error) {
+			return d.mx, d.mxErr
+		}
+		lookupHost = func(string) ([]string, error) {
+			return nil, d.hostErr
+		}
+		servers, err := FindMailServers("example.com")
+		if d.err != (err != nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(servers, d.servers) {
+			t.Fatalf("%v != %v", servers, d.servers)
+		}
+	}
+}
+
+func TestIsNullMX(t *testing.T) {
+	defer func() {
+		lookupMX = net.LookupMX
+	}()
+	for _, d := range []struct {
+		mx   []*net.MX
+		err  error
+		null bool
+	}{
+		{[]*net.MX{{Host: "."}}, nil, true},
+		{[]*net.MX{{Host: "mx.example.com."}}, nil, false},
+		{nil, &net.DNSError{IsNotFound: true}, false},
+	} {
+		lookupMX = func(string) ([]*net.MX, error) {
+			return d.mx, d.err
+		}
+		null, err := IsNullMX("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if null != d.null {
+			t.Fatalf("%t != %t", null, d.null)
+		}
+	}
+}
+
+func TestFindWeightedMailServers(t *testing.T) {
+	defer func() {
+		lookupMX = net.LookupMX
+		randIntn = rand.Intn
+	}()
+	lookupMX = func(string) ([]*net.MX, error) {
+		return []*net.MX{
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "mx2.example.com.", Pref: 10},
+			{Host: "mx3.example.com.", Pref: 20},
+		}, nil
+	}
+	weights := map[string]int{"mx2.example.com": 3}
+	for _, d := range []struct {
+		n       int
+		servers []string
+	}{
+		{0, []string{"mx1.example.com", "mx2.example.com", "mx3.example.com"}},
+		{1, []string{"mx2.example.com", "mx1.example.com", "mx3.example.com"}},
+		{3, []string{"mx2.example.com", "mx1.example.com", "mx3.example.com"}},
+	} {
+		first := true
+		randIntn = func(total int) int {
+			if first {
+				first = false
+				return d.n
+			}
+			return 0
+		}
+		servers, err := FindWeightedMailServers("example.com", weights, CNAMEFollow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(servers, d.servers) {
+			t.Fatalf("%v != %v", servers, d.servers)
+		}
+	}
+}
+
+func TestPrioritizeMailServers(t *testing.T) {
+	var (
+		servers    = []string{"mx1.example.com", "mx2.example.com", "mx3.example.com", "mx4.example.com"}
+		priorities = map[string]int{"mx3.example.com": 10, "mx2.example.com": 20}
+		expected   = []string{"mx3.example.com", "mx2.example.com", "mx1.example.com", "mx4.example.com"}
+	)
+	if s := PrioritizeMailServers(servers, priorities); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("%v != %v", s, expected)
+	}
+}
+
+func TestFindMailServersCNAME(t *testing.T) {
+	defer func() {
+		lookupMX = net.LookupMX
+		lookupCNAME = net.LookupCNAME
+	}()
+	lookupMX = func(string) ([]*net.MX, error) {
+		return []*net.MX{
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "alias.example.com.", Pref: 20},
+		}, nil
+	}
+	lookupCNAME = func(host string) (string, error) {
+		if host == "alias.example.com" {
+			return "mx.provider.net.", nil
+		}
+		return host + ".", nil
+	}
+	for _, d := range []struct {
+		policy  string
+		servers []string
+	}{
+		{CNAMEFollow, []string{"mx1.example.com", "alias.example.com"}},
+		{CNAMECanonical, []string{"mx1.example.com", "mx.provider.net"}},
+		{CNAMEReject, []string{"mx1.example.com"}},
+	} {
+		servers, err := FindWeightedMailServers("example.com", nil, d.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(servers, d.servers) {
+			t.Fatalf("%s: %v != %v", d.policy, servers, d.servers)
+		}
+	}
+}
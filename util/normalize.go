@@ -0,0 +1,50 @@
+package util
+
+import (
+	"strings"
+)
+
+// Rules for normalizing the local part of addresses at a specific domain.
+type NormalizeRule struct {
+	IgnoreDots bool `json:"ignore-dots"`
+	IgnorePlus bool `json:"ignore-plus"`
+}
+
+// Map of domain names to the rules used for normalizing their addresses.
+type NormalizeRules map[string]NormalizeRule
+
+// Split an address into its local part and domain. The domain is empty if the
+// address does not contain an "@".
+func splitAddress(addr string) (string, string) {
+	i := strings.LastIndex(addr, "@")
+	if i == -1 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
+
+// Normalize a domain name so that it can be used for comparisons.
+func NormalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// Normalize an address so that equivalent addresses compare equal. The domain
+// is always lowercased and the local part is modified according to the rules
+// for the domain (if any). The result is only suitable for grouping addresses
+// internally and must never be used as the address during delivery.
+func NormalizeAddress(addr string, rules NormalizeRules) string {
+	local, domain := splitAddress(addr)
+	domain = NormalizeDomain(domain)
+	if r, ok := rules[domain]; ok {
+		if r.IgnorePlus {
+			if i := strings.Index(local, "+"); i != -1 {
+				local = local[:i]
+			}
+		}
+		if r.IgnoreDots {
+			local = strings.Replace(local, ".", "", -1)
+		}
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	var (
+		rules = NormalizeRules{
+			"gmail.com": NormalizeRule{
+				IgnoreDots: true,
+				IgnorePlus: true,
+			},
+		}
+		data = []struct {
+			i, o string
+		}{
+			{"User@Example.COM", "User@example.com"},
+			{"first.last@example.com", "first.last@example.com"},
+			{"First.Last+news@GMail.com", "firstlast@gmail.com"},
+			{"a.b.c@gmail.com", "abc@gmail.com"},
+		}
+	)
+	for _, d := range data {
+		if o := NormalizeAddress(d.i, rules); o != d.o {
+			t.Fatalf("%s != %s", o, d.o)
+		}
+	}
+}